@@ -2,27 +2,42 @@ package cmd
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2"
 	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
 )
 
+const (
+	cleanupFlagRunID        = "run-id"
+	cleanupFlagJournal      = "journal"
+	cleanupFlagOlderThan    = "older-than"
+	cleanupFlagIgnoreActive = "ignore-active"
+	cleanupFlagDryRun       = "dry-run"
+)
+
 // cleanupCmd represents the cleanup command
 var cleanupCmd = &cobra.Command{
 	Use:   "cleanup",
 	Short: "Remove any temporary resources that were left over",
-	Long: `If the upload fails at any point, there might still exist a server or
-ssh key in your Hetzner Cloud project. This command cleans up any resources
+	Long: `If the upload fails at any point, there might still exist a server,
+volume or ssh key in your Hetzner Cloud project. This command cleans up any resources
 that match the label "apricote.de/created-by=hcloud-upload-image".
 
-If you want to see a preview of what would be removed, you can use the official hcloud CLI and run:
+If you want to see a preview of what would be removed, use --dry-run.
 
-    $ hcloud server list -l apricote.de/created-by=hcloud-upload-image
-    $ hcloud ssh-key list -l apricote.de/created-by=hcloud-upload-image
+By default, this command also removes resources of parallel executions of
+hcloud-upload-image that are still in progress. Every run regularly updates the
+label "apricote.de/heartbeat" of its resources, use --ignore-active to skip
+resources of runs that are still active. Alternatively, --older-than only
+removes resources that were created some time ago.
 
-This command does not handle any parallel executions of hcloud-upload-image
-and will remove in-use resources if called at the same time.`,
+Every run of upload and write-to-disk writes a journal of the temporary
+resources it created to --journal-dir. To only remove the resources of a
+single run, even after the process crashed, pass its run ID through --run-id
+or the path of its journal file through --journal.`,
 	DisableAutoGenTag: true,
 
 	GroupID: "primary",
@@ -32,18 +47,64 @@ and will remove in-use resources if called at the same time.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		ctx := cmd.Context()
 		logger := contextlogger.From(ctx)
+		start := time.Now()
+
+		runID, _ := cmd.Flags().GetString(cleanupFlagRunID)
+		journalPath, _ := cmd.Flags().GetString(cleanupFlagJournal)
+		dryRun, _ := cmd.Flags().GetBool(cleanupFlagDryRun)
+
+		var err error
+		switch {
+		case runID != "" && dryRun:
+			// The journal can not be previewed, but all resources of the run carry its ID as a label.
+			err = client.CleanupTempResourcesWithOpts(ctx, hcloudimages.CleanupOptions{RunID: runID, DryRun: true})
+		case runID != "":
+			err = client.CleanupRun(ctx, runID)
+		case journalPath != "":
+			err = client.CleanupJournal(ctx, journalPath)
+		default:
+			olderThan, _ := cmd.Flags().GetDuration(cleanupFlagOlderThan)
+			ignoreActive, _ := cmd.Flags().GetBool(cleanupFlagIgnoreActive)
+
+			err = client.CleanupTempResourcesWithOpts(ctx, hcloudimages.CleanupOptions{
+				OlderThan:    olderThan,
+				IgnoreActive: ignoreActive,
+				DryRun:       dryRun,
+			})
+		}
+
+		res := newResult(start)
+		res.DryRun = dryRun
 
-		err := client.CleanupTempResources(ctx)
 		if err != nil {
-			return fmt.Errorf("failed to clean up temporary resources: %w", err)
+			return printFailedResult(cmd.OutOrStdout(), res, fmt.Errorf("failed to clean up temporary resources: %w", err))
+		}
+
+		if dryRun {
+			logger.InfoContext(ctx, "Dry run finished, nothing was deleted")
+			return printResult(cmd.OutOrStdout(), res)
 		}
 
 		logger.InfoContext(ctx, "Successfully cleaned up all temporary resources!")
 
-		return nil
+		return printResult(cmd.OutOrStdout(), res)
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(cleanupCmd)
+
+	cleanupCmd.Flags().String(cleanupFlagRunID, "", "Only remove the resources of the run with this ID, as recorded in its journal")
+	cleanupCmd.Flags().String(cleanupFlagJournal, "", "Only remove the resources recorded in this journal file")
+	cleanupCmd.MarkFlagsMutuallyExclusive(cleanupFlagRunID, cleanupFlagJournal)
+
+	cleanupCmd.Flags().Duration(cleanupFlagOlderThan, 0, "Only remove resources that were created at least this long ago, e.g. 2h")
+	cleanupCmd.Flags().Bool(cleanupFlagIgnoreActive, false, "Skip resources of runs that are still in progress")
+	cleanupCmd.MarkFlagsMutuallyExclusive(cleanupFlagRunID, cleanupFlagOlderThan)
+	cleanupCmd.MarkFlagsMutuallyExclusive(cleanupFlagRunID, cleanupFlagIgnoreActive)
+	cleanupCmd.MarkFlagsMutuallyExclusive(cleanupFlagJournal, cleanupFlagOlderThan)
+	cleanupCmd.MarkFlagsMutuallyExclusive(cleanupFlagJournal, cleanupFlagIgnoreActive)
+
+	cleanupCmd.Flags().Bool(cleanupFlagDryRun, false, "Only print the resources that would be removed, without removing them")
+	cleanupCmd.MarkFlagsMutuallyExclusive(cleanupFlagJournal, cleanupFlagDryRun)
 }
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/spf13/cobra"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
+	"github.com/apricote/hcloud-upload-image/internal/ui"
+)
+
+const (
+	copyFlagImage            = "image"
+	copyFlagSourceServerType = "source-server-type"
+	copyFlagSourceLocation   = "source-location"
+
+	// copyDestinationTokenEnv is the API token of the destination project. It is not a flag, so it does not end up
+	// in the shell history.
+	copyDestinationTokenEnv = "HCLOUD_DESTINATION_TOKEN"
+)
+
+//go:embed copy.md
+var copyLongDescription string
+
+// copyCmd represents the copy command
+var copyCmd = &cobra.Command{
+	Use:   "copy --image=<id>",
+	Short: "Copy a snapshot from your Hetzner Cloud project into another project.",
+	Long:  copyLongDescription,
+	Example: `  HCLOUD_TOKEN=<staging> HCLOUD_DESTINATION_TOKEN=<production> hcloud-upload-image copy --image 123456
+  hcloud-upload-image copy --image 123456 --labels stage=production --location nbg1`,
+	DisableAutoGenTag: true,
+
+	GroupID: "primary",
+
+	PreRun: initClient,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		logger := contextlogger.From(ctx)
+		start := time.Now()
+
+		imageIDString, _ := cmd.Flags().GetString(copyFlagImage)
+		labels, _ := cmd.Flags().GetStringToString(uploadFlagLabels)
+		serverType, _ := cmd.Flags().GetString(uploadFlagServerType)
+		location, _ := cmd.Flags().GetString(uploadFlagLocation)
+		sourceServerType, _ := cmd.Flags().GetString(copyFlagSourceServerType)
+		sourceLocation, _ := cmd.Flags().GetString(copyFlagSourceLocation)
+		dryRun, _ := cmd.Flags().GetBool(writeFlagDryRun)
+
+		imageID, err := strconv.ParseInt(imageIDString, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid --%s=%q, must be the ID of a snapshot", copyFlagImage, imageIDString)
+		}
+
+		token := os.Getenv(copyDestinationTokenEnv)
+		if token == "" {
+			return fmt.Errorf("you need to set the %s environment variable to the API token of the destination project", copyDestinationTokenEnv)
+		}
+
+		options := hcloudimages.CopyImageOptions{
+			Image:       &hcloud.Image{ID: imageID},
+			Destination: newClient(newHCloudClient(token)),
+			Labels:      labels,
+			DryRun:      dryRun,
+		}
+
+		if cmd.Flags().Changed(uploadFlagDescription) {
+			description, _ := cmd.Flags().GetString(uploadFlagDescription)
+			options.Description = hcloud.Ptr(description)
+		}
+
+		if serverType != "" {
+			options.ServerType = &hcloud.ServerType{Name: serverType}
+		}
+		if location != "" {
+			options.Location = &hcloud.Location{Name: location}
+		}
+		if sourceServerType != "" {
+			options.SourceServerType = &hcloud.ServerType{Name: sourceServerType}
+		}
+		if sourceLocation != "" {
+			options.SourceLocation = &hcloud.Location{Name: sourceLocation}
+		}
+
+		if out := logOutput(); ui.IsTerminal(out) {
+			bar := logHandler.NewProgressBar()
+			options.Progress = func(p hcloudimages.Progress) {
+				bar.Update(p.BytesRead, p.TotalBytes, p.Throughput, p.ETA)
+			}
+		}
+
+		image, err := client.CopyImage(ctx, options)
+
+		res := newResult(start)
+		res.DryRun = options.DryRun
+
+		if err != nil {
+			return printFailedResult(cmd.OutOrStdout(), res, fmt.Errorf("failed to copy the image: %w", err))
+		}
+
+		if options.DryRun {
+			logger.InfoContext(ctx, "Dry run finished, nothing was created")
+			return printResult(cmd.OutOrStdout(), res)
+		}
+
+		res.Image = newImageResult(image)
+
+		logger.InfoContext(ctx, "Successfully copied the image!", "source", imageID, "image", image.ID)
+
+		return printResult(cmd.OutOrStdout(), res)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(copyCmd)
+
+	copyCmd.Flags().String(copyFlagImage, "", "ID of the snapshot or backup to copy")
+	_ = copyCmd.MarkFlagRequired(copyFlagImage)
+
+	copyCmd.Flags().String(uploadFlagDescription, "", "Description for the resulting image [default: description of the source image]")
+	copyCmd.Flags().StringToString(uploadFlagLabels, map[string]string{}, "Labels for the resulting image, added to the labels of the source image")
+
+	locations := cobra.FixedCompletions([]string{"fsn1", "nbg1", "hel1", "ash", "hil", "sin"}, cobra.ShellCompDirectiveNoFileComp)
+
+	copyCmd.Flags().String(uploadFlagServerType, "", "Explicitly use this server type for the temporary server in the destination project [default: cx23 or cax11 depending on the architecture of the image]")
+	copyCmd.Flags().String(uploadFlagLocation, "", "Datacenter location for the temporary server in the destination project [default: fsn1, choices: fsn1, nbg1, hel1, ash, hil, sin]")
+	_ = copyCmd.RegisterFlagCompletionFunc(uploadFlagLocation, locations)
+
+	copyCmd.Flags().String(copyFlagSourceServerType, "", "Explicitly use this server type for the temporary server in the source project, its disk must fit the image [default: cx23 or cax11 depending on the architecture of the image]")
+	copyCmd.Flags().String(copyFlagSourceLocation, "", "Datacenter location for the temporary server in the source project [default: fsn1, choices: fsn1, nbg1, hel1, ash, hil, sin]")
+	_ = copyCmd.RegisterFlagCompletionFunc(copyFlagSourceLocation, locations)
+
+	copyCmd.Flags().Bool(writeFlagDryRun, false, "Only print the API calls and commands that would be used, without creating anything")
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2"
+)
+
+// Exit codes of the CLI, documented in the help of [RootCmd].
+const (
+	exitCodeError        = 1
+	exitCodeRetryable    = 2
+	exitCodeInvalidImage = 3
+	exitCodeCleanup      = 4
+	exitCodeInterrupted  = 130
+)
+
+// exitCode maps the errors of [hcloudimages] to an exit code, so scripts can decide whether to retry.
+func exitCode(err error) int {
+	var cleanupErr *hcloudimages.CleanupError
+
+	switch {
+	// Leaked resources must be cleaned up before a retry, so they take precedence over all other errors
+	case errors.As(err, &cleanupErr):
+		return exitCodeCleanup
+	case errors.Is(err, hcloudimages.ErrInvalidImage),
+		errors.Is(err, hcloudimages.ErrChecksumMismatch),
+		errors.Is(err, hcloudimages.ErrImageNotFound),
+		errors.Is(err, hcloudimages.ErrImageForbidden),
+		errors.Is(err, hcloudimages.ErrNoSpaceLeft):
+		return exitCodeInvalidImage
+	case hcloudimages.IsRetryable(err):
+		return exitCodeRetryable
+	default:
+		return exitCodeError
+	}
+}
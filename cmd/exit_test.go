@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2"
+)
+
+func TestExitCode(t *testing.T) {
+	cleanupErr := &hcloudimages.CleanupError{ServerIDs: []int64{1}, Err: errors.New("server is locked")}
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{
+			name: "other error",
+			err:  errors.New("unexpected"),
+			want: exitCodeError,
+		},
+		{
+			name: "retryable",
+			err:  fmt.Errorf("upload failed: %w", hcloudimages.ErrSSHUnreachable),
+			want: exitCodeRetryable,
+		},
+		{
+			name: "invalid image",
+			err:  fmt.Errorf("upload failed: %w", hcloudimages.ErrChecksumMismatch),
+			want: exitCodeInvalidImage,
+		},
+		{
+			name: "cleanup failed",
+			err:  cleanupErr,
+			want: exitCodeCleanup,
+		},
+		{
+			// Retrying would leak another server
+			name: "retryable and cleanup failed",
+			err:  errors.Join(hcloudimages.ErrSSHUnreachable, cleanupErr),
+			want: exitCodeCleanup,
+		},
+		{
+			name: "invalid image and cleanup failed",
+			err:  errors.Join(hcloudimages.ErrInvalidImage, cleanupErr),
+			want: exitCodeCleanup,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
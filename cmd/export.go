@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/spf13/cobra"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
+	"github.com/apricote/hcloud-upload-image/internal/ui"
+)
+
+const (
+	exportFlagImage       = "image"
+	exportFlagOutputPath  = "output-path"
+	exportFlagCompression = "compression"
+	exportFlagFormat      = "format"
+
+	// exportToStdout as --output-path writes the image to stdout
+	exportToStdout = "-"
+)
+
+// Path of the exported image. If it is [exportToStdout], stdout is reserved for the image, see [logOutput].
+var exportOutputPath string
+
+//go:embed export.md
+var exportLongDescription string
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export --image=<id> --output-path=<local-path>",
+	Short: "Export a snapshot from your Hetzner Cloud project into a disk image.",
+	Long:  exportLongDescription,
+	Example: `  hcloud-upload-image export --image 123456 --output-path /home/you/images/backup.raw
+  hcloud-upload-image export --image 123456 --output-path /home/you/images/backup.qcow2.zst --format qcow2 --compression zstd
+  hcloud-upload-image export --image 123456 --output-path - --compression xz | ssh backup-host "cat > image.raw.xz"`,
+	DisableAutoGenTag: true,
+
+	GroupID: "primary",
+
+	PreRun: initClient,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		logger := contextlogger.From(ctx)
+		start := time.Now()
+
+		imageIDString, _ := cmd.Flags().GetString(exportFlagImage)
+		compression, _ := cmd.Flags().GetString(exportFlagCompression)
+		format, _ := cmd.Flags().GetString(exportFlagFormat)
+		serverType, _ := cmd.Flags().GetString(uploadFlagServerType)
+		location, _ := cmd.Flags().GetString(uploadFlagLocation)
+		dryRun, _ := cmd.Flags().GetBool(writeFlagDryRun)
+
+		if exportOutputPath == exportToStdout && output != "" {
+			return fmt.Errorf("--%s=%s and --%s can not be used together, both write to stdout", exportFlagOutputPath, exportToStdout, flagOutput)
+		}
+
+		imageID, err := strconv.ParseInt(imageIDString, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid --%s=%q, must be the ID of a snapshot", exportFlagImage, imageIDString)
+		}
+
+		options := hcloudimages.ExportOptions{
+			Image:       &hcloud.Image{ID: imageID},
+			Compression: hcloudimages.Compression(compression),
+			Format:      hcloudimages.Format(format),
+			DryRun:      dryRun,
+		}
+		if format == "raw" {
+			options.Format = hcloudimages.FormatRaw
+		}
+
+		if serverType != "" {
+			options.ServerType = &hcloud.ServerType{Name: serverType}
+		}
+
+		if location != "" {
+			options.Location = &hcloud.Location{Name: location}
+		}
+
+		if out := logOutput(); ui.IsTerminal(out) {
+			bar := logHandler.NewProgressBar()
+			options.Progress = func(p hcloudimages.Progress) {
+				bar.Update(p.BytesRead, p.TotalBytes, p.Throughput, p.ETA)
+			}
+		}
+
+		if !dryRun {
+			var imageOutput io.Writer = os.Stdout
+			if exportOutputPath != exportToStdout {
+				file, err := os.Create(exportOutputPath)
+				if err != nil {
+					return fmt.Errorf("unable to create file from --%s=%q: %w", exportFlagOutputPath, exportOutputPath, err)
+				}
+				defer func() { _ = file.Close() }()
+				imageOutput = file
+			}
+			options.Output = imageOutput
+		}
+
+		err = client.Export(ctx, options)
+		if err != nil {
+			if exportOutputPath != exportToStdout && !dryRun {
+				// A partial image is of no use
+				_ = os.Remove(exportOutputPath)
+			}
+			return printFailedResult(cmd.OutOrStdout(), newResult(start), fmt.Errorf("failed to export the image: %w", err))
+		}
+
+		res := newResult(start)
+		res.DryRun = options.DryRun
+		res.setImageType(options.Compression, options.Format)
+
+		if options.DryRun {
+			logger.InfoContext(ctx, "Dry run finished, nothing was created")
+			return printResult(cmd.OutOrStdout(), res)
+		}
+
+		logger.InfoContext(ctx, "Successfully exported the image!", "image", imageID, "path", exportOutputPath)
+
+		return printResult(cmd.OutOrStdout(), res)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().String(exportFlagImage, "", "ID of the snapshot or backup to export")
+	_ = exportCmd.MarkFlagRequired(exportFlagImage)
+
+	exportCmd.Flags().StringVar(&exportOutputPath, exportFlagOutputPath, "", `Local path for the disk image, "-" writes it to stdout`)
+	_ = exportCmd.MarkFlagRequired(exportFlagOutputPath)
+
+	exportCmd.Flags().String(exportFlagCompression, "", "Compress the disk image [choices: zstd, xz]")
+	_ = exportCmd.RegisterFlagCompletionFunc(
+		exportFlagCompression,
+		cobra.FixedCompletions([]string{
+			string(hcloudimages.CompressionZSTD),
+			string(hcloudimages.CompressionXZ),
+		}, cobra.ShellCompDirectiveNoFileComp),
+	)
+
+	exportCmd.Flags().String(exportFlagFormat, "", "Format of the disk image [default: raw, choices: raw, qcow2]")
+	_ = exportCmd.RegisterFlagCompletionFunc(
+		exportFlagFormat,
+		cobra.FixedCompletions([]string{"raw", string(hcloudimages.FormatQCOW2)}, cobra.ShellCompDirectiveNoFileComp),
+	)
+
+	exportCmd.Flags().String(uploadFlagServerType, "", "Explicitly use this server type for the temporary server, its disk must fit the image [default: cx23 or cax11 depending on the architecture of the image]")
+
+	exportCmd.Flags().String(uploadFlagLocation, "", "Datacenter location for the temporary server [default: fsn1, choices: fsn1, nbg1, hel1, ash, hil, sin]")
+	_ = exportCmd.RegisterFlagCompletionFunc(
+		uploadFlagLocation,
+		cobra.FixedCompletions([]string{"fsn1", "nbg1", "hel1", "ash", "hil", "sin"}, cobra.ShellCompDirectiveNoFileComp),
+	)
+
+	exportCmd.Flags().Bool(writeFlagDryRun, false, "Only print the API calls and commands that would be used, without creating anything")
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2"
+)
+
+// cleanupReport is a [hcloudimages.Observer] that records which temporary resources were deleted by the library.
+type cleanupReport struct {
+	mu      sync.Mutex
+	deleted []deletedResource
+	failed  []deletedResource
+}
+
+type deletedResource struct {
+	kind string
+	id   int64
+	err  error
+}
+
+func (c *cleanupReport) Observe(_ context.Context, event hcloudimages.Event) {
+	var resource deletedResource
+	switch event.Step {
+	case hcloudimages.StepDeleteServer:
+		resource = deletedResource{kind: "server", id: event.Resources.ServerID}
+	case hcloudimages.StepDeleteSSHKey:
+		resource = deletedResource{kind: "ssh-key", id: event.Resources.SSHKeyID}
+	case hcloudimages.StepDeleteVolume:
+		resource = deletedResource{kind: "volume", id: event.Resources.VolumeID}
+	default:
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch event.Type {
+	case hcloudimages.EventStepFinished:
+		c.deleted = append(c.deleted, resource)
+	case hcloudimages.EventStepFailed:
+		resource.err = event.Err
+		c.failed = append(c.failed, resource)
+	}
+}
+
+// resources returns the temporary resources that were deleted and those that could not be deleted so far.
+func (c *cleanupReport) resources() (deleted, failed []deletedResource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]deletedResource(nil), c.deleted...), append([]deletedResource(nil), c.failed...)
+}
+
+// report logs every temporary resource that was deleted or could not be deleted.
+func (c *cleanupReport) report(logger *slog.Logger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	logger.Warn("Interrupted, finished cleaning up temporary resources")
+
+	for _, resource := range c.deleted {
+		logger.Info("Deleted temporary resource", "type", resource.kind, "id", resource.id)
+	}
+
+	for _, resource := range c.failed {
+		logger.Error("Could not delete temporary resource, please remove it manually or run the cleanup command",
+			"type", resource.kind, "id", resource.id, "error", resource.err,
+		)
+	}
+
+	if len(c.deleted) == 0 && len(c.failed) == 0 {
+		logger.Info("No temporary resources needed to be deleted")
+	}
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2"
+)
+
+func TestCleanupReport(t *testing.T) {
+	deleteErr := errors.New("server is locked")
+
+	report := &cleanupReport{}
+	events := []hcloudimages.Event{
+		{Type: hcloudimages.EventStepStarted, Step: hcloudimages.StepDeleteServer, Resources: hcloudimages.Resources{ServerID: 1}},
+		{Type: hcloudimages.EventStepFinished, Step: hcloudimages.StepDeleteServer, Resources: hcloudimages.Resources{ServerID: 1}},
+		{Type: hcloudimages.EventStepFinished, Step: hcloudimages.StepDeleteSSHKey, Resources: hcloudimages.Resources{SSHKeyID: 2}},
+		{Type: hcloudimages.EventStepFailed, Step: hcloudimages.StepDeleteVolume, Resources: hcloudimages.Resources{VolumeID: 3}, Err: deleteErr},
+		// Other steps are not part of the cleanup
+		{Type: hcloudimages.EventStepFinished, Step: hcloudimages.StepCreateServer, Resources: hcloudimages.Resources{ServerID: 4}},
+		{Type: hcloudimages.EventStepFailed, Step: hcloudimages.StepWriteImage, Err: errors.New("write failed")},
+	}
+	for _, event := range events {
+		report.Observe(context.Background(), event)
+	}
+
+	deleted, failed := report.resources()
+	wantDeleted := []deletedResource{{kind: "server", id: 1}, {kind: "ssh-key", id: 2}}
+	if len(deleted) != len(wantDeleted) || deleted[0] != wantDeleted[0] || deleted[1] != wantDeleted[1] {
+		t.Errorf("deleted = %+v, want %+v", deleted, wantDeleted)
+	}
+	if len(failed) != 1 || failed[0].kind != "volume" || failed[0].id != 3 || !errors.Is(failed[0].err, deleteErr) {
+		t.Errorf("failed = %+v, want the volume with its error", failed)
+	}
+
+	// The returned slices are copies
+	deleted[0].id = 100
+	if deleted, _ := report.resources(); deleted[0].id != 1 {
+		t.Errorf("resources() returned the slice of the report")
+	}
+
+	var buf bytes.Buffer
+	report.report(slog.New(slog.NewTextHandler(&buf, nil)))
+	for _, want := range []string{"type=server id=1", "type=ssh-key id=2", "type=volume id=3", "server is locked"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("report() output does not contain %q:\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "No temporary resources") {
+		t.Errorf("report() claims that nothing was deleted:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	(&cleanupReport{}).report(slog.New(slog.NewTextHandler(&buf, nil)))
+	if !strings.Contains(buf.String(), "No temporary resources needed to be deleted") {
+		t.Errorf("report() of an empty report = %s", buf.String())
+	}
+}
@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"go.yaml.in/yaml/v3"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2"
+)
+
+const (
+	flagOutput = "output"
+
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+// Format of the result document, empty if only the logs should be printed
+var output string
+
+func validateOutput() error {
+	switch output {
+	case "", outputJSON, outputYAML:
+		return nil
+	default:
+		return fmt.Errorf("invalid value for --%s: %q, must be one of: %s, %s", flagOutput, output, outputJSON, outputYAML)
+	}
+}
+
+// logOutput is where logs and the progress bar are written to. If a result document is requested, or the export
+// command writes the image to stdout, stdout is reserved for it.
+func logOutput() *os.File {
+	if output != "" || exportOutputPath == exportToStdout {
+		return os.Stderr
+	}
+
+	return os.Stdout
+}
+
+// result is the document that is printed to stdout with --output. Fields that do not apply to a command are omitted.
+type result struct {
+	RunID      string       `json:"run_id,omitempty" yaml:"run_id,omitempty"`
+	Image      *imageResult `json:"image,omitempty" yaml:"image,omitempty"`
+	Server     *idResult    `json:"server,omitempty" yaml:"server,omitempty"`
+	Volume     *idResult    `json:"volume,omitempty" yaml:"volume,omitempty"`
+	ServerType string       `json:"server_type,omitempty" yaml:"server_type,omitempty"`
+	Location   string       `json:"location,omitempty" yaml:"location,omitempty"`
+	DryRun     bool         `json:"dry_run,omitempty" yaml:"dry_run,omitempty"`
+
+	Compression string `json:"compression,omitempty" yaml:"compression,omitempty"`
+	Format      string `json:"format,omitempty" yaml:"format,omitempty"`
+
+	DurationSeconds float64 `json:"duration_seconds" yaml:"duration_seconds"`
+
+	DeletedResources []resourceResult `json:"deleted_resources" yaml:"deleted_resources"`
+	FailedResources  []resourceResult `json:"failed_resources,omitempty" yaml:"failed_resources,omitempty"`
+
+	Warnings []string `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+
+	// Error is the reason the command failed, the other fields describe what was done until then
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+
+	// cleanupErr lists the FailedResources, it is returned by [printResult]
+	cleanupErr *hcloudimages.CleanupError
+}
+
+type imageResult struct {
+	ID           int64             `json:"id" yaml:"id"`
+	Description  string            `json:"description" yaml:"description"`
+	Labels       map[string]string `json:"labels" yaml:"labels"`
+	Architecture string            `json:"architecture" yaml:"architecture"`
+	// DiskSize in GB
+	DiskSize float32 `json:"disk_size" yaml:"disk_size"`
+	// ImageSize in GB, only set once the image is available
+	ImageSize float32 `json:"image_size,omitempty" yaml:"image_size,omitempty"`
+}
+
+type idResult struct {
+	ID   int64  `json:"id" yaml:"id"`
+	Name string `json:"name" yaml:"name"`
+}
+
+type resourceResult struct {
+	Type  string `json:"type" yaml:"type"`
+	ID    int64  `json:"id" yaml:"id"`
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+func newResult(start time.Time) *result {
+	r := &result{
+		DurationSeconds:  time.Since(start).Seconds(),
+		DeletedResources: []resourceResult{},
+	}
+
+	deleted, failed := cleanups.resources()
+	for _, resource := range deleted {
+		r.DeletedResources = append(r.DeletedResources, resourceResult{Type: resource.kind, ID: resource.id})
+	}
+	if len(failed) == 0 {
+		return r
+	}
+
+	r.cleanupErr = &hcloudimages.CleanupError{}
+	var errs []error
+	for _, resource := range failed {
+		r.FailedResources = append(r.FailedResources, resourceResult{Type: resource.kind, ID: resource.id, Error: resource.err.Error()})
+
+		switch resource.kind {
+		case "server":
+			r.cleanupErr.ServerIDs = append(r.cleanupErr.ServerIDs, resource.id)
+		case "ssh-key":
+			r.cleanupErr.SSHKeyIDs = append(r.cleanupErr.SSHKeyIDs, resource.id)
+		case "volume":
+			r.cleanupErr.VolumeIDs = append(r.cleanupErr.VolumeIDs, resource.id)
+		}
+		errs = append(errs, resource.err)
+	}
+	r.cleanupErr.Err = errors.Join(errs...)
+
+	return r
+}
+
+// setImageType fills the compression and format, using "none" and "raw" instead of the empty defaults.
+func (r *result) setImageType(compression hcloudimages.Compression, format hcloudimages.Format) {
+	r.Compression = string(compression)
+	if compression == hcloudimages.CompressionNone {
+		r.Compression = "none"
+	}
+	r.Format = string(format)
+	if format == hcloudimages.FormatRaw {
+		r.Format = "raw"
+	}
+}
+
+// setUploadResult fills the details of an upload. On failure, only the steps that ran before are reflected.
+func (r *result) setUploadResult(upload *hcloudimages.UploadResult) {
+	r.RunID = upload.RunID
+	r.Warnings = upload.Warnings
+	if server := upload.Server; server != nil {
+		r.Server = &idResult{ID: server.ID, Name: server.Name}
+	}
+	if upload.ServerType != nil {
+		r.ServerType = upload.ServerType.Name
+	}
+	if upload.Location != nil {
+		r.Location = upload.Location.Name
+	}
+	if upload.Image != nil {
+		r.Image = newImageResult(upload.Image)
+	}
+}
+
+func newImageResult(image *hcloud.Image) *imageResult {
+	return &imageResult{
+		ID:           image.ID,
+		Description:  image.Description,
+		Labels:       image.Labels,
+		Architecture: string(image.Architecture),
+		DiskSize:     image.DiskSize,
+		ImageSize:    image.ImageSize,
+	}
+}
+
+// printResult writes the result document in the format selected through --output. Nothing is printed if the flag is
+// not set.
+//
+// If some temporary resources could not be deleted, it returns a [hcloudimages.CleanupError] for them, even though the
+// command succeeded, so it exits with [exitCodeCleanup].
+func printResult(w io.Writer, r *result) error {
+	if err := encodeResult(w, r); err != nil {
+		return err
+	}
+
+	if r.cleanupErr != nil {
+		return fmt.Errorf("%w, run the cleanup command to delete them", r.cleanupErr)
+	}
+	return nil
+}
+
+// printFailedResult writes the result document of a command that failed with err, so scripts still learn which
+// temporary resources were deleted and which were not. It returns err.
+func printFailedResult(w io.Writer, r *result, err error) error {
+	r.Error = err.Error()
+	if encodeErr := encodeResult(w, r); encodeErr != nil {
+		return errors.Join(err, encodeErr)
+	}
+	return err
+}
+
+func encodeResult(w io.Writer, r *result) error {
+	switch output {
+	case outputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	case outputYAML:
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+		return encoder.Close()
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2"
+)
+
+func TestPrintResult(t *testing.T) {
+	defer func(previous string, report *cleanupReport) { output, cleanups = previous, report }(output, cleanups)
+	output = outputJSON
+
+	deleteErr := errors.New("server is locked")
+	cleanups = &cleanupReport{}
+	cleanups.Observe(context.Background(), hcloudimages.Event{
+		Type: hcloudimages.EventStepFinished, Step: hcloudimages.StepDeleteSSHKey, Resources: hcloudimages.Resources{SSHKeyID: 2},
+	})
+
+	// Nothing failed
+	var buf bytes.Buffer
+	if err := printResult(&buf, newResult(time.Now())); err != nil {
+		t.Errorf("printResult() = %v, want nil", err)
+	}
+	var doc result
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.DeletedResources) != 1 || doc.DeletedResources[0] != (resourceResult{Type: "ssh-key", ID: 2}) || doc.FailedResources != nil {
+		t.Errorf("printResult() printed deleted %+v and failed %+v", doc.DeletedResources, doc.FailedResources)
+	}
+
+	cleanups.Observe(context.Background(), hcloudimages.Event{
+		Type: hcloudimages.EventStepFailed, Step: hcloudimages.StepDeleteServer, Resources: hcloudimages.Resources{ServerID: 1}, Err: deleteErr,
+	})
+
+	// The command succeeded, but the server is left over
+	buf.Reset()
+	err := printResult(&buf, newResult(time.Now()))
+	var cleanupErr *hcloudimages.CleanupError
+	if !errors.As(err, &cleanupErr) || len(cleanupErr.ServerIDs) != 1 || cleanupErr.ServerIDs[0] != 1 || !errors.Is(err, deleteErr) {
+		t.Fatalf("printResult() = %v, want a cleanup error for server 1", err)
+	}
+	if code := exitCode(err); code != exitCodeCleanup {
+		t.Errorf("exitCode() = %d, want %d", code, exitCodeCleanup)
+	}
+	doc = result{}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.FailedResources) != 1 || doc.FailedResources[0] != (resourceResult{Type: "server", ID: 1, Error: "server is locked"}) {
+		t.Errorf("printResult() printed failed %+v", doc.FailedResources)
+	}
+
+	// The command failed, the document is printed with the error
+	buf.Reset()
+	commandErr := errors.Join(errors.New("boot failed"), cleanupErr)
+	if err := printFailedResult(&buf, newResult(time.Now()), commandErr); !errors.Is(err, commandErr) {
+		t.Errorf("printFailedResult() = %v, want %v", err, commandErr)
+	}
+	doc = result{}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Error != commandErr.Error() || len(doc.DeletedResources) != 1 || len(doc.FailedResources) != 1 {
+		t.Errorf("printFailedResult() printed %+v", doc)
+	}
+
+	// Without --output nothing is printed
+	output = ""
+	buf.Reset()
+	if err := printFailedResult(&buf, newResult(time.Now()), commandErr); !errors.Is(err, commandErr) || buf.Len() != 0 {
+		t.Errorf("printFailedResult() = %v and printed %q", err, buf.String())
+	}
+}
@@ -1,8 +1,12 @@
 package cmd
 
 import (
+	"context"
 	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
@@ -15,38 +19,65 @@ import (
 )
 
 const (
-	flagVerbose = "verbose"
+	flagVerbose    = "verbose"
+	flagJournalDir = "journal-dir"
 )
 
 var (
 	// 1 activates slog debug output
 	// 2 activates hcloud-go debug output
 	verbose int
+
+	// Directory for the journals of runs, see [hcloudimages.WithJournalDir]
+	journalDir string
 )
 
-// The pre-authenticated client. Set in the root command PersistentPreRun
+// The pre-authenticated client. Set in the root command PersistentPreRunE
 var client *hcloudimages.Client
 var hcloudclient *hcloud.Client
 
+// Collects the cleanup results of the client, to report them when the command is interrupted.
+var cleanups = &cleanupReport{}
+
+// logHandler writes the logs, progress bars are drawn through it so they do not interfere, see
+// [ui.Handler.NewProgressBar].
+var logHandler *ui.Handler
+
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
-	Use:               "hcloud-upload-image",
-	Short:             `Manage custom OS images on Hetzner Cloud.`,
-	Long:              `Manage custom OS images on Hetzner Cloud.`,
+	Use:   "hcloud-upload-image",
+	Short: `Manage custom OS images on Hetzner Cloud.`,
+	Long: `Manage custom OS images on Hetzner Cloud.
+
+The exit code tells scripts why a command failed:
+
+- 0: Success
+- 1: Any other error
+- 2: Temporary error, e.g. the API or the image URL is unavailable. Retrying might succeed.
+- 3: The image is invalid, does not match the checksum, could not be found or does not fit on the disk.
+- 4: Some temporary resources could not be deleted, see the cleanup command. Takes precedence over the other codes and
+  is also used if the command succeeded otherwise.
+- 130: Interrupted by SIGINT or SIGTERM`,
 	SilenceUsage:      true,
 	DisableAutoGenTag: true,
 
 	Version: version.Version,
 
-	PersistentPreRun: func(cmd *cobra.Command, _ []string) {
+	PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
 		ctx := cmd.Context()
 
+		if err := validateOutput(); err != nil {
+			return err
+		}
+
 		slog.SetDefault(initLogger())
 
 		// Add logger to command context
 		logger := slog.Default()
 		ctx = contextlogger.New(ctx, logger)
 		cmd.SetContext(ctx)
+
+		return nil
 	},
 }
 
@@ -56,8 +87,11 @@ func initLogger() *slog.Logger {
 		logLevel = slog.LevelDebug
 	}
 
-	return slog.New(ui.NewHandler(os.Stdout, &ui.HandlerOptions{
-		Level: logLevel,
+	out := logOutput()
+
+	logHandler = ui.NewHandler(out, &ui.HandlerOptions{
+		Level:     logLevel,
+		ClearLine: ui.IsTerminal(out),
 		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
 			// Remove attributes that are unnecessary for the cli context
 			if a.Key == "library" || a.Key == "method" {
@@ -66,8 +100,9 @@ func initLogger() *slog.Logger {
 
 			return a
 		},
-	}))
+	})
 
+	return slog.New(logHandler)
 }
 
 func initClient(cmd *cobra.Command, _ []string) {
@@ -86,8 +121,14 @@ func initClient(cmd *cobra.Command, _ []string) {
 		os.Exit(1)
 	}
 
+	hcloudclient = newHCloudClient(os.Getenv("HCLOUD_TOKEN"))
+	client = newClient(hcloudclient)
+}
+
+// newHCloudClient builds a hcloud-go client for the project of token.
+func newHCloudClient(token string) *hcloud.Client {
 	opts := []hcloud.ClientOption{
-		hcloud.WithToken(os.Getenv("HCLOUD_TOKEN")),
+		hcloud.WithToken(token),
 		hcloud.WithApplication("hcloud-upload-image", version.Version),
 		hcloud.WithPollOpts(hcloud.PollOpts{BackoffFunc: hcloud.ExponentialBackoffWithOpts(hcloud.ExponentialBackoffOpts{Multiplier: 2, Base: 1 * time.Second, Cap: 30 * time.Second})}),
 	}
@@ -96,14 +137,61 @@ func initClient(cmd *cobra.Command, _ []string) {
 		opts = append(opts, hcloud.WithDebugWriter(os.Stderr))
 	}
 
-	hcloudclient = hcloud.NewClient(opts...)
-	client = hcloudimages.NewClient(hcloudclient)
+	return hcloud.NewClient(opts...)
+}
+
+// newClient builds the client of the library on top of hc, with the journal and cleanup report of the cli.
+func newClient(hc *hcloud.Client) *hcloudimages.Client {
+	clientOpts := []hcloudimages.ClientOption{
+		hcloudimages.WithObserver(cleanups),
+	}
+
+	switch journalDir {
+	case "off":
+	case "":
+		if dir := defaultJournalDir(); dir != "" {
+			clientOpts = append(clientOpts, hcloudimages.WithJournalDir(dir))
+		}
+	default:
+		clientOpts = append(clientOpts, hcloudimages.WithJournalDir(journalDir))
+	}
+
+	return hcloudimages.NewClient(hc, clientOpts...)
+}
+
+// defaultJournalDir follows the XDG Base Directory Specification for state files.
+func defaultJournalDir() string {
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+
+	return filepath.Join(stateHome, "hcloud-upload-image", "runs")
 }
 
 func Execute() {
-	err := RootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		// Restore the default behaviour, a second signal exits immediately
+		stop()
+	}()
+
+	err := RootCmd.ExecuteContext(ctx)
+
+	if err != nil && ctx.Err() != nil {
+		cleanups.report(slog.Default())
+		os.Exit(exitCodeInterrupted)
+	}
+
 	if err != nil {
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -111,6 +199,12 @@ func init() {
 	RootCmd.SetErrPrefix("\033[1;31mError:")
 
 	RootCmd.PersistentFlags().CountVarP(&verbose, flagVerbose, "v", "verbose debug output, can be specified up to 2 times")
+	RootCmd.PersistentFlags().StringVarP(&output, flagOutput, "o", "", "Print a result document to stdout, also if the command fails. Logs are written to stderr instead [choices: json, yaml]")
+	_ = RootCmd.RegisterFlagCompletionFunc(
+		flagOutput,
+		cobra.FixedCompletions([]string{outputJSON, outputYAML}, cobra.ShellCompDirectiveNoFileComp),
+	)
+	RootCmd.PersistentFlags().StringVar(&journalDir, flagJournalDir, "", `Directory for the journals of temporary resources created by each run, "off" disables the journals [default: $XDG_STATE_HOME/hcloud-upload-image/runs]`)
 
 	RootCmd.AddGroup(&cobra.Group{
 		ID:    "primary",
@@ -3,6 +3,8 @@ package cmd
 import (
 	_ "embed"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
 	"github.com/spf13/cobra"
@@ -17,6 +19,7 @@ const (
 	uploadFlagDescription  = "description"
 	uploadFlagLabels       = "labels"
 	uploadFlagLocation     = "location"
+	uploadFlagBaseImage    = "base-image"
 )
 
 //go:embed upload.md
@@ -29,7 +32,11 @@ var uploadCmd = &cobra.Command{
 	Long:  uploadLongDescription,
 	Example: `  hcloud-upload-image upload --image-path /home/you/images/custom-linux-image-x86.bz2 --architecture x86 --compression bz2 --description "My super duper custom linux"
   hcloud-upload-image upload --image-url https://examples.com/image-arm.raw --architecture arm --labels foo=bar,version=latest
-  hcloud-upload-image upload --image-url https://examples.com/image-x86.qcow2 --architecture x86 --format qcow2`,
+  hcloud-upload-image upload --image-url https://examples.com/image-x86.qcow2 --architecture x86 --format qcow2
+  hcloud-upload-image upload --image-url https://examples.com/image-x86.qcow2.xz --architecture x86 --compression auto --format auto
+  hcloud-upload-image upload --image-url https://examples.com/image-x86.tar.gz --architecture x86 --compression gzip --archive-member disk.raw
+  hcloud-upload-image upload --image-path /home/you/images/release-2.raw --base-image 123456
+  hcloud-upload-image upload --image-path /home/you/images/custom-linux-image-x86.raw --architecture x86 --transfer-compression zstd`,
 	DisableAutoGenTag: true,
 
 	GroupID: "primary",
@@ -39,6 +46,7 @@ var uploadCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		ctx := cmd.Context()
 		logger := contextlogger.From(ctx)
+		start := time.Now()
 
 		writeOptions, err := parseAndValidateWriteOptions(ctx, cmd.Flags())
 		if err != nil {
@@ -50,6 +58,7 @@ var uploadCmd = &cobra.Command{
 		description, _ := cmd.Flags().GetString(uploadFlagDescription)
 		labels, _ := cmd.Flags().GetStringToString(uploadFlagLabels)
 		location, _ := cmd.Flags().GetString(uploadFlagLocation)
+		baseImage, _ := cmd.Flags().GetString(uploadFlagBaseImage)
 
 		options := hcloudimages.UploadOptions{
 			WriteOptions: writeOptions,
@@ -67,14 +76,41 @@ var uploadCmd = &cobra.Command{
 			options.Location = &hcloud.Location{Name: location}
 		}
 
-		image, err := client.Upload(ctx, options)
+		if baseImage != "" {
+			baseImageID, err := strconv.ParseInt(baseImage, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid --%s=%q, must be the ID of a snapshot", uploadFlagBaseImage, baseImage)
+			}
+			options.BaseImage = &hcloud.Image{ID: baseImageID}
+		}
+
+		uploadResult, err := client.UploadWithResult(ctx, options)
+
+		res := newResult(start)
+		res.DryRun = options.DryRun
+
 		if err != nil {
-			return fmt.Errorf("failed to upload the image: %w", err)
+			if uploadResult != nil {
+				res.setUploadResult(uploadResult)
+			}
+			return printFailedResult(cmd.OutOrStdout(), res, fmt.Errorf("failed to upload the image: %w", err))
 		}
 
-		logger.InfoContext(ctx, "Successfully uploaded the image!", "image", image.ID)
+		if options.DryRun {
+			res.ServerType = uploadResult.Plan.ServerType
+			res.Location = uploadResult.Plan.Location
+			res.setImageType(uploadResult.Plan.ImageCompression, uploadResult.Plan.ImageFormat)
 
-		return nil
+			logger.InfoContext(ctx, "Dry run finished, no image was created")
+			return printResult(cmd.OutOrStdout(), res)
+		}
+
+		res.setUploadResult(uploadResult)
+		res.setImageType(uploadResult.ImageCompression, uploadResult.ImageFormat)
+
+		logger.InfoContext(ctx, "Successfully uploaded the image!", "image", uploadResult.Image.ID)
+
+		return printResult(cmd.OutOrStdout(), res)
 	},
 }
 
@@ -91,8 +127,10 @@ func init() {
 
 	uploadCmd.Flags().String(uploadFlagServerType, "", "Explicitly use this server type to generate the image. Mutually exclusive with --architecture.")
 
+	uploadCmd.Flags().String(uploadFlagBaseImage, "", "ID of an earlier snapshot of the image, only the blocks that changed since are written. The architecture defaults to the one of the snapshot.")
+
 	// Only one of them needs to be set
-	uploadCmd.MarkFlagsOneRequired(uploadFlagArchitecture, uploadFlagServerType)
+	uploadCmd.MarkFlagsOneRequired(uploadFlagArchitecture, uploadFlagServerType, uploadFlagBaseImage)
 	uploadCmd.MarkFlagsMutuallyExclusive(uploadFlagArchitecture, uploadFlagServerType)
 
 	uploadCmd.Flags().String(uploadFlagDescription, "", "Description for the resulting image")
@@ -4,9 +4,15 @@ import (
 	"context"
 	_ "embed"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
 	"github.com/spf13/cobra"
@@ -14,6 +20,7 @@ import (
 
 	"github.com/apricote/hcloud-upload-image/hcloudimages/v2"
 	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
+	"github.com/apricote/hcloud-upload-image/internal/ui"
 )
 
 const (
@@ -21,7 +28,15 @@ const (
 	writeFlagImagePath   = "image-path"
 	writeFlagCompression = "compression"
 	writeFlagFormat      = "format"
+	writeFlagChecksum    = "image-checksum"
+	writeFlagChecksumURL = "checksum-url"
+	writeFlagDryRun      = "dry-run"
+	writeFlagScratchSize = "scratch-volume-size"
+	writeFlagMember      = "archive-member"
+	writeFlagProcessing  = "processing"
+	writeFlagTransfer    = "transfer-compression"
 	writeFlagServer      = "server"
+	writeFlagTarget      = "target-device"
 )
 
 func registerWriteOptions(cmd *cobra.Command) {
@@ -30,16 +45,60 @@ func registerWriteOptions(cmd *cobra.Command) {
 	cmd.MarkFlagsMutuallyExclusive(writeFlagImageURL, writeFlagImagePath)
 	cmd.MarkFlagsOneRequired(writeFlagImageURL, writeFlagImagePath)
 
-	cmd.Flags().String(writeFlagCompression, "", "Type of compression that was used on the disk image [choices: bz2, xz, zstd]")
+	cmd.Flags().String(writeFlagCompression, "", "Type of compression that was used on the disk image [choices: auto, bz2, xz, zstd, gzip, lz4, zip]")
 	_ = cmd.RegisterFlagCompletionFunc(
 		writeFlagCompression,
-		cobra.FixedCompletions([]string{string(hcloudimages.CompressionBZ2), string(hcloudimages.CompressionXZ), string(hcloudimages.CompressionZSTD)}, cobra.ShellCompDirectiveNoFileComp),
+		cobra.FixedCompletions([]string{
+			string(hcloudimages.CompressionAuto),
+			string(hcloudimages.CompressionBZ2),
+			string(hcloudimages.CompressionXZ),
+			string(hcloudimages.CompressionZSTD),
+			string(hcloudimages.CompressionGZIP),
+			string(hcloudimages.CompressionLZ4),
+			string(hcloudimages.CompressionZIP),
+		}, cobra.ShellCompDirectiveNoFileComp),
 	)
 
-	cmd.Flags().String(writeFlagFormat, "", "Format of the disk image. [default: raw, choices: qcow2]")
+	cmd.Flags().String(writeFlagFormat, "", "Format of the disk image. [default: raw, choices: auto, qcow2, vmdk, vhd, vhdx, vdi]")
 	_ = cmd.RegisterFlagCompletionFunc(
 		writeFlagFormat,
-		cobra.FixedCompletions([]string{string(hcloudimages.FormatQCOW2)}, cobra.ShellCompDirectiveNoFileComp),
+		cobra.FixedCompletions([]string{
+			string(hcloudimages.FormatAuto),
+			string(hcloudimages.FormatQCOW2),
+			string(hcloudimages.FormatVMDK),
+			string(hcloudimages.FormatVHD),
+			string(hcloudimages.FormatVHDX),
+			string(hcloudimages.FormatVDI),
+		}, cobra.ShellCompDirectiveNoFileComp),
+	)
+
+	cmd.Flags().String(writeFlagChecksum, "", "Expected SHA-256 checksum of the disk image file, verified before the image is used")
+	cmd.Flags().String(writeFlagChecksumURL, "", "Remote URL of a checksum file (sha256sum or BSD format) that contains the SHA-256 checksum of the disk image file")
+	cmd.MarkFlagsMutuallyExclusive(writeFlagChecksum, writeFlagChecksumURL)
+
+	cmd.Flags().Bool(writeFlagDryRun, false, "Only print the API calls and commands that would be used, without changing anything")
+
+	cmd.Flags().String(writeFlagMember, "", "Path of the disk image inside a tar or zip archive, e.g. disk.raw")
+
+	cmd.Flags().Int(writeFlagScratchSize, 0, "Size in GB of a temporary volume to stage images that are not raw, instead of the rescue system root disk (minimum 10, costs money)")
+
+	cmd.Flags().String(writeFlagProcessing, "", "Where the disk image is decompressed and converted, auto uses the client if the rescue system lacks a tool [default: auto, choices: rescue, client]")
+	_ = cmd.RegisterFlagCompletionFunc(
+		writeFlagProcessing,
+		cobra.FixedCompletions([]string{
+			"auto",
+			string(hcloudimages.ProcessingRescue),
+			string(hcloudimages.ProcessingClient),
+		}, cobra.ShellCompDirectiveNoFileComp),
+	)
+
+	cmd.Flags().String(writeFlagTransfer, "", "Compress uncompressed disk images on the client while they are sent to the server, already compressed images are sent as they are [default: none, choices: none, zstd]")
+	_ = cmd.RegisterFlagCompletionFunc(
+		writeFlagTransfer,
+		cobra.FixedCompletions([]string{
+			"none",
+			string(hcloudimages.CompressionZSTD),
+		}, cobra.ShellCompDirectiveNoFileComp),
 	)
 }
 
@@ -50,10 +109,43 @@ func parseAndValidateWriteOptions(ctx context.Context, flags *pflag.FlagSet) (hc
 	imagePathString, _ := flags.GetString(writeFlagImagePath)
 	imageCompression, _ := flags.GetString(writeFlagCompression)
 	imageFormat, _ := flags.GetString(writeFlagFormat)
+	imageChecksum, _ := flags.GetString(writeFlagChecksum)
+	checksumURLString, _ := flags.GetString(writeFlagChecksumURL)
+	dryRun, _ := flags.GetBool(writeFlagDryRun)
+	scratchVolumeSize, _ := flags.GetInt(writeFlagScratchSize)
+	archiveMember, _ := flags.GetString(writeFlagMember)
+	processing, _ := flags.GetString(writeFlagProcessing)
+	transferCompression, _ := flags.GetString(writeFlagTransfer)
+
+	if scratchVolumeSize < 0 || (scratchVolumeSize > 0 && scratchVolumeSize < 10) {
+		return hcloudimages.WriteOptions{}, fmt.Errorf("--%s must be at least 10 GB, got %d", writeFlagScratchSize, scratchVolumeSize)
+	}
+
+	switch hcloudimages.Processing(processing) {
+	case "auto":
+		processing = string(hcloudimages.ProcessingAuto)
+	case hcloudimages.ProcessingAuto, hcloudimages.ProcessingRescue, hcloudimages.ProcessingClient:
+	default:
+		return hcloudimages.WriteOptions{}, fmt.Errorf("unknown --%s=%q", writeFlagProcessing, processing)
+	}
+
+	switch hcloudimages.Compression(transferCompression) {
+	case "none":
+		transferCompression = string(hcloudimages.CompressionNone)
+	case hcloudimages.CompressionNone, hcloudimages.CompressionZSTD:
+	default:
+		return hcloudimages.WriteOptions{}, fmt.Errorf("unknown --%s=%q", writeFlagTransfer, transferCompression)
+	}
 
 	options := hcloudimages.WriteOptions{
-		ImageCompression: hcloudimages.Compression(imageCompression),
-		ImageFormat:      hcloudimages.Format(imageFormat),
+		ImageCompression:    hcloudimages.Compression(imageCompression),
+		ImageFormat:         hcloudimages.Format(imageFormat),
+		ImageChecksum:       imageChecksum,
+		DryRun:              dryRun,
+		ArchiveMember:       archiveMember,
+		ScratchVolumeSize:   scratchVolumeSize,
+		Processing:          hcloudimages.Processing(processing),
+		TransferCompression: hcloudimages.Compression(transferCompression),
 	}
 
 	if imageURLString != "" {
@@ -91,9 +183,97 @@ func parseAndValidateWriteOptions(ctx context.Context, flags *pflag.FlagSet) (hc
 		options.ImageReader = imageFile
 	}
 
+	if checksumURLString != "" {
+		imageName := filepath.Base(imagePathString)
+		if options.ImageURL != nil {
+			imageName = path.Base(options.ImageURL.Path)
+		}
+
+		checksum, err := fetchChecksum(ctx, checksumURLString, imageName)
+		if err != nil {
+			return hcloudimages.WriteOptions{}, fmt.Errorf("unable to get checksum from --%s=%q: %w", writeFlagChecksumURL, checksumURLString, err)
+		}
+		logger.DebugContext(ctx, "found checksum for image", "image", imageName, "checksum", checksum)
+
+		options.ImageChecksum = checksum
+	}
+
+	if out := logOutput(); ui.IsTerminal(out) {
+		bar := logHandler.NewProgressBar()
+		options.Progress = func(p hcloudimages.Progress) {
+			if p.BytesRead > 0 {
+				bar.Update(p.BytesRead, p.TotalBytes, p.Throughput, p.ETA)
+			} else {
+				bar.Update(p.BytesWritten, 0, p.Throughput, 0)
+			}
+		}
+	}
+
 	return options, nil
 }
 
+// fetchChecksum downloads a checksum file and returns the checksum for imageName, see [parseChecksumFile].
+func fetchChecksum(ctx context.Context, checksumURL, imageName string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checksumURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return parseChecksumFile(string(body), imageName)
+}
+
+// bsdChecksumLine matches a line as written by "sha256sum --tag" or the BSD "sha256" command.
+var bsdChecksumLine = regexp.MustCompile(`^SHA256 \((.+)\) = ([0-9a-fA-F]+)$`)
+
+// parseChecksumFile returns the checksum for imageName from a checksum file. It accepts the lines of sha256sum
+// ("<hash>  <file>", or "<hash> *<file>" in binary mode) and the BSD-style lines of "sha256sum --tag"
+// ("SHA256 (<file>) = <hash>"). File names may contain spaces, but not the escaped newlines or backslashes of
+// sha256sum. Only the base name of the file is compared. If the file only contains a single checksum without a file
+// name, that one is returned.
+func parseChecksumFile(body, imageName string) (string, error) {
+	lines := strings.FieldsFunc(body, func(r rune) bool { return r == '\n' || r == '\r' })
+	for _, line := range lines {
+		if m := bsdChecksumLine.FindStringSubmatch(line); m != nil {
+			if path.Base(m[1]) == imageName {
+				return m[2], nil
+			}
+			continue
+		}
+
+		checksum, name, found := strings.Cut(strings.TrimSpace(line), " ")
+		switch {
+		case !found && len(lines) == 1:
+			return checksum, nil
+		case !found:
+			continue
+		}
+		// The second separator is a space in text mode and "*" in binary mode
+		if len(name) > 0 && (name[0] == ' ' || name[0] == '*') {
+			name = name[1:]
+		}
+		if path.Base(name) == imageName {
+			return checksum, nil
+		}
+	}
+
+	return "", fmt.Errorf("no checksum found for %q", imageName)
+}
+
 //go:embed write-to-disk.md
 var writeToDiskLongDescription string
 
@@ -104,7 +284,10 @@ var writeToDiskCmd = &cobra.Command{
 	Long:  writeToDiskLongDescription,
 	Example: `  hcloud-upload-image write-to-disk --image-path /home/you/images/custom-linux-image-x86.bz2 --compression bz2 --server my-server
   hcloud-upload-image write-to-disk --image-url https://examples.com/image-arm.raw --server my-arm-server
-  hcloud-upload-image write-to-disk --image-url https://examples.com/image-x86.qcow2 --format qcow2 --server my-x86-server`,
+  hcloud-upload-image write-to-disk --image-url https://examples.com/image-x86.qcow2 --format qcow2 --server my-x86-server
+  hcloud-upload-image write-to-disk --image-path /home/you/images/image-x86.raw.zst --compression auto --format auto --server my-x86-server
+  hcloud-upload-image write-to-disk --image-url https://examples.com/image-x86.qcow2.xz --processing client --server my-x86-server
+  hcloud-upload-image write-to-disk --image-path /home/you/images/data.raw --target-device /dev/disk/by-id/scsi-0HC_Volume_123 --server my-server`,
 	DisableAutoGenTag: true,
 
 	GroupID: "primary",
@@ -114,12 +297,15 @@ var writeToDiskCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		ctx := cmd.Context()
 		logger := contextlogger.From(ctx)
+		start := time.Now()
 
 		options, err := parseAndValidateWriteOptions(ctx, cmd.Flags())
 		if err != nil {
 			return err
 		}
 
+		options.TargetDevice, _ = cmd.Flags().GetString(writeFlagTarget)
+
 		serverIDOrName, _ := cmd.Flags().GetString(writeFlagServer)
 		options.Server, _, err = hcloudclient.Server.Get(ctx, serverIDOrName)
 		if err != nil {
@@ -130,13 +316,23 @@ var writeToDiskCmd = &cobra.Command{
 		}
 
 		err = client.WriteToDisk(ctx, options)
+
+		res := newResult(start)
+		res.Server = &idResult{ID: options.Server.ID, Name: options.Server.Name}
+		res.DryRun = options.DryRun
+
 		if err != nil {
-			return fmt.Errorf("failed to write the image: %w", err)
+			return printFailedResult(cmd.OutOrStdout(), res, fmt.Errorf("failed to write the image: %w", err))
+		}
+
+		if options.DryRun {
+			logger.InfoContext(ctx, "Dry run finished, nothing was changed")
+			return printResult(cmd.OutOrStdout(), res)
 		}
 
 		logger.InfoContext(ctx, "Successfully wrote the image!")
 
-		return nil
+		return printResult(cmd.OutOrStdout(), res)
 	},
 }
 
@@ -163,4 +359,6 @@ func init() {
 			return serverNames, cobra.ShellCompDirectiveNoFileComp
 		},
 	)
+
+	writeToDiskCmd.Flags().String(writeFlagTarget, "", "Block device in the rescue system that the image is written to, e.g. /dev/nvme0n1 [default: the detected root disk]")
 }
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestParseChecksumFile(t *testing.T) {
+	const (
+		checksumA = "4a5c0a1e6e3b2f9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d"
+		checksumB = "0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c"
+	)
+
+	tests := []struct {
+		name      string
+		body      string
+		imageName string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:      "single checksum without file name",
+			body:      checksumA + "\n",
+			imageName: "image.raw",
+			want:      checksumA,
+		},
+		{
+			name:      "text mode",
+			body:      checksumB + "  other.raw\n" + checksumA + "  image.raw\n",
+			imageName: "image.raw",
+			want:      checksumA,
+		},
+		{
+			name:      "binary mode",
+			body:      checksumB + " *other.raw\n" + checksumA + " *image.raw\n",
+			imageName: "image.raw",
+			want:      checksumA,
+		},
+		{
+			name:      "file name with spaces",
+			body:      checksumB + "  my image.raw.xz\n" + checksumA + "  my image.raw\n",
+			imageName: "my image.raw",
+			want:      checksumA,
+		},
+		{
+			name:      "file in directory",
+			body:      checksumA + "  ./images/image.raw\n",
+			imageName: "image.raw",
+			want:      checksumA,
+		},
+		{
+			name:      "windows line endings",
+			body:      checksumB + "  other.raw\r\n" + checksumA + "  image.raw\r\n",
+			imageName: "image.raw",
+			want:      checksumA,
+		},
+		{
+			name:      "bsd style",
+			body:      "SHA256 (other.raw) = " + checksumB + "\nSHA256 (image.raw) = " + checksumA + "\n",
+			imageName: "image.raw",
+			want:      checksumA,
+		},
+		{
+			name:      "bsd style with spaces and parentheses",
+			body:      "SHA256 (my image (1).raw) = " + checksumA + "\n",
+			imageName: "my image (1).raw",
+			want:      checksumA,
+		},
+		{
+			name:      "missing file",
+			body:      checksumB + "  other.raw\n" + checksumA + "  image.raw.xz\n",
+			imageName: "image.raw",
+			wantErr:   true,
+		},
+		{
+			name:      "single checksum of another file",
+			body:      "SHA256 (other.raw) = " + checksumB + "\n",
+			imageName: "image.raw",
+			wantErr:   true,
+		},
+		{
+			name:      "empty",
+			body:      "",
+			imageName: "image.raw",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseChecksumFile(tt.body, tt.imageName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseChecksumFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseChecksumFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
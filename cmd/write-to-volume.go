@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	_ "embed"
+	"fmt"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/spf13/cobra"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
+)
+
+const (
+	volumeFlagVolume = "volume"
+	volumeFlagSize   = "volume-size"
+	volumeFlagName   = "volume-name"
+)
+
+//go:embed write-to-volume.md
+var writeToVolumeLongDescription string
+
+// writeToVolumeCmd represents the write-to-volume command
+var writeToVolumeCmd = &cobra.Command{
+	Use:   "write-to-volume (--image-path=<local-path> | --image-url=<url>) (--volume=<id-or-name> | --volume-size=<gb>)",
+	Short: "Write the specified disk image to a new or existing Volume.",
+	Long:  writeToVolumeLongDescription,
+	Example: `  hcloud-upload-image write-to-volume --image-path /home/you/images/data-disk.raw.zst --compression auto --volume my-data-volume
+  hcloud-upload-image write-to-volume --image-url https://examples.com/boot-disk.qcow2 --format qcow2 --volume-size 20 --volume-name boot-disk --location nbg1`,
+	DisableAutoGenTag: true,
+
+	GroupID: "primary",
+
+	PreRun: initClient,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		logger := contextlogger.From(ctx)
+		start := time.Now()
+
+		writeOptions, err := parseAndValidateWriteOptions(ctx, cmd.Flags())
+		if err != nil {
+			return err
+		}
+
+		volumeIDOrName, _ := cmd.Flags().GetString(volumeFlagVolume)
+		volumeSize, _ := cmd.Flags().GetInt(volumeFlagSize)
+		volumeName, _ := cmd.Flags().GetString(volumeFlagName)
+		architecture, _ := cmd.Flags().GetString(uploadFlagArchitecture)
+		serverType, _ := cmd.Flags().GetString(uploadFlagServerType)
+		labels, _ := cmd.Flags().GetStringToString(uploadFlagLabels)
+		location, _ := cmd.Flags().GetString(uploadFlagLocation)
+
+		options := hcloudimages.WriteToVolumeOptions{
+			WriteOptions: writeOptions,
+			VolumeSize:   volumeSize,
+			VolumeName:   volumeName,
+			Labels:       labels,
+			Architecture: hcloud.Architecture(architecture),
+		}
+
+		if volumeIDOrName != "" {
+			options.Volume, _, err = hcloudclient.Volume.Get(ctx, volumeIDOrName)
+			if err != nil {
+				return fmt.Errorf("could not get volume %q: %w", volumeIDOrName, err)
+			}
+			if options.Volume == nil {
+				return fmt.Errorf("volume %q not found", volumeIDOrName)
+			}
+		}
+
+		if serverType != "" {
+			options.ServerType = &hcloud.ServerType{Name: serverType}
+		}
+
+		if location != "" {
+			options.Location = &hcloud.Location{Name: location}
+		}
+
+		volume, err := client.WriteToVolume(ctx, options)
+
+		res := newResult(start)
+		res.DryRun = options.DryRun
+
+		if err != nil {
+			return printFailedResult(cmd.OutOrStdout(), res, fmt.Errorf("failed to write the image: %w", err))
+		}
+
+		if options.DryRun {
+			logger.InfoContext(ctx, "Dry run finished, nothing was changed")
+			return printResult(cmd.OutOrStdout(), res)
+		}
+
+		res.Volume = &idResult{ID: volume.ID, Name: volume.Name}
+
+		logger.InfoContext(ctx, "Successfully wrote the image!", "volume", volume.ID)
+
+		return printResult(cmd.OutOrStdout(), res)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(writeToVolumeCmd)
+
+	registerWriteOptions(writeToVolumeCmd)
+
+	writeToVolumeCmd.Flags().String(volumeFlagVolume, "", "ID or name of an existing volume that is not attached to a server")
+	_ = writeToVolumeCmd.RegisterFlagCompletionFunc(
+		volumeFlagVolume,
+		func(cmd *cobra.Command, args []string, toComplete string) ([]cobra.Completion, cobra.ShellCompDirective) {
+			volumes, err := hcloudclient.Volume.AllWithOpts(cmd.Context(), hcloud.VolumeListOpts{})
+			if err != nil {
+				return []cobra.Completion{}, cobra.ShellCompDirectiveError
+			}
+
+			volumeNames := make([]string, len(volumes))
+			for i, volume := range volumes {
+				volumeNames[i] = volume.Name
+			}
+
+			return volumeNames, cobra.ShellCompDirectiveNoFileComp
+		},
+	)
+
+	writeToVolumeCmd.Flags().Int(volumeFlagSize, 0, "Size in GB of a new volume for the image (minimum 10)")
+	writeToVolumeCmd.MarkFlagsOneRequired(volumeFlagVolume, volumeFlagSize)
+	writeToVolumeCmd.MarkFlagsMutuallyExclusive(volumeFlagVolume, volumeFlagSize)
+
+	writeToVolumeCmd.Flags().String(volumeFlagName, "", "Name of the new volume")
+	writeToVolumeCmd.Flags().StringToString(uploadFlagLabels, map[string]string{}, "Labels for the new volume")
+	writeToVolumeCmd.MarkFlagsMutuallyExclusive(volumeFlagVolume, volumeFlagName)
+	writeToVolumeCmd.MarkFlagsMutuallyExclusive(volumeFlagVolume, uploadFlagLabels)
+
+	writeToVolumeCmd.Flags().String(uploadFlagLocation, "", "Location of the new volume and the temporary server [default: fsn1, choices: fsn1, nbg1, hel1, ash, hil, sin]")
+	_ = writeToVolumeCmd.RegisterFlagCompletionFunc(
+		uploadFlagLocation,
+		cobra.FixedCompletions([]string{"fsn1", "nbg1", "hel1", "ash", "hil", "sin"}, cobra.ShellCompDirectiveNoFileComp),
+	)
+	writeToVolumeCmd.MarkFlagsMutuallyExclusive(volumeFlagVolume, uploadFlagLocation)
+
+	writeToVolumeCmd.Flags().String(uploadFlagArchitecture, "", "CPU architecture of the temporary server [default: x86, choices: x86, arm]")
+	_ = writeToVolumeCmd.RegisterFlagCompletionFunc(
+		uploadFlagArchitecture,
+		cobra.FixedCompletions([]string{string(hcloud.ArchitectureX86), string(hcloud.ArchitectureARM)}, cobra.ShellCompDirectiveNoFileComp),
+	)
+	writeToVolumeCmd.Flags().String(uploadFlagServerType, "", "Explicitly use this server type for the temporary server. Mutually exclusive with --architecture.")
+	writeToVolumeCmd.MarkFlagsMutuallyExclusive(uploadFlagArchitecture, uploadFlagServerType)
+}
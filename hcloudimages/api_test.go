@@ -0,0 +1,57 @@
+package hcloudimages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/exp/mockutil"
+)
+
+// newTestClient returns a client for a fake API that expects exactly the requests, in order. Actions in the responses
+// should already be finished, so they are not polled.
+func newTestClient(t *testing.T, requests []mockutil.Request, opts ...ClientOption) *Client {
+	t.Helper()
+
+	var calls atomic.Int32
+	handler := mockutil.Handler(t, requests)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(func() {
+		server.Close()
+		if int(calls.Load()) != len(requests) {
+			t.Errorf("API received %d requests, want %d", calls.Load(), len(requests))
+		}
+	})
+
+	hc := hcloud.NewClient(
+		hcloud.WithEndpoint(server.URL),
+		hcloud.WithToken("token"),
+		hcloud.WithPollOpts(hcloud.PollOpts{BackoffFunc: hcloud.ConstantBackoff(0)}),
+		hcloud.WithRetryOpts(hcloud.RetryOpts{BackoffFunc: hcloud.ConstantBackoff(0), MaxRetries: 0}),
+	)
+	return NewClient(hc, opts...)
+}
+
+// Responses of the fake API that are used by many tests.
+var (
+	getServerTypeRequest = mockutil.Request{
+		Method: "GET", Path: "/server_types?name=cx23",
+		Status:  http.StatusOK,
+		JSONRaw: `{"server_types": [{"id": 1, "name": "cx23", "architecture": "x86", "disk": 40}]}`,
+	}
+	getLocationRequest = mockutil.Request{
+		Method: "GET", Path: "/locations?name=fsn1",
+		Status:  http.StatusOK,
+		JSONRaw: `{"locations": [{"id": 1, "name": "fsn1"}]}`,
+	}
+)
+
+// apiError returns the response body of a failed API call.
+func apiError(code hcloud.ErrorCode) string {
+	return `{"error": {"code": "` + string(code) + `", "message": "test error"}}`
+}
@@ -1,12 +1,17 @@
 package hcloudimages
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/url"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
@@ -16,7 +21,9 @@ import (
 	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
 	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/actionutil"
 	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/control"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/journal"
 	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/labelutil"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/progress"
 	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/randomid"
 	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/sshsession"
 )
@@ -26,6 +33,12 @@ const (
 	CreatedByValue = "hcloud-upload-image"
 
 	resourcePrefix = "hcloud-upload-image-"
+
+	// Printed by the command built in [assembleCommand] if the image does not match [WriteOptions.ImageChecksum].
+	checksumMismatchMessage = "image checksum mismatch"
+
+	// Printed by the command built in [assembleCommand] if a zip archive does not contain exactly one file.
+	zipEntriesMessage = "zip archive must contain exactly one file"
 )
 
 var (
@@ -44,9 +57,16 @@ var (
 
 	defaultSSHDialTimeout = 1 * time.Minute
 
-	// Size observed on x86, 2025-05-03, no idea if that changes.
-	// Might be able to extends this to more of the available memory.
-	rescueSystemRootDiskSizeMB int64 = 960
+	// Cleanup of temporary resources continues for this long after the context passed by the user was cancelled.
+	cleanupTimeout = 5 * time.Minute
+
+	sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+	// The archive member is quoted in the command on the rescue system, so no characters are allowed that have a
+	// special meaning in quotes.
+	archiveMemberPattern = regexp.MustCompile(`^[A-Za-z0-9._+@%=,:/ -]+$`)
+
+	targetDevicePattern = regexp.MustCompile(`^/dev/[A-Za-z0-9._:/-]+$`)
 )
 
 type WriteOptions struct {
@@ -57,14 +77,63 @@ type WriteOptions struct {
 	ImageReader io.Reader
 
 	// ImageCompression describes the compression of the referenced image file. It defaults to [CompressionNone]. If
-	// set to anything else, the file will be decompressed before written to the disk.
+	// set to anything else, the file will be decompressed before written to the disk. Use [CompressionAuto] to detect
+	// it from the image.
 	ImageCompression Compression
 
+	// ImageFormat describes the format of the image after decompression. It defaults to [FormatRaw]. Use [FormatAuto]
+	// to detect it from the image.
 	ImageFormat Format
 
 	// Can be optionally set to make the client validate that the image can be written to the server.
 	ImageSize int64
 
+	// TransferCompression compresses the image on the client while it is sent to the rescue system, where it is
+	// decompressed again before it is written. Only [CompressionNone] and [CompressionZSTD] are supported. It only
+	// applies to images that are sent from the client with [CompressionNone], including images that were processed on
+	// the client. Compressed images are sent as they are, and images from ImageURL are downloaded by the rescue system.
+	// If the rescue system lacks zstd, the image is sent uncompressed.
+	TransferCompression Compression
+
+	// ImageChecksum is the expected SHA-256 checksum of the image file as a hex string. If set, the image is hashed on
+	// the rescue system while it is written to the disk, and the write fails if the checksum does not match.
+	//
+	// The checksum is calculated over the file as it is referenced by ImageURL or ImageReader, before any
+	// decompression happens. This matches the checksums published alongside most images.
+	//
+	// Raw images are written to the disk while they are streamed, so a mismatch is only detected after the disk was
+	// overwritten. With [Client.WriteToDisk] this leaves the server with a corrupt disk. Images that are stored in the
+	// rescue system first, e.g. qcow2 images, are verified before they are written.
+	ImageChecksum string
+
+	// Progress is optionally called every second while the image is written to the disk. It must not block.
+	Progress func(Progress)
+
+	// DryRun resolves and validates all inputs and logs a [Plan] of the API calls and commands, without creating or
+	// changing any resources.
+	DryRun bool
+
+	// ArchiveMember is the path of the disk image inside a tar archive, e.g. "disk.raw" for a GCE-style
+	// "image.tar.gz". The tar archive is extracted from the stream after the decompression, so it can be combined with
+	// any [Compression]. For [CompressionZIP] it selects the file in the zip archive, which then may contain more than
+	// one file. The path must match the name in the archive exactly, as listed by "tar -tf".
+	ArchiveMember string
+
+	// ScratchVolumeSize is the size in GB of a temporary Volume that is attached to the server to stage images that
+	// need random access, like qcow2 images, instead of the memory-backed root disk of the rescue system. This allows
+	// images that are larger than the rescue system root disk. The minimum size is 10 GB. The Volume costs money and
+	// is deleted after the image was written. Raw images are streamed to the disk and never use the Volume.
+	ScratchVolumeSize int
+
+	// Processing selects where the image is decompressed, extracted and converted. It defaults to [ProcessingAuto].
+	Processing Processing
+
+	// TargetDevice is the block device in the rescue system that the image is written to, e.g. "/dev/nvme0n1" or
+	// "/dev/disk/by-id/scsi-0HC_Volume_123" for an attached Volume. By default, the root disk of the server is detected
+	// with lsblk: the only disk that is neither read-only, removable nor a Volume. If there is no such disk, or more
+	// than one, the write fails with [ErrTargetDevice] before anything is written.
+	TargetDevice string
+
 	// Server the image is written to.
 	Server *hcloud.Server
 }
@@ -77,7 +146,7 @@ type UploadOptions struct {
 	//
 	// Internally this decides what server type is used for the temporary server.
 	//
-	// Optional if [UploadOptions.ServerType] is set.
+	// Optional if [UploadOptions.ServerType] or [UploadOptions.BaseImage] is set.
 	Architecture hcloud.Architecture
 
 	// ServerType can be optionally set to override the default server type for the architecture.
@@ -103,6 +172,16 @@ type UploadOptions struct {
 
 	// DebugSkipResourceCleanup will skip the cleanup of the temporary SSH Key and Server.
 	DebugSkipResourceCleanup bool
+
+	// BaseImage is an earlier snapshot or backup of the image, e.g. of the previous release. If set, the temporary
+	// server is created from it and only the blocks that changed are written: the disk is hashed in the rescue system,
+	// compared with the image on the client, and only the differing blocks are sent. This is a lot faster if only a
+	// small part of a large image changed, but the whole disk is read once in the rescue system.
+	//
+	// The image is always processed on the client, like with [ProcessingClient], so images from
+	// [WriteOptions.ImageURL] are downloaded by the client. The architecture defaults to the one of BaseImage and
+	// [WriteOptions.TargetDevice] can not be set.
+	BaseImage *hcloud.Image
 }
 
 type Compression string
@@ -112,9 +191,18 @@ const (
 	CompressionBZ2  Compression = "bz2"
 	CompressionXZ   Compression = "xz"
 	CompressionZSTD Compression = "zstd"
-
-	// Possible future additions:
-	// zip
+	CompressionGZIP Compression = "gzip"
+	CompressionLZ4  Compression = "lz4"
+
+	// CompressionZIP allows to upload zip archives that contain a single file, the disk image. zip archives can not be
+	// extracted from a stream, so the archive is stored in the rescue system first. The same limits as for
+	// [FormatQCOW2] apply to the size of the archive.
+	CompressionZIP Compression = "zip"
+
+	// CompressionAuto detects the compression from the magic bytes at the start of the image, or from the file
+	// extension of [WriteOptions.ImageURL] or the name of [WriteOptions.ImageReader] if it is a file. Images without
+	// known magic bytes are treated as uncompressed.
+	CompressionAuto Compression = "auto"
 )
 
 type Format string
@@ -122,77 +210,171 @@ type Format string
 const (
 	FormatRaw Format = ""
 
+	// FormatAuto detects the format from the magic bytes at the start of the decompressed image, or from the file
+	// extension. Raw images are recognized by their MBR or GPT partition table. The format of xz, zstd and lz4
+	// compressed images can only be detected from the file extension, e.g. "image.qcow2.xz".
+	FormatAuto Format = "auto"
+
 	// FormatQCOW2 allows to upload images in the qcow2 format directly.
 	//
 	// The qcow2 image must fit on the disk available in the rescue system. "qemu-img dd", which is used to convert
-	// qcow2 to raw, requires a file as an input. If [WriteOptions.ImageSize] is set and FormatQCOW2 is used, there is a
-	// warning message displayed if there is a high probability of issues.
+	// qcow2 to raw, requires a file as an input. If [WriteOptions.ImageSize] is set, it is compared with the free space
+	// that the rescue system reports before anything is written, and [ErrNoSpaceLeft] is returned if it does not fit.
+	//
+	// With [ProcessingAuto], qcow2 images that do not fit, and uncompressed qcow2 images whose [WriteOptions.ImageSize]
+	// is unknown, are converted to raw on the client instead. If [WriteOptions.ImageReader] does not implement
+	// [io.ReaderAt], or [WriteOptions.ImageURL] is used, the image is downloaded to a temporary file first.
 	FormatQCOW2 Format = "qcow2"
+
+	// FormatVMDK allows to upload VMware images, e.g. the disk of an OVA. The same limits as for [FormatQCOW2] apply.
+	FormatVMDK Format = "vmdk"
+
+	// FormatVHD allows to upload Hyper-V and Azure images in the VHD (VPC) format. The same limits as for
+	// [FormatQCOW2] apply.
+	FormatVHD Format = "vhd"
+
+	// FormatVHDX allows to upload Hyper-V images in the VHDX format. The same limits as for [FormatQCOW2] apply.
+	FormatVHDX Format = "vhdx"
+
+	// FormatVDI allows to upload VirtualBox images. The same limits as for [FormatQCOW2] apply.
+	FormatVDI Format = "vdi"
 )
 
+type Processing string
+
+const (
+	// ProcessingAuto processes the image in the rescue system, unless it lacks a tool that is needed for the image. In
+	// that case the image is processed on the client, like with [ProcessingClient].
+	ProcessingAuto Processing = ""
+
+	// ProcessingRescue always processes the image in the rescue system, and fails if a tool is missing.
+	ProcessingRescue Processing = "rescue"
+
+	// ProcessingClient decompresses, extracts and converts the image on the client, and only sends the raw image to
+	// the rescue system, which writes it to the disk. Images from [WriteOptions.ImageURL] are downloaded by the
+	// client. [CompressionLZ4], [FormatVMDK], [FormatVHD], [FormatVHDX] and [FormatVDI] are not supported, and qcow2
+	// images inside a zip archive must be stored without compression.
+	ProcessingClient Processing = "client"
+)
+
+// qemuDriver returns the name of the format in qemu-img, or an empty string if the format is not converted through
+// qemu-img.
+func (f Format) qemuDriver() string {
+	switch f {
+	case FormatQCOW2, FormatVMDK, FormatVHDX, FormatVDI:
+		return string(f)
+	case FormatVHD:
+		return "vpc"
+	default:
+		return ""
+	}
+}
+
 // NewClient instantiates a new client. It requires a working [*hcloud.Client] to interact with the Hetzner Cloud API.
-func NewClient(c *hcloud.Client) *Client {
-	return &Client{
+func NewClient(c *hcloud.Client, opts ...ClientOption) *Client {
+	client := &Client{
 		c: c,
 	}
+
+	for _, opt := range opts {
+		opt(client)
+	}
+
+	return client
 }
 
 type Client struct {
-	c *hcloud.Client
+	c          *hcloud.Client
+	observer   Observer
+	journalDir string
+}
+
+// ClientOption configures optional behaviour of a [Client] in [NewClient].
+type ClientOption func(*Client)
+
+// WithObserver sets an [Observer] that receives [Event]s about the progress of all method calls.
+func WithObserver(observer Observer) ClientOption {
+	return func(c *Client) {
+		c.observer = observer
+	}
 }
 
 // WriteToDisk writes the specified image onto the root disk of an existing server on Hetzner Cloud.
 //
 // The server will be rebooted multiple times and any existing data is lost.
-func (s *Client) WriteToDisk(ctx context.Context, options WriteOptions) error {
-	id, err := randomid.Generate()
+func (s *Client) WriteToDisk(ctx context.Context, options WriteOptions) (err error) {
+	if options.DryRun {
+		plan, err := s.planWriteToDisk(ctx, options)
+		if err != nil {
+			return err
+		}
+		plan.log(ctx)
+		return nil
+	}
+
+	ctx, r, err := s.newRun(ctx, "write")
 	if err != nil {
 		return err
 	}
+	defer r.closeJournal(ctx)
+	defer r.joinCleanupError(&err)
+	logger := contextlogger.From(ctx)
 
-	logger := contextlogger.From(ctx).With(
-		"library", "hcloudimages",
-		"method", "write",
-		"run-id", id,
-	)
-	ctx = contextlogger.New(ctx, logger)
+	options, err = detectImage(ctx, options)
+	if err != nil {
+		return err
+	}
+
+	options, removeTempFile, err := prepareImage(ctx, options)
+	defer removeTempFile()
+	if err != nil {
+		return err
+	}
+
+	resourceName := resourcePrefix + r.id
+	r.resources.ServerID = options.Server.ID
 
-	resourceName := resourcePrefix + id
+	tempLabels := r.tempLabels(DefaultLabels)
+	r.heartbeat = s.startHeartbeat(ctx, tempLabels)
+	defer r.heartbeat.stop()
 
 	// 1. Create SSH Key
-	key, privateKey, keyCleanup, err := s.generateSSHKey(ctx, 1, resourceName, DefaultLabels)
+	key, privateKey, keyCleanup, err := s.generateSSHKey(ctx, r, 1, resourceName, tempLabels)
 	if err != nil {
 		return err
 	}
 	defer keyCleanup(false)
 
 	// 2. Power off Server
-	logger.InfoContext(ctx, "# Step 2: Shutting down server")
+	st := r.startStep(ctx, 2, StepPowerOffServer, "Shutting down server")
 	powerOffAction, _, err := s.c.Server.Poweroff(ctx, options.Server)
 	if err != nil {
-		return fmt.Errorf("stopping the server failed: %w", err)
+		return st.fail(ctx, fmt.Errorf("stopping the server failed: %w", err))
 	}
 
 	logger.DebugContext(ctx, "power off requested, waiting on action")
 
+	st.waitingOn(powerOffAction)
 	err = s.c.Action.WaitFor(ctx, powerOffAction)
 	if err != nil {
-		return fmt.Errorf("stopping the server failed: %w", err)
+		return st.fail(ctx, fmt.Errorf("stopping the server failed: %w", err))
 	}
 	logger.DebugContext(ctx, "action finished, server is powered off")
+	st.done(ctx)
 
 	// 3-8
-	return s.write(ctx, options, 3, key, privateKey)
+	_, err = s.write(ctx, r, options, false, 3, key, privateKey)
+	return err
 }
 
-func (s *Client) generateSSHKey(ctx context.Context, step int, resourceName string, labels map[string]string) (*hcloud.SSHKey, []byte, func(bool), error) {
+func (s *Client) generateSSHKey(ctx context.Context, r *run, number int, resourceName string, labels map[string]string) (*hcloud.SSHKey, []byte, func(bool), error) {
 	logger := contextlogger.From(ctx)
 
 	// 1. Create SSH Key
-	logger.InfoContext(ctx, fmt.Sprintf("# Step %d: Generating SSH Key", step))
+	st := r.startStep(ctx, number, StepGenerateSSHKey, "Generating SSH Key")
 	privateKey, publicKey, err := sshutil.GenerateKeyPair()
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to generate temporary ssh key pair: %w", err)
+		return nil, nil, nil, st.fail(ctx, fmt.Errorf("failed to generate temporary ssh key pair: %w", err))
 	}
 
 	key, _, err := s.c.SSHKey.Create(ctx, hcloud.SSHKeyCreateOpts{
@@ -201,81 +383,328 @@ func (s *Client) generateSSHKey(ctx context.Context, step int, resourceName stri
 		Labels:    labels,
 	})
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to submit temporary ssh key to API: %w", err)
+		return nil, nil, nil, st.fail(ctx, fmt.Errorf("failed to submit temporary ssh key to API: %w", err))
 	}
 	logger.DebugContext(ctx, "Uploaded ssh key", "ssh-key-id", key.ID)
+	r.resources.SSHKeyID = key.ID
+	r.track(ctx, journal.ResourceSSHKey, key.ID, key.Name)
+	r.heartbeat.addSSHKey(key)
+	st.done(ctx)
+
 	return key, privateKey, func(skipCleanup bool) {
 		// Cleanup SSH Key
 		if skipCleanup {
 			logger.InfoContext(ctx, "Cleanup: Skipping cleanup of temporary ssh key")
+			r.cleanup.Skipped = true
 			return
 		}
 
-		logger.InfoContext(ctx, "Cleanup: Deleting temporary ssh key")
+		r.heartbeat.stop()
+
+		// The context might already be cancelled, but we still want to delete the key
+		ctx, cancel := cleanupContext(ctx)
+		defer cancel()
+
+		st := r.startStep(ctx, 0, StepDeleteSSHKey, "Deleting temporary ssh key")
 
 		_, err := s.c.SSHKey.Delete(ctx, key)
 		if err != nil {
-			logger.WarnContext(ctx, "Cleanup: ssh key could not be deleted", "error", err)
+			r.warn(ctx, "Cleanup: ssh key could not be deleted", "error", err)
+			r.cleanupError().addSSHKey(key.ID, err)
+			_ = st.fail(ctx, err)
 			// TODO
+			return
 		}
+		r.untrack(ctx, journal.ResourceSSHKey, key.ID)
+		r.cleanup.SSHKeyDeleted = true
+		st.done(ctx)
 	}, nil
 }
 
+// cleanupContext returns a context that is not cancelled when ctx is, so resources can still be deleted after the
+// user aborted the operation. It keeps the values of ctx, like the logger.
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+}
+
 // write is the internal utility function to actually write the image to a root disk. It expects a powered off server and returns a powered off server.
-func (s *Client) write(ctx context.Context, options WriteOptions, initialStep int, key *hcloud.SSHKey, privateKey []byte) error {
+// It returns the number of the next step, which depends on whether a scratch volume was created.
+//
+// If delta is set, the raw image is compared with the existing disk and only the changed blocks are written, see
+// [UploadOptions.BaseImage].
+func (s *Client) write(ctx context.Context, r *run, options WriteOptions, delta bool, initialStep int, key *hcloud.SSHKey, privateKey []byte) (int, error) {
 	logger := contextlogger.From(ctx)
 
-	// 0. Validations
-	if options.ImageFormat == FormatQCOW2 && options.ImageSize > 0 {
-		if options.ImageSize > rescueSystemRootDiskSizeMB*1024*1024 {
-			// Just a warning, because the size might change with time.
-			// Alternatively one could add an override flag for the check and make this an error.
-			logger.WarnContext(ctx,
-				fmt.Sprintf("image must be smaller than %d MB (rescue system root disk) for qcow2", rescueSystemRootDiskSizeMB),
-				"maximum-size", rescueSystemRootDiskSizeMB,
-				"actual-size", options.ImageSize/(1024*1024),
-			)
+	var env rescueEnvironment
+	if useScratchVolume(options) {
+		volume, volumeCleanup, err := s.createScratchVolume(ctx, r, initialStep, resourcePrefix+r.id, r.tempLabels(DefaultLabels), options)
+		if volumeCleanup != nil {
+			defer volumeCleanup()
 		}
+		if err != nil {
+			return 0, err
+		}
+		env.ScratchDevice = volumeDevice(volume)
+		initialStep++
+	}
+
+	// 3-5. Boot into the rescue system
+	sshClient, err := s.bootRescue(ctx, r, initialStep, options.Server, key, privateKey)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = sshClient.Close() }()
+
+	// 6. Probe the rescue system, to fail before anything is downloaded or written
+	st := r.startStep(ctx, initialStep+3, StepProbeRescue, "Probing rescue system")
+	tools := append(writeTools(options), requiredTools(options)...)
+	if delta {
+		tools = append(tools, deltaTools...)
 	}
+	tools = transferTools(tools, options)
+	rescue, err := s.probeRescueSystem(ctx, sshClient, tools, options.TargetDevice)
+	if err != nil {
+		return 0, st.fail(ctx, err)
+	}
+	logger.DebugContext(ctx, "probed rescue system",
+		"tools", rescue.Tools,
+		"missing-tools", rescue.Missing,
+		"staging-available", rescue.StagingAvailable,
+		"target-device", rescue.TargetDevice,
+		"target-device-size", rescue.TargetDeviceSize,
+		"memory-available", rescue.MemoryAvailable,
+	)
+	env.TargetDevice = rescue.TargetDevice
+
+	useClient, err := checkRescueSystem(options, rescue)
+	if err != nil {
+		return 0, st.fail(ctx, err)
+	}
+	if delta {
+		for _, tool := range deltaTools {
+			if slices.Contains(rescue.Missing, tool) {
+				return 0, st.fail(ctx, fmt.Errorf("%w: %s is missing", ErrRescueSystem, tool))
+			}
+		}
+	}
+	if useClient {
+		r.warn(ctx, "rescue system can not process the image, processing it on the client", "missing-tools", rescue.Missing)
+
+		var processCleanup func()
+		options, processCleanup, err = processOnClient(ctx, options)
+		defer processCleanup()
+		if err != nil {
+			return 0, st.fail(ctx, err)
+		}
+		if err := checkTargetDevice(options, rescue); err != nil {
+			return 0, st.fail(ctx, err)
+		}
+	}
+	if compressTransfer(options) && slices.Contains(rescue.Missing, "zstd") {
+		r.warn(ctx, "rescue system can not decompress the transfer, sending the image uncompressed", "missing-tools", rescue.Missing)
+		options.TransferCompression = CompressionNone
+	}
+	st.done(ctx)
+
+	var hashes [][sha256.Size]byte
+	if delta {
+		// 7. Hash the existing disk, to only write the blocks that changed
+		st = r.startStep(ctx, initialStep+4, StepHashDisk, "Hashing existing disk")
+
+		output, err := sshsession.Run(ctx, sshClient, hashCommand(env.TargetDevice), nil)
+		if err != nil {
+			return 0, st.fail(ctx, fmt.Errorf("failed to hash existing disk: %w", remoteError(output, err)))
+		}
+		hashes, err = parseBlockHashes(output, rescue.TargetDeviceSize)
+		if err != nil {
+			return 0, st.fail(ctx, fmt.Errorf("failed to hash existing disk: %w", err))
+		}
+		st.done(ctx)
+	} else {
+		// 7. Wipe existing disk, to avoid storing any bytes from it in the snapshot
+		st = r.startStep(ctx, initialStep+4, StepCleanDisk, "Cleaning existing disk")
+
+		output, err := sshsession.Run(ctx, sshClient, "blkdiscard --force "+env.TargetDevice, nil)
+		logger.DebugContext(ctx, string(output))
+		if err != nil {
+			return 0, st.fail(ctx, fmt.Errorf("failed to clean existing disk: %w", err))
+		}
+		st.done(ctx)
+	}
+
+	// 8. SSH On Server: Download Image, Decompress, Write to Root Disk
+	st = r.startStep(ctx, initialStep+5, StepWriteImage, "Downloading image and writing to disk")
+
+	tracker := &progress.Tracker{}
+
+	// sendExtents sends only parts of the image as extents for [extentCommand], if that is possible
+	var sendExtents func(w io.Writer) error
+	if delta {
+		image := tracker.Reader(options.ImageReader)
+		sendExtents = func(w io.Writer) error {
+			stats, err := writeDelta(w, image, hashes, rescue.TargetDeviceSize)
+			if err == nil {
+				logger.InfoContext(ctx, "Only changed blocks are written",
+					"blocks", stats.Blocks,
+					"written", stats.Written,
+					"discarded", stats.Discarded,
+				)
+			}
+			return err
+		}
+	} else if file, size, ok := sparseFile(options); ok {
+		// The image is hashed on the client, as the rescue system does not receive the holes
+		checksum, err := newChecksumVerifier(options.ImageChecksum)
+		if err != nil {
+			return 0, st.fail(ctx, err)
+		}
+		regions := dataRegions(file, size)
+		sendExtents = func(w io.Writer) error {
+			stats, err := writeSparse(w, file, size, regions, tracker, checksum)
+			if err == nil {
+				logger.InfoContext(ctx, "Only the data of the image is sent", "size", stats.Size, "sent", stats.Sent)
+			}
+			return err
+		}
+	}
+
+	var cmd string
+	var stdin io.Reader
+	// stopExtents stops sending the extents and returns the error of the client side
+	var stopExtents func() error
+	if sendExtents != nil {
+		cmd = extentCommand(env.TargetDevice, decompressTransferCommand(options))
+
+		pr, pw := io.Pipe()
+		defer func() { _ = pr.Close() }()
+		extentsErr := make(chan error, 1)
+		go func() {
+			err := sendExtents(pw)
+			extentsErr <- err
+			_ = pw.CloseWithError(err)
+		}()
+		stdin = pr
+		stopExtents = func() error {
+			_ = pr.Close()
+			return <-extentsErr
+		}
+	} else {
+		cmd, err = assembleCommand(options, env)
+		if err != nil {
+			return 0, st.fail(ctx, err)
+		}
+		if options.ImageReader != nil {
+			stdin = tracker.Reader(options.ImageReader)
+		}
+	}
+
+	// sent counts the bytes of the compressed stream, stopCompression returns the error of the client side
+	sent := &progress.Tracker{}
+	var stopCompression func() error
+	if compressTransfer(options) && stdin != nil {
+		var compressed io.Reader
+		compressed, stopCompression = compressStream(stdin)
+		defer func() { _ = stopCompression() }()
+		stdin = sent.Reader(compressed)
+	}
+
+	logger.DebugContext(ctx, "running download, decompress and write to disk command", "cmd", cmd)
+
+	var output []byte
+	if options.Progress != nil {
+		var buf bytes.Buffer
+		stopProgress := reportProgress(options, tracker)
+		err = sshsession.Stream(ctx, sshClient, cmd, stdin, io.MultiWriter(&buf, tracker))
+		stopProgress()
+		output = buf.Bytes()
+	} else {
+		output, err = sshsession.Run(ctx, sshClient, cmd, stdin)
+	}
+	logger.InfoContext(ctx, fmt.Sprintf("# Step %d: Finished writing image to disk", initialStep+5))
+	logger.DebugContext(ctx, string(output))
+	r.bytesTransferred = tracker.Read()
+	if options.ImageReader == nil {
+		r.bytesTransferred = options.ImageSize
+	}
+	if err != nil {
+		if stopExtents != nil {
+			// The rescue system only sees that the stream ended early if reading the image failed on the client
+			if clientErr := stopExtents(); clientErr != nil && !errors.Is(clientErr, io.ErrClosedPipe) {
+				return 0, st.fail(ctx, clientErr)
+			}
+		}
+		if stopCompression != nil {
+			// zstd fails on the incomplete stream, which would hide why reading the image failed
+			if clientErr := stopCompression(); clientErr != nil {
+				return 0, st.fail(ctx, clientErr)
+			}
+		}
+		return 0, st.fail(ctx, remoteError(output, err))
+	}
+	if stopCompression != nil {
+		logger.InfoContext(ctx, "The image was compressed for the transfer", "size", tracker.Read(), "sent", sent.Read())
+	}
+	st.done(ctx)
+
+	// 9. SSH On Server: Shutdown
+	st = r.startStep(ctx, initialStep+6, StepShutdownServer, "Shutting down server")
+	_, err = sshsession.Run(ctx, sshClient, "shutdown now", nil)
+	if err != nil {
+		// TODO Verify if shutdown error, otherwise return
+		r.warn(ctx, "shutdown returned error", "err", err)
+	}
+	st.done(ctx)
+
+	return initialStep + 7, nil
+}
+
+// bootRescue enables the rescue system on the powered off server, boots it and opens an SSH connection to it. The
+// caller has to close the returned client.
+func (s *Client) bootRescue(ctx context.Context, r *run, initialStep int, server *hcloud.Server, key *hcloud.SSHKey, privateKey []byte) (*ssh.Client, error) {
+	logger := contextlogger.From(ctx)
 
 	// 3. Activate Rescue System
-	logger.InfoContext(ctx, fmt.Sprintf("# Step %d: Activating Rescue System", initialStep+0))
-	enableRescueResult, _, err := s.c.Server.EnableRescue(ctx, options.Server, hcloud.ServerEnableRescueOpts{
+	st := r.startStep(ctx, initialStep+0, StepEnableRescue, "Activating Rescue System")
+	enableRescueResult, _, err := s.c.Server.EnableRescue(ctx, server, hcloud.ServerEnableRescueOpts{
 		Type:    defaultRescueType,
 		SSHKeys: []*hcloud.SSHKey{key},
 	})
 	if err != nil {
-		return fmt.Errorf("enabling the rescue system on the temporary server failed: %w", err)
+		return nil, st.fail(ctx, fmt.Errorf("enabling the rescue system on the temporary server failed: %w", err))
 	}
 
 	logger.DebugContext(ctx, "rescue system requested, waiting on action")
 
+	st.waitingOn(enableRescueResult.Action)
 	err = s.c.Action.WaitFor(ctx, enableRescueResult.Action)
 	if err != nil {
-		return fmt.Errorf("enabling the rescue system on the temporary server failed: %w", err)
+		return nil, st.fail(ctx, fmt.Errorf("enabling the rescue system on the temporary server failed: %w", err))
 	}
 	logger.DebugContext(ctx, "action finished, rescue system enabled")
+	st.done(ctx)
 
 	// 4. Boot Server
-	logger.InfoContext(ctx, fmt.Sprintf("# Step %d: Booting Server", initialStep+1))
-	powerOnAction, _, err := s.c.Server.Poweron(ctx, options.Server)
+	st = r.startStep(ctx, initialStep+1, StepBootServer, "Booting Server")
+	powerOnAction, _, err := s.c.Server.Poweron(ctx, server)
 	if err != nil {
-		return fmt.Errorf("starting the temporary server failed: %w", err)
+		return nil, st.fail(ctx, fmt.Errorf("starting the temporary server failed: %w", err))
 	}
 
 	logger.DebugContext(ctx, "boot requested, waiting on action")
 
+	st.waitingOn(powerOnAction)
 	err = s.c.Action.WaitFor(ctx, powerOnAction)
 	if err != nil {
-		return fmt.Errorf("starting the temporary server failed: %w", err)
+		return nil, st.fail(ctx, fmt.Errorf("starting the temporary server failed: %w", err))
 	}
 	logger.DebugContext(ctx, "action finished, server is booting")
+	st.done(ctx)
 
 	// 5. Open SSH Session
-	logger.InfoContext(ctx, fmt.Sprintf("# Step %d: Opening SSH Connection", initialStep+2))
+	st = r.startStep(ctx, initialStep+2, StepOpenSSH, "Opening SSH Connection")
 	signer, err := ssh.ParsePrivateKey(privateKey)
 	if err != nil {
-		return fmt.Errorf("parsing the automatically generated temporary private key failed: %w", err)
+		return nil, st.fail(ctx, fmt.Errorf("parsing the automatically generated temporary private key failed: %w", err))
 	}
 
 	sshClientConfig := &ssh.ClientConfig{
@@ -296,103 +725,185 @@ func (s *Client) write(ctx context.Context, options WriteOptions, initialStep in
 		100, // ~ 3 minutes
 		func() error {
 			var err error
-			logger.DebugContext(ctx, "trying to connect to server", "ip", options.Server.PublicNet.IPv4.IP)
-			sshClient, err = ssh.Dial("tcp", options.Server.PublicNet.IPv4.IP.String()+":ssh", sshClientConfig)
+			logger.DebugContext(ctx, "trying to connect to server", "ip", server.PublicNet.IPv4.IP)
+			sshClient, err = ssh.Dial("tcp", server.PublicNet.IPv4.IP.String()+":ssh", sshClientConfig)
 			return err
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("failed to ssh into temporary server: %w", err)
+		return nil, st.fail(ctx, fmt.Errorf("%w: %w", ErrSSHUnreachable, err))
 	}
-	defer func() { _ = sshClient.Close() }()
+	st.done(ctx)
 
-	// 6. Wipe existing disk, to avoid storing any bytes from it in the snapshot
-	logger.InfoContext(ctx, fmt.Sprintf("# Step %d: Cleaning existing disk", initialStep+3))
+	return sshClient, nil
+}
 
-	output, err := sshsession.Run(sshClient, "blkdiscard --force /dev/sda", nil)
-	logger.DebugContext(ctx, string(output))
+// Upload the specified image into a snapshot on Hetzner Cloud.
+//
+// As the Hetzner Cloud API has no direct way to upload images, we create a temporary server,
+// overwrite the root disk and take a snapshot of that disk instead.
+//
+// The temporary server costs money. If the upload fails, we might be unable to delete the server. Check out
+// CleanupTempResources for a helper in this case.
+//
+// If [WriteOptions.DryRun] is set, no image is created and the returned image is nil.
+//
+// Use [Client.UploadWithResult] to get more details about the upload.
+func (s *Client) Upload(ctx context.Context, options UploadOptions) (*hcloud.Image, error) {
+	result, err := s.UploadWithResult(ctx, options)
 	if err != nil {
-		return fmt.Errorf("failed to clean existing disk: %w", err)
+		return nil, err
 	}
 
-	// 7. SSH On Server: Download Image, Decompress, Write to Root Disk
-	logger.InfoContext(ctx, fmt.Sprintf("# Step %d: Downloading image and writing to disk", initialStep+4))
+	return result.Image, nil
+}
 
-	cmd, err := assembleCommand(options)
+// UploadWithResult works like [Client.Upload], but returns an [UploadResult] with the details of the run. The
+// result is also returned if the upload failed, to show which steps ran and whether the temporary resources were
+// deleted.
+func (s *Client) UploadWithResult(ctx context.Context, options UploadOptions) (result *UploadResult, err error) {
+	if options.DryRun {
+		plan, err := s.planUpload(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+		plan.log(ctx)
+		return &UploadResult{Plan: plan}, nil
+	}
+
+	ctx, r, err := s.newRun(ctx, "upload")
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer r.closeJournal(ctx)
+	logger := contextlogger.From(ctx)
 
-	logger.DebugContext(ctx, "running download, decompress and write to disk command", "cmd", cmd)
+	result = &UploadResult{}
+	// Runs after all other deferred functions, so the outcome of the cleanup is included
+	defer r.result(result)
+	defer r.joinCleanupError(&err)
 
-	output, err = sshsession.Run(sshClient, cmd, options.ImageReader)
-	logger.InfoContext(ctx, fmt.Sprintf("# Step %d: Finished writing image to disk", initialStep+4))
-	logger.DebugContext(ctx, string(output))
-	if err != nil {
-		return fmt.Errorf("failed to download and write the image: %w", err)
+	if options.BaseImage != nil {
+		options, err = s.getBaseImage(ctx, options)
+		if err != nil {
+			return result, err
+		}
+		// Only the raw image can be compared with the disk
+		options.Processing = ProcessingClient
 	}
 
-	// 8. SSH On Server: Shutdown
-	logger.InfoContext(ctx, fmt.Sprintf("# Step %d: Shutting down server", initialStep+5))
-	_, err = sshsession.Run(sshClient, "shutdown now", nil)
+	options.WriteOptions, err = detectImage(ctx, options.WriteOptions)
 	if err != nil {
-		// TODO Verify if shutdown error, otherwise return
-		logger.WarnContext(ctx, "shutdown returned error", "err", err)
+		return result, err
 	}
+	result.ImageCompression = options.ImageCompression
+	result.ImageFormat = options.ImageFormat
 
-	return nil
-}
-
-// Upload the specified image into a snapshot on Hetzner Cloud.
-//
-// As the Hetzner Cloud API has no direct way to upload images, we create a temporary server,
-// overwrite the root disk and take a snapshot of that disk instead.
-//
-// The temporary server costs money. If the upload fails, we might be unable to delete the server. Check out
-// CleanupTempResources for a helper in this case.
-func (s *Client) Upload(ctx context.Context, options UploadOptions) (*hcloud.Image, error) {
-	id, err := randomid.Generate()
+	var removeTempFile func()
+	options.WriteOptions, removeTempFile, err = prepareImage(ctx, options.WriteOptions)
+	defer removeTempFile()
 	if err != nil {
-		return nil, err
+		return result, err
 	}
 
-	logger := contextlogger.From(ctx).With(
-		"library", "hcloudimages",
-		"method", "upload",
-		"run-id", id,
-	)
-	ctx = contextlogger.New(ctx, logger)
-
 	// For simplicity, we use the same random name for SSH Key + Server
-	resourceName := resourcePrefix + id
+	resourceName := resourcePrefix + r.id
 	labels := labelutil.Merge(DefaultLabels, options.Labels)
 
-	key, privateKey, keyCleanup, err := s.generateSSHKey(ctx, 1, resourceName, labels)
+	// The temporary resources get some additional labels to identify the run
+	tempLabels := r.tempLabels(labels)
+	r.heartbeat = s.startHeartbeat(ctx, tempLabels)
+	defer r.heartbeat.stop()
+
+	key, privateKey, keyCleanup, err := s.generateSSHKey(ctx, r, 1, resourceName, tempLabels)
 	if err != nil {
-		return nil, err
+		return result, err
 	}
 	defer keyCleanup(options.DebugSkipResourceCleanup)
 
 	// 2. Create Server
-	logger.InfoContext(ctx, "# Step 2: Creating Server")
-	var serverType *hcloud.ServerType
-	if options.ServerType != nil {
-		serverType = options.ServerType
+	serverImage := defaultImage
+	if options.BaseImage != nil {
+		serverImage = options.BaseImage
+	}
+	server, serverCleanup, err := s.createServer(ctx, r, 2, resourceName, tempLabels, key, serverImage, options.Architecture, options.ServerType, options.Location, options.DebugSkipResourceCleanup)
+	if serverCleanup != nil {
+		defer serverCleanup()
+	}
+	if err != nil {
+		return result, err
+	}
+	logger = logger.With("server", server.ID)
+
+	options.Server = server
+	result.Server = server
+	result.ServerType = server.ServerType
+	result.Location = server.Datacenter.Location
+
+	// Steps 3-8, or 3-9 with a scratch volume
+	next, err := s.write(ctx, r, options.WriteOptions, options.BaseImage != nil, 3, key, privateKey)
+	if err != nil {
+		return result, err
+	}
+
+	// 10. Create Image from Server
+	st := r.startStep(ctx, next, StepCreateImage, "Creating Image")
+	createImageResult, _, err := s.c.Server.CreateImage(ctx, options.Server, &hcloud.ServerCreateImageOpts{
+		Type:        hcloud.ImageTypeSnapshot,
+		Description: options.Description,
+		Labels:      labels,
+	})
+	if err != nil {
+		return result, st.fail(ctx, fmt.Errorf("%w: %w", ErrSnapshotFailed, err))
+	}
+	logger.DebugContext(ctx, "image creation requested, waiting on action")
+	r.resources.ImageID = createImageResult.Image.ID
+
+	st.waitingOn(createImageResult.Action)
+	err = s.c.Action.WaitFor(ctx, createImageResult.Action)
+	if err != nil {
+		return result, st.fail(ctx, fmt.Errorf("%w: %w", ErrSnapshotFailed, err))
+	}
+	logger.DebugContext(ctx, "action finished, image was created")
+	st.done(ctx)
+
+	image := createImageResult.Image
+	logger.InfoContext(ctx, "# Image was created", "image", image.ID)
+
+	result.Image = image
+	refreshed, err := s.waitForImage(ctx, image)
+	if err != nil {
+		r.warn(ctx, "failed to refresh the image", "error", err)
 	} else {
+		result.Image = refreshed
+	}
+
+	// Resource cleanup is happening in `defer`
+	return result, nil
+}
+
+// createServer creates the temporary server that boots into the rescue system. The server type is selected by
+// architecture, unless serverType is set. The server is created from image, which is never booted, but provides the
+// disk for [Client.Export] and [UploadOptions.BaseImage]. The returned function deletes the server again, it is also
+// returned with an error if the server was already created.
+func (s *Client) createServer(ctx context.Context, r *run, number int, resourceName string, labels map[string]string, key *hcloud.SSHKey, image *hcloud.Image, architecture hcloud.Architecture, serverType *hcloud.ServerType, location *hcloud.Location, skipCleanup bool) (*hcloud.Server, func(), error) {
+	logger := contextlogger.From(ctx)
+
+	st := r.startStep(ctx, number, StepCreateServer, "Creating Server")
+	if serverType == nil {
 		var ok bool
-		serverType, ok = serverTypePerArchitecture[options.Architecture]
+		serverType, ok = serverTypePerArchitecture[architecture]
 		if !ok {
-			return nil, fmt.Errorf("unknown architecture %q, valid options: %q, %q", options.Architecture, hcloud.ArchitectureX86, hcloud.ArchitectureARM)
+			return nil, nil, st.fail(ctx, fmt.Errorf("unknown architecture %q, valid options: %q, %q", architecture, hcloud.ArchitectureX86, hcloud.ArchitectureARM))
 		}
 	}
 
-	location := defaultLocation
-	if options.Location != nil {
-		location = options.Location
+	if location == nil {
+		location = defaultLocation
 	}
 
 	logger.DebugContext(ctx, "creating server with config",
-		"image", defaultImage.Name,
+		"image", image.Name,
 		"location", location.Name,
 		"serverType", serverType.Name,
 	)
@@ -406,93 +917,114 @@ func (s *Client) Upload(ctx context.Context, options UploadOptions) (*hcloud.Ima
 		// We need to enable rescue system first
 		StartAfterCreate: hcloud.Ptr(false),
 		// Image will never be booted, we only boot into rescue system
-		Image:    defaultImage,
+		Image:    image,
 		Location: location,
 		Labels:   labels,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("creating the temporary server failed: %w", err)
+		return nil, nil, st.fail(ctx, fmt.Errorf("creating the temporary server failed: %w", err))
 	}
-	logger = logger.With("server", serverCreateResult.Server.ID)
+	server := serverCreateResult.Server
+	logger = logger.With("server", server.ID)
 	logger.DebugContext(ctx, "Created Server")
+	r.resources.ServerID = server.ID
+	r.track(ctx, journal.ResourceServer, server.ID, server.Name)
+	r.heartbeat.addServer(server)
 
-	logger.DebugContext(ctx, "waiting on actions")
-	err = s.c.Action.WaitFor(ctx, append(serverCreateResult.NextActions, serverCreateResult.Action)...)
-	if err != nil {
-		return nil, fmt.Errorf("creating the temporary server failed: %w", err)
+	// The API response might not include everything that was requested
+	if server.ServerType == nil {
+		server.ServerType = serverType
+	}
+	if server.Datacenter == nil || server.Datacenter.Location == nil {
+		server.Datacenter = &hcloud.Datacenter{Location: location}
 	}
-	logger.DebugContext(ctx, "actions finished")
 
-	options.Server = serverCreateResult.Server
-	defer func() {
+	cleanup := func() {
 		// Cleanup Server
-		if options.DebugSkipResourceCleanup {
+		if skipCleanup {
 			logger.InfoContext(ctx, "Cleanup: Skipping cleanup of temporary server")
+			r.cleanup.Skipped = true
 			return
 		}
 
-		logger.InfoContext(ctx, "Cleanup: Deleting temporary server")
+		r.heartbeat.stop()
 
-		_, _, err := s.c.Server.DeleteWithResult(ctx, options.Server)
-		if err != nil {
-			logger.WarnContext(ctx, "Cleanup: server could not be deleted", "error", err)
-		}
-	}()
+		// The context might already be cancelled, but we still want to delete the server
+		ctx, cancel := cleanupContext(ctx)
+		defer cancel()
 
-	// Steps 3-8
-	err = s.write(ctx, options.WriteOptions, 3, key, privateKey)
-	if err != nil {
-		return nil, err
-	}
+		st := r.startStep(ctx, 0, StepDeleteServer, "Deleting temporary server")
 
-	// 9. Create Image from Server
-	logger.InfoContext(ctx, "# Step 9: Creating Image")
-	createImageResult, _, err := s.c.Server.CreateImage(ctx, options.Server, &hcloud.ServerCreateImageOpts{
-		Type:        hcloud.ImageTypeSnapshot,
-		Description: options.Description,
-		Labels:      labels,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to create snapshot: %w", err)
+		deleteResult, _, err := s.c.Server.DeleteWithResult(ctx, server)
+		if err != nil {
+			r.warn(ctx, "Cleanup: server could not be deleted", "error", err)
+			r.cleanupError().addServer(server.ID, err)
+			_ = st.fail(ctx, err)
+			return
+		}
+		r.untrack(ctx, journal.ResourceServer, server.ID)
+		r.cleanup.ServerDeleted = true
+		st.waitingOn(deleteResult.Action)
+		st.done(ctx)
 	}
-	logger.DebugContext(ctx, "image creation requested, waiting on action")
 
-	err = s.c.Action.WaitFor(ctx, createImageResult.Action)
+	logger.DebugContext(ctx, "waiting on actions")
+	st.waitingOn(serverCreateResult.Action)
+	err = s.c.Action.WaitFor(ctx, append(serverCreateResult.NextActions, serverCreateResult.Action)...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create snapshot: %w", err)
+		return server, cleanup, st.fail(ctx, fmt.Errorf("creating the temporary server failed: %w", err))
 	}
-	logger.DebugContext(ctx, "action finished, image was created")
-
-	image := createImageResult.Image
-	logger.InfoContext(ctx, "# Image was created", "image", image.ID)
+	logger.DebugContext(ctx, "actions finished")
+	st.done(ctx)
 
-	// Resource cleanup is happening in `defer`
-	return image, nil
+	return server, cleanup, nil
 }
 
 // CleanupTempResources tries to delete any resources that were left over from previous calls to [Client.Upload].
 // Upload tries to clean up any temporary resources it created at runtime, but might fail at any point.
 // You can then use this command to make sure that all temporary resources are removed from your project.
 //
-// This method tries to delete any server or ssh keys that match the [DefaultLabels]
+// This method tries to delete any server, volume or ssh keys that match the [DefaultLabels]. This includes resources of
+// runs that are still in progress, use [Client.CleanupTempResourcesWithOpts] to skip them.
 func (s *Client) CleanupTempResources(ctx context.Context) error {
+	return s.CleanupTempResourcesWithOpts(ctx, CleanupOptions{})
+}
+
+// CleanupTempResourcesWithOpts works like [Client.CleanupTempResources], but only deletes the resources that match
+// the [CleanupOptions].
+func (s *Client) CleanupTempResourcesWithOpts(ctx context.Context, opts CleanupOptions) error {
 	logger := contextlogger.From(ctx).With(
 		"library", "hcloudimages",
 		"method", "cleanup",
 	)
 
-	selector := labelutil.Selector(DefaultLabels)
+	labels := DefaultLabels
+	if opts.RunID != "" {
+		if !randomid.Valid(opts.RunID) {
+			return fmt.Errorf("invalid run id: %q", opts.RunID)
+		}
+		labels = labelutil.Merge(labels, map[string]string{RunIDLabel: opts.RunID})
+	}
+
+	selector := labelutil.Selector(labels)
 	logger = logger.With("selector", selector)
 
 	logger.InfoContext(ctx, "# Cleaning up Servers")
-	err := s.cleanupTempServers(ctx, logger, selector)
+	err := s.cleanupTempServers(ctx, logger, selector, opts)
 	if err != nil {
 		return fmt.Errorf("failed to clean up all servers: %w", err)
 	}
 	logger.DebugContext(ctx, "cleaned up all servers")
 
+	logger.InfoContext(ctx, "# Cleaning up Volumes")
+	err = s.cleanupTempVolumes(ctx, logger, selector, opts)
+	if err != nil {
+		return fmt.Errorf("failed to clean up all volumes: %w", err)
+	}
+	logger.DebugContext(ctx, "cleaned up all volumes")
+
 	logger.InfoContext(ctx, "# Cleaning up SSH Keys")
-	err = s.cleanupTempSSHKeys(ctx, logger, selector)
+	err = s.cleanupTempSSHKeys(ctx, logger, selector, opts)
 	if err != nil {
 		return fmt.Errorf("failed to clean up all ssh keys: %w", err)
 	}
@@ -501,28 +1033,49 @@ func (s *Client) CleanupTempResources(ctx context.Context) error {
 	return nil
 }
 
-func (s *Client) cleanupTempServers(ctx context.Context, logger *slog.Logger, selector string) error {
-	servers, err := s.c.Server.AllWithOpts(ctx, hcloud.ServerListOpts{ListOpts: hcloud.ListOpts{
+func (s *Client) cleanupTempServers(ctx context.Context, logger *slog.Logger, selector string, opts CleanupOptions) error {
+	allServers, err := s.c.Server.AllWithOpts(ctx, hcloud.ServerListOpts{ListOpts: hcloud.ListOpts{
 		LabelSelector: selector,
 	}})
 	if err != nil {
 		return fmt.Errorf("failed to list servers: %w", err)
 	}
 
+	now := time.Now()
+	servers := make([]*hcloud.Server, 0, len(allServers))
+	for _, server := range allServers {
+		if !shouldCleanup(server.Labels, server.Created, opts, now) {
+			logger.InfoContext(ctx, "skipping server", "server", server.ID, "run-id", server.Labels[RunIDLabel])
+			continue
+		}
+		servers = append(servers, server)
+	}
+
 	if len(servers) == 0 {
 		logger.InfoContext(ctx, "No servers found")
 		return nil
 	}
+
+	if opts.DryRun {
+		for _, server := range servers {
+			logger.InfoContext(ctx, "Dry run: would delete server", "server", server.ID, "name", server.Name)
+		}
+		return nil
+	}
 	logger.InfoContext(ctx, "removing servers", "count", len(servers))
 
-	errs := []error{}
+	cleanupErr := &CleanupError{}
 	actions := make([]*hcloud.Action, 0, len(servers))
+	runIDs := make(map[int64]string, len(servers))
 
 	for _, server := range servers {
+		runIDs[server.ID] = server.Labels[RunIDLabel]
+
 		result, _, err := s.c.Server.DeleteWithResult(ctx, server)
 		if err != nil {
-			errs = append(errs, err)
+			cleanupErr.addServer(server.ID, err)
 			logger.WarnContext(ctx, "failed to delete server", "server", server.ID, "error", err)
+			s.emitCleanup(ctx, StepDeleteServer, runIDs[server.ID], Resources{ServerID: server.ID}, err)
 			continue
 		}
 
@@ -540,6 +1093,7 @@ func (s *Client) cleanupTempServers(ctx context.Context, logger *slog.Logger, se
 			for _, resource := range action.Resources {
 				if resource.Type == hcloud.ActionResourceTypeServer {
 					ids = append(ids, resource.ID)
+					s.emitCleanup(ctx, StepDeleteServer, runIDs[resource.ID], Resources{ServerID: resource.ID, ActionID: action.ID}, nil)
 				}
 			}
 		}
@@ -549,55 +1103,152 @@ func (s *Client) cleanupTempServers(ctx context.Context, logger *slog.Logger, se
 
 	if len(errorActions) > 0 {
 		for _, action := range errorActions {
-			errs = append(errs, action.Error())
+			for _, resource := range action.Resources {
+				if resource.Type == hcloud.ActionResourceTypeServer {
+					cleanupErr.addServer(resource.ID, action.Error())
+					s.emitCleanup(ctx, StepDeleteServer, runIDs[resource.ID], Resources{ServerID: resource.ID, ActionID: action.ID}, action.Error())
+				}
+			}
 		}
 	}
 
-	if len(errs) > 0 {
-		// The returned message contains no info about the server IDs which failed
-		return fmt.Errorf("failed to delete some of the servers: %w", errors.Join(errs...))
+	if cleanupErr.Err != nil {
+		return cleanupErr
 	}
 
 	return nil
 }
 
-func (s *Client) cleanupTempSSHKeys(ctx context.Context, logger *slog.Logger, selector string) error {
-	keys, _, err := s.c.SSHKey.List(ctx, hcloud.SSHKeyListOpts{ListOpts: hcloud.ListOpts{
+func (s *Client) cleanupTempSSHKeys(ctx context.Context, logger *slog.Logger, selector string, opts CleanupOptions) error {
+	allKeys, _, err := s.c.SSHKey.List(ctx, hcloud.SSHKeyListOpts{ListOpts: hcloud.ListOpts{
 		LabelSelector: selector,
 	}})
 	if err != nil {
 		return fmt.Errorf("failed to list keys: %w", err)
 	}
 
+	now := time.Now()
+	keys := make([]*hcloud.SSHKey, 0, len(allKeys))
+	for _, key := range allKeys {
+		if !shouldCleanup(key.Labels, key.Created, opts, now) {
+			logger.InfoContext(ctx, "skipping ssh key", "ssh-key", key.ID, "run-id", key.Labels[RunIDLabel])
+			continue
+		}
+		keys = append(keys, key)
+	}
+
 	if len(keys) == 0 {
 		logger.InfoContext(ctx, "No ssh keys found")
 		return nil
 	}
 
-	errs := []error{}
+	if opts.DryRun {
+		for _, key := range keys {
+			logger.InfoContext(ctx, "Dry run: would delete ssh key", "ssh-key", key.ID, "name", key.Name)
+		}
+		return nil
+	}
+
+	cleanupErr := &CleanupError{}
 	for _, key := range keys {
 		_, err := s.c.SSHKey.Delete(ctx, key)
+		s.emitCleanup(ctx, StepDeleteSSHKey, key.Labels[RunIDLabel], Resources{SSHKeyID: key.ID}, err)
 		if err != nil {
-			errs = append(errs, err)
+			cleanupErr.addSSHKey(key.ID, err)
 			logger.WarnContext(ctx, "failed to delete ssh key", "ssh-key", key.ID, "error", err)
 			continue
 		}
 	}
 
-	if len(errs) > 0 {
-		// The returned message contains no info about the server IDs which failed
-		return fmt.Errorf("failed to delete some of the ssh keys: %w", errors.Join(errs...))
+	if cleanupErr.Err != nil {
+		return cleanupErr
 	}
 
 	return nil
 }
 
-func assembleCommand(options WriteOptions) (string, error) {
+// requiredTools returns the commands that the rescue system needs to write the image.
+func requiredTools(options WriteOptions) []string {
+	var tools []string
+	if options.ImageURL != nil {
+		tools = append(tools, "wget")
+	}
+
+	switch options.ImageCompression {
+	case CompressionBZ2:
+		tools = append(tools, "bzip2")
+	case CompressionXZ:
+		tools = append(tools, "xz")
+	case CompressionZSTD:
+		tools = append(tools, "zstd")
+	case CompressionGZIP:
+		tools = append(tools, "gzip")
+	case CompressionLZ4:
+		tools = append(tools, "lz4")
+	case CompressionZIP:
+		tools = append(tools, "unzip")
+	}
+
+	if options.ArchiveMember != "" && options.ImageCompression != CompressionZIP {
+		tools = append(tools, "tar")
+	}
+	if options.ImageFormat.qemuDriver() != "" {
+		tools = append(tools, "qemu-img")
+	}
+
+	return tools
+}
+
+// rescueEnvironment describes resources of the rescue system that are prepared by [Client.write].
+type rescueEnvironment struct {
+	// ScratchDevice is the block device of the scratch volume, if one is attached.
+	ScratchDevice string
+
+	// TargetDevice is the block device that the image is written to.
+	TargetDevice string
+}
+
+func assembleCommand(options WriteOptions, env rescueEnvironment) (string, error) {
 	// Make sure that we fail early, ie. if the image url does not work
 	cmd := "set -euo pipefail && "
 
+	if env.TargetDevice == "" {
+		return "", fmt.Errorf("no target device")
+	}
+
+	if env.ScratchDevice != "" {
+		// All files are relative, so they are staged on the volume instead of the rescue system root disk
+		cmd += fmt.Sprintf("mkdir -p %s && mount %s %s && cd %s && ", scratchMountpoint, env.ScratchDevice, scratchMountpoint, scratchMountpoint)
+	}
+
+	checksum := strings.ToLower(options.ImageChecksum)
+	if checksum != "" {
+		if !sha256Pattern.MatchString(checksum) {
+			return "", fmt.Errorf("invalid sha256 checksum: %q", options.ImageChecksum)
+		}
+
+		// The checksum is calculated in the background on a copy of the stream, this way we do not need to store the
+		// image anywhere. "wait" makes sure that the checksum is done before we compare it.
+		cmd += "mkfifo image.fifo && { sha256sum < image.fifo > image.sha256 & } && "
+	}
+
 	if options.ImageURL != nil {
 		cmd += fmt.Sprintf("wget --no-verbose -O - %q | ", options.ImageURL.String())
+	} else if decompress := decompressTransferCommand(options); decompress != "" {
+		// The checksum is calculated over the image, not the compressed stream
+		cmd += decompress + " | "
+	}
+
+	if checksum != "" {
+		cmd += "tee image.fifo | "
+	}
+
+	// Extracts the image from an archive that was stored in the rescue system first, runs after the checksum was
+	// verified.
+	extractCmd := ""
+
+	if options.ArchiveMember != "" && !archiveMemberPattern.MatchString(options.ArchiveMember) {
+		return "", fmt.Errorf("invalid archive member: %q", options.ArchiveMember)
 	}
 
 	if options.ImageCompression != CompressionNone {
@@ -608,23 +1259,72 @@ func assembleCommand(options WriteOptions) (string, error) {
 			cmd += "xz -cd | "
 		case CompressionZSTD:
 			cmd += "zstd -cd | "
+		case CompressionGZIP:
+			cmd += "gzip -cd | "
+		case CompressionLZ4:
+			cmd += "lz4 -cd | "
+		case CompressionZIP:
+			// zip archives have their index at the end, so they can not be extracted from a stream.
+			cmd += "tee image.zip > /dev/null"
+			if options.ArchiveMember != "" {
+				extractCmd = fmt.Sprintf(` && unzip -p image.zip "%s" | `, options.ArchiveMember)
+			} else {
+				// "unzip -p" would concatenate all files, so we make sure that the archive contains a single one,
+				// ignoring directories.
+				extractCmd = fmt.Sprintf(
+					` && if [ "$(unzip -Z1 image.zip | grep -cv "/$")" != "1" ]; then echo "%s" >&2; exit 1; fi && unzip -p image.zip | `,
+					zipEntriesMessage,
+				)
+			}
 		default:
 			return "", fmt.Errorf("unknown compression: %q", options.ImageCompression)
 		}
 	}
 
+	if options.ArchiveMember != "" && options.ImageCompression != CompressionZIP {
+		// tar archives can be extracted from a stream, only the selected member is written to stdout
+		cmd += fmt.Sprintf(`tar -xO -f - "%s" | `, options.ArchiveMember)
+	}
+
+	// Writes the uncompressed image to the disk.
+	writeCmd := ""
+	// Commands that run after the whole image was received, but before it is considered done.
+	postCmd := ""
+
 	switch options.ImageFormat {
 	case FormatRaw:
 		// With conv=sparse dd will skip any zero blocks and not write them to the disk, this makes it faster if you
 		// have a large raw image with multiple (nearly) empty but large partitions.
 		// For example Flatcar has ~12 GB, with ~90% being zero blocks.
-		cmd += "dd of=/dev/sda bs=4M conv=sparse"
-	case FormatQCOW2:
-		cmd += "tee image.qcow2 > /dev/null && qemu-img dd -f qcow2 -O raw if=image.qcow2 of=/dev/sda bs=4M"
+		writeCmd = fmt.Sprintf("dd of=%s bs=4M conv=sparse", env.TargetDevice)
+		if options.Progress != nil {
+			writeCmd += " status=progress"
+		}
+	case FormatQCOW2, FormatVMDK, FormatVHD, FormatVHDX, FormatVDI:
+		// qemu-img needs random access to the image, so it is stored in the rescue system first.
+		file := "image." + string(options.ImageFormat)
+		writeCmd = fmt.Sprintf("tee %s > /dev/null", file)
+		postCmd = fmt.Sprintf(" && qemu-img dd -f %s -O raw if=%s of=%s bs=4M", options.ImageFormat.qemuDriver(), file, env.TargetDevice)
 	default:
 		return "", fmt.Errorf("unknown format: %q", options.ImageFormat)
 	}
 
+	if extractCmd == "" {
+		cmd += writeCmd
+	}
+
+	if checksum != "" {
+		cmd += fmt.Sprintf(
+			` && wait $! && if [ "$(cut -d " " -f 1 image.sha256)" != "%s" ]; then echo "%s: expected %s, got $(cut -d " " -f 1 image.sha256)" >&2; exit 1; fi`,
+			checksum, checksumMismatchMessage, checksum,
+		)
+	}
+
+	if extractCmd != "" {
+		cmd += extractCmd + writeCmd
+	}
+
+	cmd += postCmd
 	cmd += " && sync"
 
 	// the pipefail does not work correctly without wrapping in bash.
@@ -1,8 +1,13 @@
 package hcloudimages
 
 import (
+	"context"
 	"net/url"
+	"slices"
 	"testing"
+	"time"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
 )
 
 func mustParseURL(s string) *url.URL {
@@ -18,6 +23,7 @@ func TestAssembleCommand(t *testing.T) {
 	tests := []struct {
 		name    string
 		options WriteOptions
+		env     rescueEnvironment
 		want    string
 		wantErr bool
 	}{
@@ -26,6 +32,12 @@ func TestAssembleCommand(t *testing.T) {
 			options: WriteOptions{},
 			want:    "bash -c 'set -euo pipefail && dd of=/dev/sda bs=4M conv=sparse && sync'",
 		},
+		{
+			name:    "nvme target device",
+			options: WriteOptions{ImageFormat: FormatQCOW2},
+			env:     rescueEnvironment{TargetDevice: "/dev/nvme0n1"},
+			want:    "bash -c 'set -euo pipefail && tee image.qcow2 > /dev/null && qemu-img dd -f qcow2 -O raw if=image.qcow2 of=/dev/nvme0n1 bs=4M && sync'",
+		},
 		{
 			name: "remote raw",
 			options: WriteOptions{
@@ -78,6 +90,70 @@ func TestAssembleCommand(t *testing.T) {
 			},
 			want: "bash -c 'set -euo pipefail && wget --no-verbose -O - \"https://example.com/image.bz2\" | bzip2 -cd | dd of=/dev/sda bs=4M conv=sparse && sync'",
 		},
+		{
+			name: "local gzip",
+			options: WriteOptions{
+				ImageCompression: CompressionGZIP,
+			},
+			want: "bash -c 'set -euo pipefail && gzip -cd | dd of=/dev/sda bs=4M conv=sparse && sync'",
+		},
+		{
+			name: "remote gzip",
+			options: WriteOptions{
+				ImageURL:         mustParseURL("https://example.com/image.gz"),
+				ImageCompression: CompressionGZIP,
+			},
+			want: "bash -c 'set -euo pipefail && wget --no-verbose -O - \"https://example.com/image.gz\" | gzip -cd | dd of=/dev/sda bs=4M conv=sparse && sync'",
+		},
+		{
+			name: "local lz4",
+			options: WriteOptions{
+				ImageCompression: CompressionLZ4,
+			},
+			want: "bash -c 'set -euo pipefail && lz4 -cd | dd of=/dev/sda bs=4M conv=sparse && sync'",
+		},
+		{
+			name: "local zip",
+			options: WriteOptions{
+				ImageCompression: CompressionZIP,
+			},
+			want: "bash -c 'set -euo pipefail && tee image.zip > /dev/null && if [ \"$(unzip -Z1 image.zip | grep -cv \"/$\")\" != \"1\" ]; then echo \"zip archive must contain exactly one file\" >&2; exit 1; fi && unzip -p image.zip | dd of=/dev/sda bs=4M conv=sparse && sync'",
+		},
+		{
+			name: "remote zip with qcow2 and checksum",
+			options: WriteOptions{
+				ImageURL:         mustParseURL("https://example.com/image.zip"),
+				ImageCompression: CompressionZIP,
+				ImageFormat:      FormatQCOW2,
+				ImageChecksum:    "4a5c0a1e6e3b2f9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d",
+			},
+			want: "bash -c 'set -euo pipefail && mkfifo image.fifo && { sha256sum < image.fifo > image.sha256 & } && wget --no-verbose -O - \"https://example.com/image.zip\" | tee image.fifo | tee image.zip > /dev/null && wait $! && if [ \"$(cut -d \" \" -f 1 image.sha256)\" != \"4a5c0a1e6e3b2f9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d\" ]; then echo \"image checksum mismatch: expected 4a5c0a1e6e3b2f9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d, got $(cut -d \" \" -f 1 image.sha256)\" >&2; exit 1; fi && if [ \"$(unzip -Z1 image.zip | grep -cv \"/$\")\" != \"1\" ]; then echo \"zip archive must contain exactly one file\" >&2; exit 1; fi && unzip -p image.zip | tee image.qcow2 > /dev/null && qemu-img dd -f qcow2 -O raw if=image.qcow2 of=/dev/sda bs=4M && sync'",
+		},
+		{
+			name: "remote tar.gz",
+			options: WriteOptions{
+				ImageURL:         mustParseURL("https://example.com/image.tar.gz"),
+				ImageCompression: CompressionGZIP,
+				ArchiveMember:    "disk.raw",
+			},
+			want: "bash -c 'set -euo pipefail && wget --no-verbose -O - \"https://example.com/image.tar.gz\" | gzip -cd | tar -xO -f - \"disk.raw\" | dd of=/dev/sda bs=4M conv=sparse && sync'",
+		},
+		{
+			name: "local tar with qcow2",
+			options: WriteOptions{
+				ImageFormat:   FormatQCOW2,
+				ArchiveMember: "output/image.qcow2",
+			},
+			want: "bash -c 'set -euo pipefail && tar -xO -f - \"output/image.qcow2\" | tee image.qcow2 > /dev/null && qemu-img dd -f qcow2 -O raw if=image.qcow2 of=/dev/sda bs=4M && sync'",
+		},
+		{
+			name: "local zip member",
+			options: WriteOptions{
+				ImageCompression: CompressionZIP,
+				ArchiveMember:    "disk.raw",
+			},
+			want: "bash -c 'set -euo pipefail && tee image.zip > /dev/null && unzip -p image.zip \"disk.raw\" | dd of=/dev/sda bs=4M conv=sparse && sync'",
+		},
 		{
 			name: "local qcow2",
 			options: WriteOptions{
@@ -93,6 +169,92 @@ func TestAssembleCommand(t *testing.T) {
 			},
 			want: "bash -c 'set -euo pipefail && wget --no-verbose -O - \"https://example.com/image.qcow2\" | tee image.qcow2 > /dev/null && qemu-img dd -f qcow2 -O raw if=image.qcow2 of=/dev/sda bs=4M && sync'",
 		},
+		{
+			name: "local vmdk",
+			options: WriteOptions{
+				ImageFormat: FormatVMDK,
+			},
+			want: "bash -c 'set -euo pipefail && tee image.vmdk > /dev/null && qemu-img dd -f vmdk -O raw if=image.vmdk of=/dev/sda bs=4M && sync'",
+		},
+		{
+			name: "remote vhd",
+			options: WriteOptions{
+				ImageURL:         mustParseURL("https://example.com/image.vhd.zst"),
+				ImageCompression: CompressionZSTD,
+				ImageFormat:      FormatVHD,
+			},
+			want: "bash -c 'set -euo pipefail && wget --no-verbose -O - \"https://example.com/image.vhd.zst\" | zstd -cd | tee image.vhd > /dev/null && qemu-img dd -f vpc -O raw if=image.vhd of=/dev/sda bs=4M && sync'",
+		},
+		{
+			name: "local vhdx",
+			options: WriteOptions{
+				ImageFormat: FormatVHDX,
+			},
+			want: "bash -c 'set -euo pipefail && tee image.vhdx > /dev/null && qemu-img dd -f vhdx -O raw if=image.vhdx of=/dev/sda bs=4M && sync'",
+		},
+		{
+			name: "local vdi",
+			options: WriteOptions{
+				ImageFormat: FormatVDI,
+			},
+			want: "bash -c 'set -euo pipefail && tee image.vdi > /dev/null && qemu-img dd -f vdi -O raw if=image.vdi of=/dev/sda bs=4M && sync'",
+		},
+		{
+			name: "local raw with progress",
+			options: WriteOptions{
+				Progress: func(Progress) {},
+			},
+			want: "bash -c 'set -euo pipefail && dd of=/dev/sda bs=4M conv=sparse status=progress && sync'",
+		},
+		{
+			name: "local raw with checksum",
+			options: WriteOptions{
+				ImageChecksum: "4A5C0A1E6E3B2F9D8C7B6A5F4E3D2C1B0A9F8E7D6C5B4A3F2E1D0C9B8A7F6E5D",
+			},
+			want: "bash -c 'set -euo pipefail && mkfifo image.fifo && { sha256sum < image.fifo > image.sha256 & } && tee image.fifo | dd of=/dev/sda bs=4M conv=sparse && wait $! && if [ \"$(cut -d \" \" -f 1 image.sha256)\" != \"4a5c0a1e6e3b2f9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d\" ]; then echo \"image checksum mismatch: expected 4a5c0a1e6e3b2f9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d, got $(cut -d \" \" -f 1 image.sha256)\" >&2; exit 1; fi && sync'",
+		},
+		{
+			name: "local raw with transfer compression",
+			options: WriteOptions{
+				TransferCompression: CompressionZSTD,
+				ImageChecksum:       "4a5c0a1e6e3b2f9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d",
+			},
+			want: "bash -c 'set -euo pipefail && mkfifo image.fifo && { sha256sum < image.fifo > image.sha256 & } && zstd -cd | tee image.fifo | dd of=/dev/sda bs=4M conv=sparse && wait $! && if [ \"$(cut -d \" \" -f 1 image.sha256)\" != \"4a5c0a1e6e3b2f9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d\" ]; then echo \"image checksum mismatch: expected 4a5c0a1e6e3b2f9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d, got $(cut -d \" \" -f 1 image.sha256)\" >&2; exit 1; fi && sync'",
+		},
+		{
+			name: "local xz with transfer compression",
+			options: WriteOptions{
+				ImageCompression:    CompressionXZ,
+				TransferCompression: CompressionZSTD,
+			},
+			want: "bash -c 'set -euo pipefail && xz -cd | dd of=/dev/sda bs=4M conv=sparse && sync'",
+		},
+		{
+			name: "remote raw with transfer compression",
+			options: WriteOptions{
+				ImageURL:            mustParseURL("https://example.com/image.raw"),
+				TransferCompression: CompressionZSTD,
+			},
+			want: "bash -c 'set -euo pipefail && wget --no-verbose -O - \"https://example.com/image.raw\" | dd of=/dev/sda bs=4M conv=sparse && sync'",
+		},
+		{
+			name: "remote qcow2 with checksum",
+			options: WriteOptions{
+				ImageURL:         mustParseURL("https://example.com/image.qcow2.xz"),
+				ImageFormat:      FormatQCOW2,
+				ImageCompression: CompressionXZ,
+				ImageChecksum:    "4a5c0a1e6e3b2f9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d",
+			},
+			want: "bash -c 'set -euo pipefail && mkfifo image.fifo && { sha256sum < image.fifo > image.sha256 & } && wget --no-verbose -O - \"https://example.com/image.qcow2.xz\" | tee image.fifo | xz -cd | tee image.qcow2 > /dev/null && wait $! && if [ \"$(cut -d \" \" -f 1 image.sha256)\" != \"4a5c0a1e6e3b2f9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d\" ]; then echo \"image checksum mismatch: expected 4a5c0a1e6e3b2f9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d, got $(cut -d \" \" -f 1 image.sha256)\" >&2; exit 1; fi && qemu-img dd -f qcow2 -O raw if=image.qcow2 of=/dev/sda bs=4M && sync'",
+		},
+		{
+			name: "qcow2 on scratch volume",
+			options: WriteOptions{
+				ImageFormat: FormatQCOW2,
+			},
+			env:  rescueEnvironment{ScratchDevice: "/dev/disk/by-id/scsi-0HC_Volume_123"},
+			want: "bash -c 'set -euo pipefail && mkdir -p /mnt/scratch && mount /dev/disk/by-id/scsi-0HC_Volume_123 /mnt/scratch && cd /mnt/scratch && tee image.qcow2 > /dev/null && qemu-img dd -f qcow2 -O raw if=image.qcow2 of=/dev/sda bs=4M && sync'",
+		},
 
 		{
 			name: "unknown compression",
@@ -109,10 +271,29 @@ func TestAssembleCommand(t *testing.T) {
 			},
 			wantErr: true,
 		},
+
+		{
+			name: "invalid archive member",
+			options: WriteOptions{
+				ArchiveMember: "disk.raw\"; rm -rf /",
+			},
+			wantErr: true,
+		},
+
+		{
+			name: "invalid checksum",
+			options: WriteOptions{
+				ImageChecksum: "abc'; rm -rf /",
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := assembleCommand(tt.options)
+			if tt.env.TargetDevice == "" {
+				tt.env.TargetDevice = "/dev/sda"
+			}
+			got, err := assembleCommand(tt.options, tt.env)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("assembleCommand() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -123,3 +304,70 @@ func TestAssembleCommand(t *testing.T) {
 		})
 	}
 }
+
+func TestRequiredTools(t *testing.T) {
+	tests := []struct {
+		name    string
+		options WriteOptions
+		want    []string
+	}{
+		{
+			name:    "raw stream",
+			options: WriteOptions{},
+			want:    nil,
+		},
+		{
+			name:    "url",
+			options: WriteOptions{ImageURL: mustParseURL("https://example.com/image.raw")},
+			want:    []string{"wget"},
+		},
+		{
+			name:    "xz qcow2",
+			options: WriteOptions{ImageCompression: CompressionXZ, ImageFormat: FormatQCOW2},
+			want:    []string{"xz", "qemu-img"},
+		},
+		{
+			name:    "tar.gz member",
+			options: WriteOptions{ImageURL: mustParseURL("https://example.com/image.tar.gz"), ImageCompression: CompressionGZIP, ArchiveMember: "disk.raw"},
+			want:    []string{"wget", "gzip", "tar"},
+		},
+		{
+			name:    "zip member",
+			options: WriteOptions{ImageCompression: CompressionZIP, ArchiveMember: "disk.vhd", ImageFormat: FormatVHD},
+			want:    []string{"unzip", "qemu-img"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requiredTools(tt.options); !slices.Equal(got, tt.want) {
+				t.Errorf("requiredTools() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanupContext(t *testing.T) {
+	logger := contextlogger.From(context.Background()).With("run-id", "abcd1234")
+	parent, cancel := context.WithCancel(contextlogger.New(context.Background(), logger))
+
+	// Cleanup runs after Ctrl-C cancelled the context of the run
+	cancel()
+	ctx, cancelCleanup := cleanupContext(parent)
+	defer cancelCleanup()
+
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("cleanup context is done after the parent was cancelled: %v", err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > cleanupTimeout || time.Until(deadline) < cleanupTimeout-time.Minute {
+		t.Errorf("cleanup context has deadline %v, want one in %s", deadline, cleanupTimeout)
+	}
+	if contextlogger.From(ctx) != logger {
+		t.Errorf("cleanup context lost the logger of the run")
+	}
+
+	cancelCleanup()
+	if ctx.Err() == nil {
+		t.Errorf("cleanup context is not done after it was cancelled")
+	}
+}
@@ -0,0 +1,478 @@
+package hcloudimages
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/qcow2"
+)
+
+// convertOnClient reports whether the image is converted to a raw image on the client, instead of in the rescue
+// system. qemu-img in the rescue system needs the whole image in the memory-backed root disk or the scratch volume, so
+// images that are larger than limit, or of unknown size, are converted on the client. A limit of 0 means that it is
+// not known yet. This is only supported for uncompressed qcow2 images that are not inside an archive.
+func convertOnClient(options WriteOptions, limit int64) bool {
+	return options.ImageFormat == FormatQCOW2 &&
+		options.ImageCompression == CompressionNone &&
+		options.ArchiveMember == "" &&
+		(options.ImageSize <= 0 || (limit > 0 && options.ImageSize > limit))
+}
+
+// supportedOnClient reports whether [processOnClient] supports the image.
+func supportedOnClient(options WriteOptions) bool {
+	return options.ImageCompression != CompressionLZ4 &&
+		(options.ImageFormat == FormatRaw || options.ImageFormat == FormatQCOW2)
+}
+
+// convertedOptions returns the options for the rescue system after the image was processed on the client. The image
+// is sent as a raw image through [WriteOptions.ImageReader] and the checksum is verified on the client.
+func convertedOptions(options WriteOptions, image io.Reader, size int64) WriteOptions {
+	options.ImageURL = nil
+	options.ImageReader = image
+	options.ImageCompression = CompressionNone
+	options.ImageFormat = FormatRaw
+	options.ArchiveMember = ""
+	options.ImageSize = size
+	options.ImageChecksum = ""
+	return options
+}
+
+// prepareImage processes the image on the client if [WriteOptions.Processing] or, for [ProcessingAuto],
+// [convertOnClient] say so, otherwise it returns the options unchanged. The returned function removes temporary files
+// and must always be called.
+func prepareImage(ctx context.Context, options WriteOptions) (WriteOptions, func(), error) {
+	if err := validateTransferCompression(options.TransferCompression); err != nil {
+		return options, func() {}, err
+	}
+
+	switch options.Processing {
+	case ProcessingAuto:
+		if !convertOnClient(options, stagingLimit(options, nil)) {
+			return options, func() {}, nil
+		}
+	case ProcessingRescue:
+		// Images that do not fit on the rescue system fail there with [ErrNoSpaceLeft]
+		return options, func() {}, nil
+	case ProcessingClient:
+	default:
+		return options, func() {}, fmt.Errorf("unknown processing: %q", options.Processing)
+	}
+
+	return processOnClient(ctx, options)
+}
+
+// processOnClient decompresses, extracts and converts the image on the client, so only a raw image is sent to the
+// rescue system. The image is streamed whenever possible, zip archives and qcow2 images need random access and are
+// downloaded to a temporary file first. The returned function closes the image and removes temporary files, it must
+// always be called.
+//
+// If the image is streamed, the checksum can only be verified once the image was read completely. Reading the last
+// bytes of the image then returns [ErrChecksumMismatch] instead of [io.EOF].
+func processOnClient(ctx context.Context, options WriteOptions) (WriteOptions, func(), error) {
+	logger := contextlogger.From(ctx)
+
+	var closers []func()
+	cleanup := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+
+	checksum, err := newChecksumVerifier(options.ImageChecksum)
+	if err != nil {
+		return options, cleanup, err
+	}
+
+	logger.InfoContext(ctx, "Processing image on the client",
+		"compression", describeCompression(options.ImageCompression),
+		"format", describeFormat(options.ImageFormat),
+	)
+
+	// Local files that need random access are used directly, instead of copying them to a temporary file
+	if readerAt, size, ok := randomAccess(options); ok {
+		if checksum != nil {
+			logger.InfoContext(ctx, "Verifying image checksum")
+			if _, err := io.Copy(checksum.hash, io.NewSectionReader(readerAt, 0, size)); err != nil {
+				return options, cleanup, fmt.Errorf("failed to read the image: %w", err)
+			}
+			if err := checksum.verify(); err != nil {
+				return options, cleanup, err
+			}
+		}
+
+		image, size, err := openRandomAccess(readerAt, size, options)
+		if err != nil {
+			return options, cleanup, err
+		}
+		return convertedOptions(options, image, size), cleanup, nil
+	}
+
+	source, err := openImage(ctx, options)
+	if err != nil {
+		return options, cleanup, err
+	}
+	closers = append(closers, func() { _ = source.Close() })
+
+	// raw is the image file as it was referenced, it is hashed while it is read
+	var raw io.Reader = source
+	if checksum != nil {
+		raw = io.TeeReader(source, checksum.hash)
+	}
+
+	stream := decompressedOrRaw(raw, options, &closers)
+	if stream == nil {
+		return options, cleanup, fmt.Errorf("%s compression is not supported for processing on the client", options.ImageCompression)
+	}
+	stream = &typedReader{r: stream, err: ErrInvalidImage}
+
+	if options.ArchiveMember != "" && options.ImageCompression != CompressionZIP {
+		stream, err = tarMember(stream, options.ArchiveMember)
+		if err != nil {
+			return options, cleanup, err
+		}
+	}
+
+	if needsRandomAccess(options) {
+		logger.InfoContext(ctx, "Downloading image to a temporary file, to process it on the client")
+		file, size, remove, err := spoolToFile(stream)
+		closers = append(closers, remove)
+		if err != nil {
+			return options, cleanup, err
+		}
+		if checksum != nil {
+			// The decompression might stop before the end of the file
+			if _, err := io.Copy(io.Discard, raw); err != nil {
+				return options, cleanup, fmt.Errorf("%w: %w", ErrImageDownload, err)
+			}
+			if err := checksum.verify(); err != nil {
+				return options, cleanup, err
+			}
+		}
+
+		if options.ImageCompression != CompressionZIP {
+			// The file holds the decompressed image
+			options.ImageCompression = CompressionNone
+			options.ArchiveMember = ""
+		}
+		image, size, err := openRandomAccess(file, size, options)
+		if err != nil {
+			return options, cleanup, err
+		}
+		return convertedOptions(options, image, size), cleanup, nil
+	}
+
+	if checksum != nil {
+		stream = &verifyingReader{r: stream, raw: raw, checksum: checksum}
+	}
+
+	// The size of a raw image only stays the same if nothing is decompressed or extracted
+	size := int64(0)
+	if options.ImageCompression == CompressionNone && options.ArchiveMember == "" {
+		size = options.ImageSize
+	}
+
+	return convertedOptions(options, stream, size), cleanup, nil
+}
+
+// needsRandomAccess reports whether the image has to be stored in a file to process it on the client.
+func needsRandomAccess(options WriteOptions) bool {
+	return options.ImageCompression == CompressionZIP || options.ImageFormat == FormatQCOW2
+}
+
+// randomAccess returns the image if it can be read without copying it to a temporary file first.
+func randomAccess(options WriteOptions) (io.ReaderAt, int64, bool) {
+	if options.ImageURL != nil || !needsRandomAccess(options) {
+		return nil, 0, false
+	}
+	// Compressed images and archive members need to be extracted first
+	if options.ImageCompression != CompressionNone && options.ImageCompression != CompressionZIP {
+		return nil, 0, false
+	}
+	if options.ImageCompression == CompressionNone && options.ArchiveMember != "" {
+		return nil, 0, false
+	}
+
+	readerAt, ok := options.ImageReader.(io.ReaderAt)
+	if !ok {
+		return nil, 0, false
+	}
+
+	switch r := options.ImageReader.(type) {
+	case interface{ Size() int64 }:
+		return readerAt, r.Size(), true
+	case interface{ Stat() (os.FileInfo, error) }:
+		info, err := r.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return nil, 0, false
+		}
+		return readerAt, info.Size(), true
+	default:
+		if options.ImageFormat == FormatQCOW2 && options.ImageCompression == CompressionNone {
+			// qcow2 images know their own size
+			return readerAt, math.MaxInt64, true
+		}
+		return nil, 0, false
+	}
+}
+
+// openRandomAccess extracts the image from a zip archive and converts qcow2 images. It returns the raw image and its
+// size.
+func openRandomAccess(file io.ReaderAt, size int64, options WriteOptions) (io.Reader, int64, error) {
+	if options.ImageCompression == CompressionZIP {
+		archive, err := zip.NewReader(file, size)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %w", ErrInvalidImage, err)
+		}
+		entry, err := zipMember(archive, options.ArchiveMember)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if options.ImageFormat != FormatQCOW2 {
+			r, err := entry.Open()
+			if err != nil {
+				return nil, 0, fmt.Errorf("%w: %w", ErrInvalidImage, err)
+			}
+			return &typedReader{r: r, err: ErrInvalidImage}, int64(entry.UncompressedSize64), nil
+		}
+
+		// qcow2 images need random access, only stored zip entries support it directly
+		offset, err := entry.DataOffset()
+		if err != nil || entry.Method != zip.Store {
+			return nil, 0, fmt.Errorf("qcow2 images in a zip archive must be stored without compression for processing on the client")
+		}
+		file, size = io.NewSectionReader(file, offset, int64(entry.UncompressedSize64)), int64(entry.UncompressedSize64)
+	}
+
+	switch options.ImageFormat {
+	case FormatRaw:
+		return io.NewSectionReader(file, 0, size), size, nil
+	case FormatQCOW2:
+		image, err := qcow2.Open(file)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %w", ErrInvalidImage, err)
+		}
+		return io.NewSectionReader(image, 0, image.Size()), image.Size(), nil
+	default:
+		return nil, 0, fmt.Errorf("%s images are not supported for processing on the client", options.ImageFormat)
+	}
+}
+
+// decompressedOrRaw returns the decompressed image, or raw for uncompressed images and zip archives. It returns nil
+// if the compression is not supported. Decoders that need to be closed are added to closers.
+func decompressedOrRaw(raw io.Reader, options WriteOptions, closers *[]func()) io.Reader {
+	switch options.ImageCompression {
+	case CompressionNone, CompressionZIP:
+		return raw
+	case CompressionBZ2:
+		return bzip2.NewReader(raw)
+	case CompressionGZIP:
+		return &lazyReader{open: func() (io.Reader, error) { return gzip.NewReader(raw) }}
+	case CompressionXZ:
+		return &lazyReader{open: func() (io.Reader, error) { return xz.NewReader(raw) }}
+	case CompressionZSTD:
+		decoder, err := zstd.NewReader(raw)
+		if err != nil {
+			return &lazyReader{open: func() (io.Reader, error) { return nil, err }}
+		}
+		*closers = append(*closers, decoder.Close)
+		return decoder
+	default:
+		return nil
+	}
+}
+
+// tarMember returns a reader for member in the tar archive.
+func tarMember(r io.Reader, member string) (io.Reader, error) {
+	archive := tar.NewReader(r)
+	for {
+		hdr, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: %s: Not found in archive", ErrInvalidImage, member)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidImage, err)
+		}
+		if hdr.Name == member {
+			return &typedReader{r: archive, err: ErrInvalidImage}, nil
+		}
+	}
+}
+
+// zipMember returns member, or the only file in the archive if member is empty.
+func zipMember(archive *zip.Reader, member string) (*zip.File, error) {
+	var files []*zip.File
+	for _, file := range archive.File {
+		if member != "" && file.Name == member {
+			return file, nil
+		}
+		if !file.FileInfo().IsDir() {
+			files = append(files, file)
+		}
+	}
+
+	if member != "" {
+		return nil, fmt.Errorf("%w: %s: filename not matched", ErrInvalidImage, member)
+	}
+	if len(files) != 1 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidImage, zipEntriesMessage)
+	}
+	return files[0], nil
+}
+
+// spoolToFile copies r to a temporary file. The returned function removes the file, it is also returned on error.
+func spoolToFile(r io.Reader) (*os.File, int64, func(), error) {
+	file, err := os.CreateTemp("", "hcloud-upload-image-*")
+	if err != nil {
+		return nil, 0, func() {}, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	remove := func() {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}
+
+	size, err := io.Copy(file, r)
+	if err != nil {
+		return nil, 0, remove, err
+	}
+
+	return file, size, remove, nil
+}
+
+// openImage opens [WriteOptions.ImageURL] or returns [WriteOptions.ImageReader].
+func openImage(ctx context.Context, options WriteOptions) (io.ReadCloser, error) {
+	if options.ImageURL == nil {
+		return io.NopCloser(options.ImageReader), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, options.ImageURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrImageDownload, err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrImageDownload, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrImageNotFound, resp.Status)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrImageForbidden, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrImageDownload, resp.Status)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{&typedReader{r: resp.Body, err: ErrImageDownload}, resp.Body}, nil
+}
+
+// checksumVerifier compares the hash of the image with [WriteOptions.ImageChecksum].
+type checksumVerifier struct {
+	hash     hash.Hash
+	expected string
+}
+
+// newChecksumVerifier returns the verifier for [WriteOptions.ImageChecksum], or nil if it is not set.
+func newChecksumVerifier(checksum string) (*checksumVerifier, error) {
+	if checksum == "" {
+		return nil, nil
+	}
+	expected := strings.ToLower(checksum)
+	if !sha256Pattern.MatchString(expected) {
+		return nil, fmt.Errorf("invalid sha256 checksum: %q", checksum)
+	}
+	return &checksumVerifier{hash: sha256.New(), expected: expected}, nil
+}
+
+func (c *checksumVerifier) verify() error {
+	if actual := hex.EncodeToString(c.hash.Sum(nil)); actual != c.expected {
+		return fmt.Errorf("%w: %s: expected %s, got %s", ErrChecksumMismatch, checksumMismatchMessage, c.expected, actual)
+	}
+	return nil
+}
+
+// verifyingReader reads the processed image from r. At the end, it reads the rest of the raw image file and verifies
+// its checksum, so the write fails if it does not match.
+type verifyingReader struct {
+	r        io.Reader
+	raw      io.Reader
+	checksum *checksumVerifier
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if !errors.Is(err, io.EOF) {
+		return n, err
+	}
+
+	// The decompression might stop before the end of the file
+	if _, err := io.Copy(io.Discard, v.raw); err != nil {
+		return n, fmt.Errorf("%w: %w", ErrImageDownload, err)
+	}
+	if err := v.checksum.verify(); err != nil {
+		return n, err
+	}
+	return n, io.EOF
+}
+
+// typedReader wraps read errors in err, unless they already are one of our errors. This way the errors of the
+// processing on the client can be told apart like those of the rescue system.
+type typedReader struct {
+	r   io.Reader
+	err error
+}
+
+func (t *typedReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) && !isImageError(err) {
+		err = fmt.Errorf("%w: %w", t.err, err)
+	}
+	return n, err
+}
+
+// isImageError reports whether err is already one of the errors about the image.
+func isImageError(err error) bool {
+	return errors.Is(err, ErrImageDownload) || errors.Is(err, ErrInvalidImage) || errors.Is(err, ErrChecksumMismatch)
+}
+
+// lazyReader opens the reader on the first read. Decoders that read a header on creation would otherwise start
+// reading the image before it is written.
+type lazyReader struct {
+	open func() (io.Reader, error)
+	r    io.Reader
+	err  error
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.r == nil && l.err == nil {
+		l.r, l.err = l.open()
+	}
+	if l.err != nil {
+		return 0, l.err
+	}
+	return l.r.Read(p)
+}
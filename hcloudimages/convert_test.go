@@ -0,0 +1,249 @@
+package hcloudimages
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestConvertOnClient(t *testing.T) {
+	const rootDiskLimit = 960 * 1024 * 1024
+
+	tests := []struct {
+		name    string
+		options WriteOptions
+		limit   int64
+		want    bool
+	}{
+		{
+			name:    "raw",
+			options: WriteOptions{ImageSize: 10 * 1024 * 1024 * 1024},
+			limit:   rootDiskLimit,
+			want:    false,
+		},
+		{
+			name:    "small qcow2",
+			options: WriteOptions{ImageFormat: FormatQCOW2, ImageSize: 500 * 1024 * 1024},
+			limit:   rootDiskLimit,
+			want:    false,
+		},
+		{
+			name:    "large qcow2",
+			options: WriteOptions{ImageFormat: FormatQCOW2, ImageSize: 2 * 1024 * 1024 * 1024},
+			limit:   rootDiskLimit,
+			want:    true,
+		},
+		{
+			name:    "large qcow2 before the rescue system was probed",
+			options: WriteOptions{ImageFormat: FormatQCOW2, ImageSize: 2 * 1024 * 1024 * 1024},
+			want:    false,
+		},
+		{
+			name:    "large qcow2 on scratch volume",
+			options: WriteOptions{ImageFormat: FormatQCOW2, ImageSize: 2 * 1024 * 1024 * 1024, ScratchVolumeSize: 10},
+			limit:   10 * 1024 * 1024 * 1024,
+			want:    false,
+		},
+		{
+			name:    "qcow2 of unknown size",
+			options: WriteOptions{ImageFormat: FormatQCOW2},
+			want:    true,
+		},
+		{
+			name:    "compressed qcow2",
+			options: WriteOptions{ImageFormat: FormatQCOW2, ImageCompression: CompressionXZ},
+			limit:   rootDiskLimit,
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := convertOnClient(tt.options, tt.limit); got != tt.want {
+				t.Errorf("convertOnClient() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareImage(t *testing.T) {
+	notQCOW2 := bytes.Repeat([]byte{0}, 1024)
+
+	tests := []struct {
+		name    string
+		options WriteOptions
+		wantErr error
+	}{
+		{
+			name:    "random access",
+			options: WriteOptions{ImageFormat: FormatQCOW2, ImageReader: bytes.NewReader(notQCOW2)},
+			wantErr: ErrInvalidImage,
+		},
+		{
+			name:    "stream",
+			options: WriteOptions{ImageFormat: FormatQCOW2, ImageReader: io.MultiReader(bytes.NewReader(notQCOW2))},
+			wantErr: ErrInvalidImage,
+		},
+		{
+			name: "checksum mismatch",
+			options: WriteOptions{
+				ImageFormat:   FormatQCOW2,
+				ImageReader:   io.MultiReader(bytes.NewReader(notQCOW2)),
+				ImageChecksum: "4a5c0a1e6e3b2f9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d",
+			},
+			wantErr: ErrChecksumMismatch,
+		},
+		{
+			// The size is unknown, but the image must not be converted on the client, so it is not read at all
+			name:    "rescue processing",
+			options: WriteOptions{ImageFormat: FormatQCOW2, ImageReader: io.MultiReader(bytes.NewReader(notQCOW2)), Processing: ProcessingRescue},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, cleanup, err := prepareImage(context.Background(), tt.options)
+			cleanup()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("prepareImage() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && options.ImageFormat != tt.options.ImageFormat {
+				t.Errorf("prepareImage() converted the image to %q", options.ImageFormat)
+			}
+		})
+	}
+}
+
+func TestProcessOnClient(t *testing.T) {
+	image := bytes.Repeat([]byte("hcloud-upload-image"), 1024)
+	imageChecksum := "0000000000000000000000000000000000000000000000000000000000000000"
+
+	compress := func(t *testing.T, newWriter func(io.Writer) (io.WriteCloser, error)) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		w, err := newWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(image); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	gzipImage := compress(t, func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil })
+	xzImage := compress(t, func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) })
+	zstdImage := compress(t, func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) })
+	zipImage := compress(t, func(w io.Writer) (io.WriteCloser, error) {
+		archive := zip.NewWriter(w)
+		f, err := archive.Create("disk.raw")
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Writer
+			io.Closer
+		}{f, archive}, nil
+	})
+	tarImage := compress(t, func(w io.Writer) (io.WriteCloser, error) {
+		gz := gzip.NewWriter(w)
+		archive := tar.NewWriter(gz)
+		if err := archive.WriteHeader(&tar.Header{Name: "disk.raw", Mode: 0o644, Size: int64(len(image))}); err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Writer
+			io.Closer
+		}{archive, closerFunc(func() error { return errors.Join(archive.Close(), gz.Close()) })}, nil
+	})
+
+	sum := sha256.Sum256(gzipImage)
+	gzipChecksum := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		options WriteOptions
+		wantErr error
+	}{
+		{
+			name:    "raw",
+			options: WriteOptions{ImageReader: bytes.NewReader(image)},
+		},
+		{
+			name:    "gzip stream",
+			options: WriteOptions{ImageReader: io.MultiReader(bytes.NewReader(gzipImage)), ImageCompression: CompressionGZIP, ImageChecksum: gzipChecksum},
+		},
+		{
+			name:    "xz",
+			options: WriteOptions{ImageReader: bytes.NewReader(xzImage), ImageCompression: CompressionXZ},
+		},
+		{
+			name:    "zstd",
+			options: WriteOptions{ImageReader: bytes.NewReader(zstdImage), ImageCompression: CompressionZSTD},
+		},
+		{
+			name:    "zip",
+			options: WriteOptions{ImageReader: bytes.NewReader(zipImage), ImageCompression: CompressionZIP},
+		},
+		{
+			name:    "zip stream",
+			options: WriteOptions{ImageReader: io.MultiReader(bytes.NewReader(zipImage)), ImageCompression: CompressionZIP, ArchiveMember: "disk.raw"},
+		},
+		{
+			name:    "tar member",
+			options: WriteOptions{ImageReader: bytes.NewReader(tarImage), ImageCompression: CompressionGZIP, ArchiveMember: "disk.raw"},
+		},
+		{
+			name:    "missing tar member",
+			options: WriteOptions{ImageReader: bytes.NewReader(tarImage), ImageCompression: CompressionGZIP, ArchiveMember: "other.raw"},
+			wantErr: ErrInvalidImage,
+		},
+		{
+			name:    "corrupt gzip",
+			options: WriteOptions{ImageReader: bytes.NewReader(gzipImage[:len(gzipImage)/2]), ImageCompression: CompressionGZIP},
+			wantErr: ErrInvalidImage,
+		},
+		{
+			name:    "checksum mismatch",
+			options: WriteOptions{ImageReader: bytes.NewReader(gzipImage), ImageCompression: CompressionGZIP, ImageChecksum: imageChecksum},
+			wantErr: ErrChecksumMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.options.Processing = ProcessingClient
+			got, cleanup, err := prepareImage(context.Background(), tt.options)
+			defer cleanup()
+
+			// Streamed images only fail once they are read
+			var data []byte
+			if err == nil {
+				if got.ImageCompression != CompressionNone || got.ImageFormat != FormatRaw || got.ArchiveMember != "" || got.ImageChecksum != "" {
+					t.Errorf("prepareImage() = %+v, want a raw image", got)
+				}
+				data, err = io.ReadAll(got.ImageReader)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("prepareImage() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(data, image) {
+				t.Errorf("prepareImage() returned %d bytes that do not match the image", len(data))
+			}
+		})
+	}
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
@@ -0,0 +1,183 @@
+package hcloudimages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/labelutil"
+)
+
+// errUploadStopped is returned to the export if the upload stopped reading the image.
+var errUploadStopped = errors.New("upload stopped reading the image")
+
+// CopyImageOptions are the options for [Client.CopyImage].
+type CopyImageOptions struct {
+	// Image is the snapshot or backup in the project of the [Client] that is copied.
+	Image *hcloud.Image
+
+	// Destination is the client for the project that the image is copied to.
+	Destination *Client
+
+	// Description of the new snapshot. Defaults to the description of Image.
+	Description *string
+
+	// Labels are added to the labels of Image for the new snapshot. The [CreatedByLabel] is always added.
+	Labels map[string]string
+
+	// SourceServerType and SourceLocation select the temporary server in the source project, like
+	// [ExportOptions.ServerType] and [ExportOptions.Location].
+	SourceServerType *hcloud.ServerType
+	SourceLocation   *hcloud.Location
+
+	// ServerType and Location select the temporary server in the destination project, like
+	// [UploadOptions.ServerType] and [UploadOptions.Location]. The architecture is always the one of Image.
+	ServerType *hcloud.ServerType
+	Location   *hcloud.Location
+
+	// Progress is optionally called every second while the image is copied, see [ExportOptions.Progress].
+	Progress func(Progress)
+
+	// DryRun logs the [Plan] of the export and the upload, without creating any resources.
+	DryRun bool
+
+	// DebugSkipResourceCleanup will skip the cleanup of the temporary SSH Keys and Servers in both projects.
+	DebugSkipResourceCleanup bool
+}
+
+// CopyImage copies a snapshot or backup from the project of the client to the project of
+// [CopyImageOptions.Destination], as a new snapshot with the same description and labels.
+//
+// The image is exported like with [Client.Export], and the stream is directly written to the disk of the temporary
+// server of [Client.Upload] in the destination project. Nothing is stored on the client. The temporary resources in
+// both projects are deleted once the copy is done, or failed.
+//
+// If [CopyImageOptions.DryRun] is set, no image is created and the returned image is nil.
+func (s *Client) CopyImage(ctx context.Context, options CopyImageOptions) (*hcloud.Image, error) {
+	if options.Image == nil {
+		return nil, fmt.Errorf("image must be set")
+	}
+	if options.Destination == nil {
+		return nil, fmt.Errorf("destination must be set")
+	}
+
+	image, _, err := s.c.Image.GetByID(ctx, options.Image.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image %d: %w", options.Image.ID, err)
+	}
+	if image == nil {
+		return nil, fmt.Errorf("image %d not found", options.Image.ID)
+	}
+
+	description := options.Description
+	if description == nil {
+		description = hcloud.Ptr(image.Description)
+	}
+
+	logger := contextlogger.From(ctx)
+	sourceCtx := contextlogger.New(ctx, logger.With("project", "source"))
+	destinationCtx := contextlogger.New(ctx, logger.With("project", "destination"))
+
+	exportOptions := ExportOptions{
+		Image:                    image,
+		Format:                   FormatRaw,
+		Progress:                 options.Progress,
+		ServerType:               options.SourceServerType,
+		Location:                 options.SourceLocation,
+		DryRun:                   options.DryRun,
+		DebugSkipResourceCleanup: options.DebugSkipResourceCleanup,
+	}
+	uploadOptions := UploadOptions{
+		WriteOptions: WriteOptions{
+			ImageCompression: CompressionNone,
+			ImageFormat:      FormatRaw,
+			DryRun:           options.DryRun,
+		},
+		Architecture:             image.Architecture,
+		ServerType:               options.ServerType,
+		Description:              description,
+		Labels:                   labelutil.Merge(image.Labels, options.Labels),
+		Location:                 options.Location,
+		DebugSkipResourceCleanup: options.DebugSkipResourceCleanup,
+	}
+
+	if options.DryRun {
+		if err := s.Export(sourceCtx, exportOptions); err != nil {
+			return nil, fmt.Errorf("source project: %w", err)
+		}
+		if _, err := options.Destination.UploadWithResult(destinationCtx, uploadOptions); err != nil {
+			return nil, fmt.Errorf("destination project: %w", err)
+		}
+		return nil, nil
+	}
+
+	result, err := copyStream(sourceCtx,
+		func(ctx context.Context, w io.Writer) error {
+			exportOptions.Output = w
+			return s.Export(ctx, exportOptions)
+		},
+		func(r io.Reader) (*UploadResult, error) {
+			uploadOptions.ImageReader = r
+			return options.Destination.UploadWithResult(destinationCtx, uploadOptions)
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Image, nil
+}
+
+// copyStream runs export and upload at the same time, connected by a pipe. If the export fails, the upload reads its
+// error from the pipe. If the upload stops early, the export is cancelled, and only a [CleanupError] of the export is
+// reported. The errors of both sides are joined.
+func copyStream(ctx context.Context, export func(ctx context.Context, w io.Writer) error, upload func(r io.Reader) (*UploadResult, error)) (*UploadResult, error) {
+	// The export is stopped if the upload fails, e.g. because no server could be created in the destination project
+	exportCtx, cancelExport := context.WithCancel(ctx)
+	defer cancelExport()
+
+	pr, pw := io.Pipe()
+
+	exported := make(chan error, 1)
+	go func() {
+		err := export(exportCtx, pw)
+		// The result is sent first, so it is available once the upload sees the end of the stream
+		exported <- err
+		_ = pw.CloseWithError(err)
+	}()
+
+	result, uploadErr := upload(pr)
+	_ = pr.CloseWithError(errUploadStopped)
+
+	var exportErr error
+	select {
+	case exportErr = <-exported:
+	default:
+		// The upload failed on its own, the export only needs to clean up
+		cancelExport()
+		exportErr = <-exported
+
+		var cleanupErr *CleanupError
+		if !errors.As(exportErr, &cleanupErr) {
+			exportErr = nil
+		} else {
+			exportErr = cleanupErr
+		}
+	}
+
+	if exportErr != nil {
+		exportErr = fmt.Errorf("source project: %w", exportErr)
+	}
+	if uploadErr != nil {
+		uploadErr = fmt.Errorf("destination project: %w", uploadErr)
+	}
+	if err := errors.Join(exportErr, uploadErr); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,161 @@
+package hcloudimages
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+func TestCopyImageOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options CopyImageOptions
+	}{
+		{name: "no image", options: CopyImageOptions{Destination: &Client{}}},
+		{name: "no destination", options: CopyImageOptions{Image: &hcloud.Image{ID: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The options are validated before the API is used
+			image, err := (&Client{}).CopyImage(context.Background(), tt.options)
+			if err == nil || image != nil {
+				t.Errorf("CopyImage() = %v, %v, want an error", image, err)
+			}
+		})
+	}
+}
+
+func TestCopyStream(t *testing.T) {
+	exportErr := errors.New("disk could not be read")
+	uploadErr := errors.New("server could not be created")
+	leaked := &CleanupError{ServerIDs: []int64{42}}
+
+	// uploadAll reads the whole image, like an upload that writes it to the disk
+	uploadAll := func(got *[]byte) func(r io.Reader) (*UploadResult, error) {
+		return func(r io.Reader) (*UploadResult, error) {
+			data, err := io.ReadAll(r)
+			*got = data
+			if err != nil {
+				return nil, err
+			}
+			return &UploadResult{Image: &hcloud.Image{ID: 7}}, nil
+		}
+	}
+
+	tests := []struct {
+		name   string
+		export func(ctx context.Context, w io.Writer) error
+		// upload returns the function that is called with the reader of the pipe, it may record what it read in data
+		upload func(data *[]byte) func(r io.Reader) (*UploadResult, error)
+
+		wantData    string
+		wantImage   int64
+		wantErrs    []error
+		wantNotErrs []error
+		// Prefixes of the projects that are part of the error
+		wantSource, wantDestination bool
+	}{
+		{
+			name: "success",
+			export: func(_ context.Context, w io.Writer) error {
+				_, err := io.WriteString(w, "image")
+				return err
+			},
+			upload:    uploadAll,
+			wantData:  "image",
+			wantImage: 7,
+		},
+		{
+			name: "export fails",
+			export: func(_ context.Context, w io.Writer) error {
+				if _, err := io.WriteString(w, "ima"); err != nil {
+					return err
+				}
+				return exportErr
+			},
+			upload:   uploadAll,
+			wantData: "ima",
+			// The upload reads the error of the export from the pipe, both report it
+			wantErrs:        []error{exportErr},
+			wantSource:      true,
+			wantDestination: true,
+		},
+		{
+			name: "upload stops early",
+			export: func(ctx context.Context, w io.Writer) error {
+				// Blocks until the upload closes the pipe
+				_, err := io.WriteString(w, "image")
+				if !errors.Is(err, errUploadStopped) {
+					t.Errorf("export got error %v from the pipe, want %v", err, errUploadStopped)
+				}
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			upload: func(*[]byte) func(r io.Reader) (*UploadResult, error) {
+				return func(io.Reader) (*UploadResult, error) { return nil, uploadErr }
+			},
+			// The export only failed because it was cancelled
+			wantErrs:        []error{uploadErr},
+			wantNotErrs:     []error{context.Canceled, errUploadStopped},
+			wantDestination: true,
+		},
+		{
+			name: "upload stops early and export leaks resources",
+			export: func(ctx context.Context, _ io.Writer) error {
+				<-ctx.Done()
+				return errors.Join(ctx.Err(), leaked)
+			},
+			upload: func(*[]byte) func(r io.Reader) (*UploadResult, error) {
+				return func(io.Reader) (*UploadResult, error) { return nil, uploadErr }
+			},
+			wantErrs:        []error{uploadErr, leaked},
+			wantNotErrs:     []error{context.Canceled},
+			wantSource:      true,
+			wantDestination: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data []byte
+			result, err := copyStream(context.Background(), tt.export, tt.upload(&data))
+
+			if string(data) != tt.wantData {
+				t.Errorf("upload read %q, want %q", data, tt.wantData)
+			}
+
+			if len(tt.wantErrs) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.Image.ID != tt.wantImage {
+					t.Errorf("copyStream() returned image %d, want %d", result.Image.ID, tt.wantImage)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("copyStream() = %+v, want an error", result)
+			}
+			for _, want := range tt.wantErrs {
+				if !errors.Is(err, want) {
+					t.Errorf("copyStream() = %v, want %v", err, want)
+				}
+			}
+			for _, notWant := range tt.wantNotErrs {
+				if errors.Is(err, notWant) {
+					t.Errorf("copyStream() = %v, must not include %v", err, notWant)
+				}
+			}
+			if got := strings.Contains(err.Error(), "source project: "); got != tt.wantSource {
+				t.Errorf("copyStream() = %v, includes the source project: %t, want %t", err, got, tt.wantSource)
+			}
+			if got := strings.Contains(err.Error(), "destination project: "); got != tt.wantDestination {
+				t.Errorf("copyStream() = %v, includes the destination project: %t, want %t", err, got, tt.wantDestination)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package hcloudimages
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// deltaBlockSize is the size of the blocks that are compared with [UploadOptions.BaseImage]. It matches the block
+	// size of dd in the other commands.
+	deltaBlockSize = 4 * 1024 * 1024
+)
+
+// deltaTools are the commands that the rescue system needs in addition to [writeTools] to write only the changed
+// blocks.
+var deltaTools = []string{"split", "sha256sum"}
+
+// getBaseImage refreshes [UploadOptions.BaseImage] and checks that the temporary server can be created from it. The
+// architecture of the upload defaults to the one of the base image.
+func (s *Client) getBaseImage(ctx context.Context, options UploadOptions) (UploadOptions, error) {
+	if options.Processing == ProcessingRescue {
+		return options, fmt.Errorf("images can not be processed in the rescue system with a base image")
+	}
+	if options.TargetDevice != "" {
+		return options, fmt.Errorf("the target device can not be set with a base image")
+	}
+
+	image, _, err := s.c.Image.GetByID(ctx, options.BaseImage.ID)
+	if err != nil {
+		return options, fmt.Errorf("failed to get base image %d: %w", options.BaseImage.ID, err)
+	}
+	if image == nil {
+		return options, fmt.Errorf("base image %d not found", options.BaseImage.ID)
+	}
+	if image.Type != hcloud.ImageTypeSnapshot && image.Type != hcloud.ImageTypeBackup {
+		return options, fmt.Errorf("base image %d is a %s image, only snapshots and backups can be used", image.ID, image.Type)
+	}
+	if image.Status != hcloud.ImageStatusAvailable {
+		return options, fmt.Errorf("base image %d is not available yet", image.ID)
+	}
+
+	switch {
+	case options.Architecture == "" && options.ServerType == nil:
+		options.Architecture = image.Architecture
+	case options.Architecture != "" && options.Architecture != image.Architecture:
+		return options, fmt.Errorf("base image %d has the architecture %s, not %s", image.ID, image.Architecture, options.Architecture)
+	}
+
+	options.BaseImage = image
+	return options, nil
+}
+
+// hashCommand returns the command that prints the SHA-256 hash of every block of device, one line per block in the
+// format of sha256sum. The last block is shorter if the size of the device is not a multiple of the block size.
+func hashCommand(device string) string {
+	return fmt.Sprintf("split --bytes=%d --filter=sha256sum %s", deltaBlockSize, device)
+}
+
+// parseBlockHashes parses the output of [hashCommand] for a device of deviceSize bytes.
+func parseBlockHashes(output []byte, deviceSize int64) ([][sha256.Size]byte, error) {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if blocks := (deviceSize + deltaBlockSize - 1) / deltaBlockSize; int64(len(lines)) != blocks {
+		return nil, fmt.Errorf("expected %d block hashes, got %d", blocks, len(lines))
+	}
+
+	hashes := make([][sha256.Size]byte, len(lines))
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[1] != "-" {
+			return nil, fmt.Errorf("unexpected line %q", line)
+		}
+		if n, err := hex.Decode(hashes[i][:], []byte(fields[0])); err != nil || n != sha256.Size {
+			return nil, fmt.Errorf("unexpected line %q", line)
+		}
+	}
+
+	return hashes, nil
+}
+
+// deltaStats describes the extents that [writeDelta] sent.
+type deltaStats struct {
+	// Blocks of the device, and how many of them were written or discarded. All other blocks already matched.
+	Blocks    int
+	Written   int
+	Discarded int
+}
+
+// writeDelta reads the raw image and compares every block with the hashes of the device, as returned by
+// [parseBlockHashes]. Blocks that differ are written to w as extents for [extentCommand]. The device after the end of
+// the image is compared with zeros, so data of the base image does not remain in the new image.
+func writeDelta(w io.Writer, image io.Reader, hashes [][sha256.Size]byte, deviceSize int64) (deltaStats, error) {
+	stats := deltaStats{Blocks: len(hashes)}
+	extents := &extentWriter{w: w}
+
+	block := make([]byte, deltaBlockSize)
+	ended := false
+
+	for i, hash := range hashes {
+		offset := int64(i) * deltaBlockSize
+		buf := block[:min(deltaBlockSize, deviceSize-offset)]
+
+		n := 0
+		if !ended {
+			var err error
+			n, err = io.ReadFull(image, buf)
+			switch {
+			case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+				ended = true
+			case err != nil:
+				return stats, err
+			}
+		}
+		// The rest of the disk is zero, like after the blkdiscard of a full write
+		clear(buf[n:])
+
+		var err error
+		switch {
+		case sha256.Sum256(buf) == hash:
+			continue
+		case isZero(buf):
+			stats.Discarded++
+			err = extents.discard(offset, int64(len(buf)))
+		default:
+			stats.Written++
+			err = extents.write(offset, buf)
+		}
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	if !ended {
+		_, err := io.ReadFull(image, block[:1])
+		switch {
+		case err == nil:
+			return stats, fmt.Errorf("%w: image is larger than the disk with %d MB", ErrNoSpaceLeft, deviceSize/(1024*1024))
+		case !errors.Is(err, io.EOF):
+			return stats, err
+		}
+	}
+
+	return stats, extents.close()
+}
@@ -0,0 +1,112 @@
+package hcloudimages
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestWriteDelta(t *testing.T) {
+	filled := func(size int, seed byte) []byte {
+		p := make([]byte, size)
+		for i := range p {
+			p[i] = byte(i%251) + seed
+		}
+		return p
+	}
+
+	// The base image on the disk, 4.5 blocks with data in all of them
+	deviceSize := 4*deltaBlockSize + deltaBlockSize/2
+	base := filled(deviceSize, 1)
+
+	changed := bytes.Clone(base)
+	copy(changed[deltaBlockSize+100:], []byte("changed"))
+	copy(changed[3*deltaBlockSize:], []byte("changed as well"))
+
+	zeroed := bytes.Clone(base)
+	clear(zeroed[2*deltaBlockSize : 3*deltaBlockSize])
+
+	tests := []struct {
+		name          string
+		image         []byte
+		wantWritten   int
+		wantDiscarded int
+		wantErr       error
+	}{
+		{name: "unchanged", image: base},
+		{name: "changed blocks", image: changed, wantWritten: 2},
+		{name: "zeroed block", image: zeroed, wantDiscarded: 1},
+		{name: "shorter image", image: base[:deltaBlockSize+10], wantWritten: 1, wantDiscarded: 3},
+		{name: "larger image", image: filled(deviceSize+1, 1), wantErr: ErrNoSpaceLeft},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hashes [][sha256.Size]byte
+			for offset := 0; offset < deviceSize; offset += deltaBlockSize {
+				hashes = append(hashes, sha256.Sum256(base[offset:min(offset+deltaBlockSize, deviceSize)]))
+			}
+
+			var stream bytes.Buffer
+			stats, err := writeDelta(&stream, bytes.NewReader(tt.image), hashes, int64(deviceSize))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("writeDelta() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Written != tt.wantWritten || stats.Discarded != tt.wantDiscarded {
+				t.Errorf("writeDelta() wrote %d and discarded %d blocks, want %d and %d", stats.Written, stats.Discarded, tt.wantWritten, tt.wantDiscarded)
+			}
+
+			disk := bytes.Clone(base)
+			if err := applyExtents(disk, &stream); err != nil {
+				t.Fatal(err)
+			}
+
+			want := make([]byte, deviceSize)
+			copy(want, tt.image)
+			if !bytes.Equal(disk, want) {
+				t.Errorf("disk does not match the image after the delta was applied")
+			}
+		})
+	}
+}
+
+func TestParseBlockHashes(t *testing.T) {
+	hash := sha256.Sum256([]byte("block"))
+	line := hex.EncodeToString(hash[:]) + "  -\n"
+
+	tests := []struct {
+		name       string
+		output     string
+		deviceSize int64
+		wantBlocks int
+		wantErr    bool
+	}{
+		{name: "full blocks", output: line + line, deviceSize: 2 * deltaBlockSize, wantBlocks: 2},
+		{name: "partial last block", output: line + line, deviceSize: deltaBlockSize + 512, wantBlocks: 2},
+		{name: "missing block", output: line, deviceSize: 2 * deltaBlockSize, wantErr: true},
+		{name: "unexpected line", output: line + "split: /dev/sda: Input/output error\n", deviceSize: 2 * deltaBlockSize, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hashes, err := parseBlockHashes([]byte(tt.output), tt.deviceSize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBlockHashes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(hashes) != tt.wantBlocks {
+				t.Errorf("parseBlockHashes() returned %d hashes, want %d", len(hashes), tt.wantBlocks)
+			}
+			for _, h := range hashes {
+				if h != hash {
+					t.Errorf("parseBlockHashes() = %x, want %x", h, hash)
+				}
+			}
+		})
+	}
+}
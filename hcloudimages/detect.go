@@ -0,0 +1,335 @@
+package hcloudimages
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/qcow2"
+)
+
+const (
+	// sniffSize is the number of bytes that are read from the start of the image to detect its type. Large enough to
+	// decompress the first block of a bzip2 stream, which is at most 900 kB.
+	sniffSize = 1024 * 1024
+
+	// sniffHeaderSize is the number of bytes of the (decompressed) image needed to detect its format. GPT headers are
+	// at 4096 bytes on disks with 4K sectors.
+	sniffHeaderSize = 4096 + 512
+)
+
+var compressionMagic = []struct {
+	compression Compression
+	magic       []byte
+}{
+	{CompressionBZ2, []byte("BZh")},
+	{CompressionXZ, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{CompressionZSTD, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{CompressionGZIP, []byte{0x1f, 0x8b, 0x08}},
+	{CompressionLZ4, []byte{0x04, 0x22, 0x4d, 0x18}},
+	{CompressionZIP, []byte("PK\x03\x04")},
+}
+
+var formatMagic = []struct {
+	format Format
+	offset int
+	magic  []byte
+}{
+	{FormatQCOW2, 0, qcow2.Magic},
+	{FormatVMDK, 0, []byte("KDMV")},
+	{FormatVHDX, 0, []byte("vhdxfile")},
+	// Dynamic VHDs start with a copy of the footer, fixed VHDs can only be detected by the extension
+	{FormatVHD, 0, []byte("conectix")},
+	{FormatVDI, 0x40, []byte{0x7f, 0x10, 0xda, 0xbe}},
+	// Raw disks with a partition table
+	{FormatRaw, 512, []byte("EFI PART")},
+	{FormatRaw, 4096, []byte("EFI PART")},
+	{FormatRaw, 510, []byte{0x55, 0xaa}},
+}
+
+var compressionExtensions = map[string]Compression{
+	".bz2":  CompressionBZ2,
+	".xz":   CompressionXZ,
+	".zst":  CompressionZSTD,
+	".zstd": CompressionZSTD,
+	".gz":   CompressionGZIP,
+	".lz4":  CompressionLZ4,
+	".zip":  CompressionZIP,
+}
+
+// formatExtensions are only used if the magic bytes are not conclusive, so uncompressed qcow2 images with the ".img"
+// extension, e.g. Ubuntu cloud images, are still detected as qcow2.
+var formatExtensions = map[string]Format{
+	".raw":   FormatRaw,
+	".img":   FormatRaw,
+	".qcow2": FormatQCOW2,
+	".vmdk":  FormatVMDK,
+	".vhd":   FormatVHD,
+	".vhdx":  FormatVHDX,
+	".vdi":   FormatVDI,
+}
+
+// sniffCompression returns the compression of the image that starts with header. Images that do not match any known
+// compression are uncompressed.
+func sniffCompression(header []byte) Compression {
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.compression
+		}
+	}
+	return CompressionNone
+}
+
+// sniffFormat returns the format of the uncompressed image that starts with header.
+func sniffFormat(header []byte) (Format, bool) {
+	for _, m := range formatMagic {
+		if len(header) >= m.offset+len(m.magic) && bytes.Equal(header[m.offset:m.offset+len(m.magic)], m.magic) {
+			return m.format, true
+		}
+	}
+	return "", false
+}
+
+// extensionType returns the compression and format from the extensions of name, e.g. "image.qcow2.xz".
+func extensionType(name string) (Compression, bool, Format, bool) {
+	name = strings.ToLower(name)
+
+	compression, compressionOK := compressionExtensions[path.Ext(name)]
+	if compressionOK {
+		name = strings.TrimSuffix(name, path.Ext(name))
+	}
+
+	format, formatOK := formatExtensions[path.Ext(name)]
+	return compression, compressionOK, format, formatOK
+}
+
+// detectImage resolves [CompressionAuto] and [FormatAuto] in the options. The magic bytes at the start of the image
+// are checked first, the extension of the file name is used if they are not conclusive.
+//
+// [WriteOptions.ImageReader] is replaced with a reader that still returns the full image, if the bytes can not be read
+// without consuming them.
+func detectImage(ctx context.Context, options WriteOptions) (WriteOptions, error) {
+	if options.ImageCompression != CompressionAuto && options.ImageFormat != FormatAuto {
+		return options, nil
+	}
+
+	logger := contextlogger.From(ctx)
+
+	header, err := peekImage(ctx, &options)
+	if err != nil {
+		logger.DebugContext(ctx, "failed to read the start of the image, using the file extension", "error", err)
+	}
+
+	name := imageName(options)
+	extCompression, extCompressionOK, extFormat, extFormatOK := extensionType(name)
+	if options.ArchiveMember != "" {
+		// The format is only known from the name of the disk image in the archive
+		name = options.ArchiveMember
+		_, _, extFormat, extFormatOK = extensionType(name)
+	}
+
+	compression := options.ImageCompression
+	if compression == CompressionAuto {
+		switch {
+		case len(header) > 0:
+			compression = sniffCompression(header)
+		case extCompressionOK:
+			compression = extCompression
+		default:
+			compression = CompressionNone
+		}
+	}
+
+	format := options.ImageFormat
+	if format == FormatAuto {
+		var ok bool
+		if len(header) > 0 {
+			format, ok = sniffFormat(decompressedHeader(header, compression, options.ArchiveMember))
+		}
+		if !ok && extFormatOK {
+			format, ok = extFormat, true
+		}
+		if !ok {
+			return options, fmt.Errorf("%w: unknown format of %q, set the format explicitly", ErrUndetectable, name)
+		}
+	}
+
+	logger.InfoContext(ctx, "Detected image type", "compression", describeCompression(compression), "format", describeFormat(format))
+
+	options.ImageCompression = compression
+	options.ImageFormat = format
+	return options, nil
+}
+
+// peekImage returns the first bytes of the image without consuming them. Readers that do not implement [io.ReaderAt]
+// are wrapped in a buffered reader.
+func peekImage(ctx context.Context, options *WriteOptions) ([]byte, error) {
+	if options.ImageURL != nil {
+		return fetchImageHeader(ctx, options.ImageURL.String())
+	}
+
+	if readerAt, ok := options.ImageReader.(io.ReaderAt); ok {
+		header := make([]byte, sniffSize)
+		n, err := readerAt.ReadAt(header, 0)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		return header[:n], nil
+	}
+
+	if options.ImageReader == nil {
+		return nil, nil
+	}
+
+	buffered := bufio.NewReaderSize(options.ImageReader, sniffSize)
+	options.ImageReader = buffered
+	header, err := buffered.Peek(sniffSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return header, nil
+}
+
+// fetchImageHeader downloads the first bytes of the image with a ranged request.
+func fetchImageHeader(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", sniffSize-1))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	// Servers that do not support ranged requests return the whole image, we only read the start of it
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, sniffSize))
+}
+
+// decompressedHeader returns the start of the uncompressed image, extracted from the archive member if it is set. Only
+// compressions that are supported by the standard library can be decompressed, for all others the result is empty.
+func decompressedHeader(header []byte, compression Compression, member string) []byte {
+	var r io.Reader
+	switch compression {
+	case CompressionNone:
+		r = bytes.NewReader(header)
+	case CompressionBZ2:
+		r = bzip2.NewReader(bytes.NewReader(header))
+	case CompressionGZIP:
+		gz, err := gzip.NewReader(bytes.NewReader(header))
+		if err != nil {
+			return nil
+		}
+		r = gz
+	case CompressionZIP:
+		r = zipEntry(header, member)
+		if r == nil {
+			return nil
+		}
+		// The zip entry is the image, it is not a tar archive
+		member = ""
+	default:
+		return nil
+	}
+
+	if member != "" {
+		r = tarEntry(r, member)
+		if r == nil {
+			return nil
+		}
+	}
+
+	// The header is cut off, so the decompression fails at some point after the data we need
+	buf := make([]byte, sniffHeaderSize)
+	n, _ := io.ReadFull(r, buf)
+	return buf[:n]
+}
+
+// tarEntry returns a reader for the data of member in the tar archive, or nil if it is not in the start of the archive.
+func tarEntry(r io.Reader, member string) io.Reader {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return nil
+		}
+		if hdr.Name == member {
+			return tr
+		}
+	}
+}
+
+// zipEntry returns a reader for the data of the first file in the zip archive that starts with header, or nil if the
+// entry is not stored or deflated. If member is set, the first file must have that name.
+func zipEntry(header []byte, member string) io.Reader {
+	// Local file header, see APPNOTE.TXT section 4.3.7
+	const localHeaderSize = 30
+	if len(header) < localHeaderSize {
+		return nil
+	}
+
+	method := binary.LittleEndian.Uint16(header[8:])
+	nameLength := int(binary.LittleEndian.Uint16(header[26:]))
+	extraLength := int(binary.LittleEndian.Uint16(header[28:]))
+
+	start := localHeaderSize + nameLength + extraLength
+	if len(header) < start {
+		return nil
+	}
+	if member != "" && string(header[localHeaderSize:localHeaderSize+nameLength]) != member {
+		return nil
+	}
+	data := bytes.NewReader(header[start:])
+
+	switch method {
+	case 0:
+		return data
+	case 8:
+		return flate.NewReader(data)
+	default:
+		return nil
+	}
+}
+
+// imageName returns the file name of the image, if it is known.
+func imageName(options WriteOptions) string {
+	if options.ImageURL != nil {
+		return path.Base(options.ImageURL.Path)
+	}
+	if named, ok := options.ImageReader.(interface{ Name() string }); ok {
+		return path.Base(named.Name())
+	}
+	return ""
+}
+
+func describeCompression(compression Compression) string {
+	if compression == CompressionNone {
+		return "none"
+	}
+	return string(compression)
+}
+
+func describeFormat(format Format) string {
+	if format == FormatRaw {
+		return "raw"
+	}
+	return string(format)
+}
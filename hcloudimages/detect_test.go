@@ -0,0 +1,230 @@
+package hcloudimages
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectImage(t *testing.T) {
+	mbr := make([]byte, 1024)
+	mbr[510], mbr[511] = 0x55, 0xaa
+
+	gpt := make([]byte, 1024)
+	copy(gpt[512:], "EFI PART")
+
+	qcow2Header := append([]byte("QFI\xfb"), make([]byte, 1020)...)
+
+	// bzip2 compressed MBR image, created with: head -c 1024 mbr.raw | bzip2 -9
+	bz2MBR := []byte{
+		0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x21, 0xbc, 0xda, 0x9d, 0x00, 0x00,
+		0x02, 0x42, 0x10, 0xc0, 0x00, 0x02, 0x00, 0x00, 0x10, 0x00, 0x08, 0x20, 0x00, 0x30, 0xcd, 0x34,
+		0x12, 0x9e, 0x9a, 0x92, 0xdb, 0x21, 0xcd, 0x83, 0xc5, 0xdc, 0x91, 0x4e, 0x14, 0x24, 0x08, 0x6f,
+		0x36, 0xa7, 0x40,
+	}
+
+	// gzip compressed MBR image, created with: head -c 1024 mbr.raw | gzip -9n
+	gzipMBR := []byte{
+		0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x03, 0x63, 0x60, 0x18, 0x05, 0x23, 0x17,
+		0x84, 0xae, 0x1a, 0x0d, 0x83, 0x91, 0x0d, 0x00, 0xdf, 0xe5, 0x91, 0x3b, 0x00, 0x04, 0x00, 0x00,
+	}
+
+	// zip archive with the MBR image as disk.raw
+	zipMBR := []byte{
+		0x50, 0x4b, 0x03, 0x04, 0x14, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x21, 0x5c, 0xdf, 0xe5,
+		0x91, 0x3b, 0x10, 0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x64, 0x69,
+		0x73, 0x6b, 0x2e, 0x72, 0x61, 0x77, 0x63, 0x60, 0x18, 0x05, 0x23, 0x17, 0x84, 0xae, 0x1a, 0x68,
+		0x17, 0x8c, 0x82, 0x81, 0x05, 0x00, 0x50, 0x4b, 0x01, 0x02, 0x14, 0x03, 0x14, 0x00, 0x00, 0x00,
+		0x08, 0x00, 0x00, 0x00, 0x21, 0x5c, 0xdf, 0xe5, 0x91, 0x3b, 0x10, 0x00, 0x00, 0x00, 0x00, 0x04,
+		0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0x01,
+		0x00, 0x00, 0x00, 0x00, 0x64, 0x69, 0x73, 0x6b, 0x2e, 0x72, 0x61, 0x77, 0x50, 0x4b, 0x05, 0x06,
+		0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x36, 0x00, 0x00, 0x00, 0x36, 0x00, 0x00, 0x00,
+		0x00, 0x00,
+	}
+
+	var tarMBR bytes.Buffer
+	tw := tar.NewWriter(&tarMBR)
+	for name, content := range map[string][]byte{"README": []byte("hello"), "disk.raw": mbr} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		options         WriteOptions
+		wantCompression Compression
+		wantFormat      Format
+		wantErr         error
+	}{
+		{
+			name:            "raw mbr",
+			options:         WriteOptions{ImageReader: bytes.NewReader(mbr), ImageCompression: CompressionAuto, ImageFormat: FormatAuto},
+			wantCompression: CompressionNone,
+			wantFormat:      FormatRaw,
+		},
+		{
+			name:            "raw gpt stream",
+			options:         WriteOptions{ImageReader: io.MultiReader(bytes.NewReader(gpt)), ImageCompression: CompressionAuto, ImageFormat: FormatAuto},
+			wantCompression: CompressionNone,
+			wantFormat:      FormatRaw,
+		},
+		{
+			name:            "qcow2",
+			options:         WriteOptions{ImageReader: bytes.NewReader(qcow2Header), ImageFormat: FormatAuto},
+			wantCompression: CompressionNone,
+			wantFormat:      FormatQCOW2,
+		},
+		{
+			name:            "bz2 raw",
+			options:         WriteOptions{ImageReader: bytes.NewReader(bz2MBR), ImageCompression: CompressionAuto, ImageFormat: FormatAuto},
+			wantCompression: CompressionBZ2,
+			wantFormat:      FormatRaw,
+		},
+		{
+			name:            "tar member",
+			options:         WriteOptions{ImageReader: bytes.NewReader(tarMBR.Bytes()), ImageCompression: CompressionAuto, ImageFormat: FormatAuto, ArchiveMember: "disk.raw"},
+			wantCompression: CompressionNone,
+			wantFormat:      FormatRaw,
+		},
+		{
+			name:            "zip member",
+			options:         WriteOptions{ImageReader: bytes.NewReader(zipMBR), ImageCompression: CompressionAuto, ImageFormat: FormatAuto, ArchiveMember: "disk.raw"},
+			wantCompression: CompressionZIP,
+			wantFormat:      FormatRaw,
+		},
+		{
+			name:            "xz tar member from extension",
+			options:         WriteOptions{ImageReader: bytes.NewReader([]byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00}), ImageCompression: CompressionXZ, ImageFormat: FormatAuto, ArchiveMember: "image.qcow2"},
+			wantCompression: CompressionXZ,
+			wantFormat:      FormatQCOW2,
+		},
+		{
+			name:    "xz without extension",
+			options: WriteOptions{ImageReader: bytes.NewReader([]byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00}), ImageCompression: CompressionAuto, ImageFormat: FormatAuto},
+			wantErr: ErrUndetectable,
+		},
+		{
+			name:    "explicit compression",
+			options: WriteOptions{ImageReader: bytes.NewReader(mbr), ImageCompression: CompressionZSTD, ImageFormat: FormatAuto},
+			wantErr: ErrInvalidImage,
+		},
+		{
+			name:            "gzip raw",
+			options:         WriteOptions{ImageReader: bytes.NewReader(gzipMBR), ImageCompression: CompressionAuto, ImageFormat: FormatAuto},
+			wantCompression: CompressionGZIP,
+			wantFormat:      FormatRaw,
+		},
+		{
+			name:            "zip raw",
+			options:         WriteOptions{ImageReader: bytes.NewReader(zipMBR), ImageCompression: CompressionAuto, ImageFormat: FormatAuto},
+			wantCompression: CompressionZIP,
+			wantFormat:      FormatRaw,
+		},
+		{
+			name:    "unknown format",
+			options: WriteOptions{ImageReader: bytes.NewReader(make([]byte, 1024)), ImageFormat: FormatAuto},
+			wantErr: ErrUndetectable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectImage(context.Background(), tt.options)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("detectImage() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.ImageCompression != tt.wantCompression || got.ImageFormat != tt.wantFormat {
+				t.Errorf("detectImage() = %q, %q, want %q, %q", got.ImageCompression, got.ImageFormat, tt.wantCompression, tt.wantFormat)
+			}
+
+			// Detection must not consume the image
+			image, err := io.ReadAll(got.ImageReader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(image) == 0 {
+				t.Errorf("image was consumed by the detection")
+			}
+		})
+	}
+}
+
+func TestExtensionType(t *testing.T) {
+	tests := []struct {
+		name            string
+		wantCompression Compression
+		wantFormat      Format
+		wantFormatOK    bool
+	}{
+		{"image.qcow2.xz", CompressionXZ, FormatQCOW2, true},
+		{"image.RAW.zst", CompressionZSTD, FormatRaw, true},
+		{"image.vhdx", CompressionNone, FormatVHDX, true},
+		{"disk.img", CompressionNone, FormatRaw, true},
+		{"disk.img.xz", CompressionXZ, FormatRaw, true},
+		{"disk.img.zst", CompressionZSTD, FormatRaw, true},
+		{"image.tar", CompressionNone, FormatRaw, false},
+		{"", CompressionNone, FormatRaw, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compression, _, format, formatOK := extensionType(tt.name)
+			if compression != tt.wantCompression || format != tt.wantFormat || formatOK != tt.wantFormatOK {
+				t.Errorf("extensionType() = %q, %q, %v, want %q, %q, %v", compression, format, formatOK, tt.wantCompression, tt.wantFormat, tt.wantFormatOK)
+			}
+		})
+	}
+}
+
+func TestDetectImageFileName(t *testing.T) {
+	xzHeader := []byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00}
+	zstdHeader := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x00}
+	qcow2Header := append([]byte("QFI\xfb"), make([]byte, 1020)...)
+
+	tests := []struct {
+		name            string
+		content         []byte
+		wantCompression Compression
+		wantFormat      Format
+	}{
+		{"disk.img", make([]byte, 1024), CompressionNone, FormatRaw},
+		{"disk.img.xz", xzHeader, CompressionXZ, FormatRaw},
+		{"disk.img.zst", zstdHeader, CompressionZSTD, FormatRaw},
+		// The magic bytes win over the extension
+		{"ubuntu-cloudimg.img", qcow2Header, CompressionNone, FormatQCOW2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.name)
+			if err := os.WriteFile(path, tt.content, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = f.Close() }()
+
+			got, err := detectImage(context.Background(), WriteOptions{ImageReader: f, ImageCompression: CompressionAuto, ImageFormat: FormatAuto})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ImageCompression != tt.wantCompression || got.ImageFormat != tt.wantFormat {
+				t.Errorf("detectImage() = %q, %q, want %q, %q", got.ImageCompression, got.ImageFormat, tt.wantCompression, tt.wantFormat)
+			}
+		})
+	}
+}
@@ -38,5 +38,11 @@
 // the process. For this we provide optional logs through [log/slog]. You can set a [log/slog.Logger] in the
 // [context.Context] through [github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger.New].
 //
+// # Events
+//
+// If you want to build your own UI, metrics or audit trail, you can pass an [Observer] to [NewClient] through
+// [WithObserver]. It receives an [Event] whenever a step of [Client.Upload] or [Client.WriteToDisk] starts, finishes
+// or fails, including the IDs of the resources involved.
+//
 // [Hetzner Cloud website]: https://www.hetzner.com/cloud/
 package hcloudimages
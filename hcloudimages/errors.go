@@ -0,0 +1,191 @@
+package hcloudimages
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// Errors returned by [Client.Upload], [Client.WriteToDisk] and [Client.Export]. They are wrapped with more details and can be
+// checked with [errors.Is].
+var (
+	// ErrImageDownload is returned if the rescue system could not download the image from [WriteOptions.ImageURL].
+	ErrImageDownload = errors.New("failed to download the image")
+
+	// ErrImageNotFound is returned if the server at [WriteOptions.ImageURL] responded with 404. It also matches
+	// [ErrImageDownload].
+	ErrImageNotFound = fmt.Errorf("%w: not found", ErrImageDownload)
+
+	// ErrImageForbidden is returned if the server at [WriteOptions.ImageURL] responded with 401 or 403. It also
+	// matches [ErrImageDownload].
+	ErrImageForbidden = fmt.Errorf("%w: access denied", ErrImageDownload)
+
+	// ErrInvalidImage is returned if the image could not be decompressed or is not in the specified format.
+	ErrInvalidImage = errors.New("invalid image")
+
+	// ErrUndetectable is returned if [CompressionAuto] or [FormatAuto] is used, but the type of the image could not
+	// be detected. It also matches [ErrInvalidImage].
+	ErrUndetectable = fmt.Errorf("%w: failed to detect the image type", ErrInvalidImage)
+
+	// ErrChecksumMismatch is returned if the image does not match [WriteOptions.ImageChecksum].
+	ErrChecksumMismatch = errors.New("failed to verify the image")
+
+	// ErrNoSpaceLeft is returned if the image does not fit on the disk or in the memory of the rescue system.
+	ErrNoSpaceLeft = errors.New("not enough space to write the image")
+
+	// ErrRescueSystem is returned if the rescue system lacks a tool that is needed to write the image, or could not be
+	// probed. With [ProcessingAuto], missing tools only cause this error if the image can not be processed on the
+	// client instead.
+	ErrRescueSystem = errors.New("rescue system can not write the image")
+
+	// ErrTargetDevice is returned if the root disk of the server could not be detected unambiguously, or
+	// [WriteOptions.TargetDevice] is not a block device.
+	ErrTargetDevice = errors.New("failed to find the device to write the image to")
+
+	// ErrWriteImage is returned if writing the image failed for any other reason.
+	ErrWriteImage = errors.New("failed to download and write the image")
+
+	// ErrExportImage is returned by [Client.Export] if the disk could not be read, or the image could not be written to
+	// [ExportOptions.Output].
+	ErrExportImage = errors.New("failed to read and export the image")
+
+	// ErrSSHUnreachable is returned if no SSH connection to the rescue system could be opened.
+	ErrSSHUnreachable = errors.New("failed to ssh into temporary server")
+
+	// ErrSnapshotFailed is returned if the snapshot of the temporary server could not be created.
+	ErrSnapshotFailed = errors.New("failed to create snapshot")
+)
+
+// CleanupError is returned if temporary resources could not be deleted. They are left in the project and continue
+// to cost money until they are removed, e.g. through [Client.CleanupTempResources].
+type CleanupError struct {
+	// ServerIDs, SSHKeyIDs and VolumeIDs of the resources that could not be deleted.
+	ServerIDs []int64
+	SSHKeyIDs []int64
+	VolumeIDs []int64
+
+	Err error
+}
+
+func (e *CleanupError) Error() string {
+	var leaked []string
+	if len(e.ServerIDs) > 0 {
+		leaked = append(leaked, fmt.Sprintf("servers %v", e.ServerIDs))
+	}
+	if len(e.SSHKeyIDs) > 0 {
+		leaked = append(leaked, fmt.Sprintf("ssh keys %v", e.SSHKeyIDs))
+	}
+	if len(e.VolumeIDs) > 0 {
+		leaked = append(leaked, fmt.Sprintf("volumes %v", e.VolumeIDs))
+	}
+
+	msg := "failed to clean up temporary resources"
+	if len(leaked) > 0 {
+		msg += " (" + strings.Join(leaked, ", ") + ")"
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *CleanupError) Unwrap() error {
+	return e.Err
+}
+
+// addServer records the server as leaked.
+func (e *CleanupError) addServer(id int64, err error) {
+	e.ServerIDs = append(e.ServerIDs, id)
+	e.Err = errors.Join(e.Err, fmt.Errorf("failed to delete server %d: %w", id, err))
+}
+
+// addSSHKey records the ssh key as leaked.
+func (e *CleanupError) addSSHKey(id int64, err error) {
+	e.SSHKeyIDs = append(e.SSHKeyIDs, id)
+	e.Err = errors.Join(e.Err, fmt.Errorf("failed to delete ssh key %d: %w", id, err))
+}
+
+// addVolume records the volume as leaked.
+func (e *CleanupError) addVolume(id int64, err error) {
+	e.VolumeIDs = append(e.VolumeIDs, id)
+	e.Err = errors.Join(e.Err, fmt.Errorf("failed to delete volume %d: %w", id, err))
+}
+
+// IsRetryable reports whether err was caused by a temporary problem, so that the same call might succeed if it is
+// tried again later. Errors caused by the image itself, like [ErrInvalidImage] or [ErrImageNotFound], are not
+// retryable.
+func IsRetryable(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrImageNotFound),
+		errors.Is(err, ErrImageForbidden),
+		errors.Is(err, ErrInvalidImage),
+		errors.Is(err, ErrChecksumMismatch),
+		errors.Is(err, ErrNoSpaceLeft):
+		return false
+	case errors.Is(err, ErrImageDownload),
+		errors.Is(err, ErrSSHUnreachable),
+		errors.Is(err, ErrSnapshotFailed):
+		return true
+	}
+
+	return hcloud.IsError(err,
+		hcloud.ErrorCodeServiceError,
+		hcloud.ErrorCodeRateLimitExceeded,
+		hcloud.ErrorCodeLocked,
+		hcloud.ErrorCodeResourceUnavailable,
+		hcloud.ErrorCodeMaintenance,
+		hcloud.ErrorCodeConflict,
+	)
+}
+
+// remoteErrorPatterns map messages that the commands on the rescue system print to stderr to our errors. They are
+// ordered by priority, the first pattern that matches any line wins.
+var remoteErrorPatterns = []struct {
+	pattern *regexp.Regexp
+	err     error
+}{
+	{regexp.MustCompile(regexp.QuoteMeta(checksumMismatchMessage)), ErrChecksumMismatch},
+	{regexp.MustCompile(`No space left on device`), ErrNoSpaceLeft},
+	// wget
+	{regexp.MustCompile(`ERROR 404`), ErrImageNotFound},
+	{regexp.MustCompile(`ERROR 40[13]`), ErrImageForbidden},
+	{regexp.MustCompile(`ERROR [0-9]{3}|unable to resolve host address|failed: Connection|Read error`), ErrImageDownload},
+	// qemu-img
+	{regexp.MustCompile(`not in qcow2 format|Unsupported qcow2 version|Could not open|Invalid footer|Unsupported VMDK|not a VDI image|Invalid file format`), ErrInvalidImage},
+	// bzip2, xz, zstd, gzip, lz4
+	{regexp.MustCompile(`is not a bzip2 file|File format not recognized|unsupported format|Unexpected end of input|Compressed data is corrupt|data integrity error|not in gzip format|unexpected end of file|Unrecognized header|Decompression error`), ErrInvalidImage},
+	// unzip
+	{regexp.MustCompile(regexp.QuoteMeta(zipEntriesMessage) + `|End-of-central-directory signature not found|cannot find zipfile directory|filename not matched`), ErrInvalidImage},
+	// tar
+	{regexp.MustCompile(`Not found in archive|This does not look like a tar archive`), ErrInvalidImage},
+}
+
+// remoteError returns the error for the output of a failed command on the rescue system. The line of the output that
+// matched is added to the error, as it usually explains the problem.
+func remoteError(output []byte, err error) error {
+	// Errors of the image that was processed on the client are passed on by the SSH session
+	if isImageError(err) {
+		return err
+	}
+
+	lines := strings.Split(string(output), "\n")
+	for i, line := range lines {
+		// Progress updates of dd are separated by \r, only the last part of the line is relevant
+		lines[i] = strings.TrimSpace(line[strings.LastIndex(line, "\r")+1:])
+	}
+
+	for _, p := range remoteErrorPatterns {
+		for _, line := range lines {
+			if p.pattern.MatchString(line) {
+				return fmt.Errorf("%w: %s", p.err, line)
+			}
+		}
+	}
+
+	return fmt.Errorf("%w: %w", ErrWriteImage, err)
+}
@@ -0,0 +1,130 @@
+package hcloudimages
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+func TestRemoteError(t *testing.T) {
+	exitErr := errors.New("Process exited with status 1")
+
+	tests := []struct {
+		name    string
+		output  string
+		want    error
+		wantMsg string
+	}{
+		{
+			name:    "unknown",
+			output:  "something went wrong\n",
+			want:    ErrWriteImage,
+			wantMsg: "failed to download and write the image: Process exited with status 1",
+		},
+		{
+			name:    "wget 404",
+			output:  "https://example.com/image.xz:\n2026-10-18 12:00:00 ERROR 404: Not Found.\n",
+			want:    ErrImageNotFound,
+			wantMsg: "failed to download the image: not found: 2026-10-18 12:00:00 ERROR 404: Not Found.",
+		},
+		{
+			name:   "wget 403",
+			output: "2026-10-18 12:00:00 ERROR 403: Forbidden.\n",
+			want:   ErrImageForbidden,
+		},
+		{
+			name:   "wget 502",
+			output: "2026-10-18 12:00:00 ERROR 502: Bad Gateway.\n",
+			want:   ErrImageDownload,
+		},
+		{
+			name:    "no space left after dd progress",
+			output:  "1048576 bytes copied\r2097152 bytes copied\rdd: error writing '/dev/sda': No space left on device\n",
+			want:    ErrNoSpaceLeft,
+			wantMsg: "not enough space to write the image: dd: error writing '/dev/sda': No space left on device",
+		},
+		{
+			name:   "invalid qcow2",
+			output: "qemu-img: Could not open 'image.qcow2': Image is not in qcow2 format\n",
+			want:   ErrInvalidImage,
+		},
+		{
+			name:   "invalid xz",
+			output: "xz: (stdin): File format not recognized\n",
+			want:   ErrInvalidImage,
+		},
+		{
+			name:   "invalid gzip",
+			output: "gzip: stdin: not in gzip format\n",
+			want:   ErrInvalidImage,
+		},
+		{
+			name:   "zip with multiple files",
+			output: "zip archive must contain exactly one file\n",
+			want:   ErrInvalidImage,
+		},
+		{
+			name:    "checksum mismatch wins over other errors",
+			output:  "xz: (stdin): Unexpected end of input\nimage checksum mismatch: expected abc, got def\n",
+			want:    ErrChecksumMismatch,
+			wantMsg: "failed to verify the image: image checksum mismatch: expected abc, got def",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := remoteError([]byte(tt.output), exitErr)
+			if !errors.Is(got, tt.want) {
+				t.Errorf("remoteError() = %v, want %v", got, tt.want)
+			}
+			if tt.wantMsg != "" && got.Error() != tt.wantMsg {
+				t.Errorf("remoteError() message = %q, want %q", got.Error(), tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"download", fmt.Errorf("%w: ERROR 502", ErrImageDownload), true},
+		{"not found", fmt.Errorf("%w: ERROR 404", ErrImageNotFound), false},
+		{"invalid image", fmt.Errorf("%w: bad magic", ErrInvalidImage), false},
+		{"ssh", fmt.Errorf("%w: i/o timeout", ErrSSHUnreachable), true},
+		{"api unavailable", fmt.Errorf("creating the temporary server failed: %w", hcloud.Error{Code: hcloud.ErrorCodeResourceUnavailable}), true},
+		{"api invalid input", fmt.Errorf("creating the temporary server failed: %w", hcloud.Error{Code: hcloud.ErrorCodeInvalidInput}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanupError(t *testing.T) {
+	cleanupErr := &CleanupError{}
+	cleanupErr.addServer(1, errors.New("locked"))
+	cleanupErr.addSSHKey(2, errors.New("not found"))
+
+	err := fmt.Errorf("failed to clean up all servers: %w", cleanupErr)
+
+	var got *CleanupError
+	if !errors.As(err, &got) {
+		t.Fatalf("errors.As() did not find CleanupError in %v", err)
+	}
+	if len(got.ServerIDs) != 1 || got.ServerIDs[0] != 1 || len(got.SSHKeyIDs) != 1 || got.SSHKeyIDs[0] != 2 {
+		t.Errorf("CleanupError = %+v, want server 1 and ssh key 2", got)
+	}
+
+	want := "failed to clean up temporary resources (servers [1], ssh keys [2]): failed to delete server 1: locked\nfailed to delete ssh key 2: not found"
+	if got.Error() != want {
+		t.Errorf("CleanupError.Error() = %q, want %q", got.Error(), want)
+	}
+}
@@ -0,0 +1,237 @@
+package hcloudimages
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/journal"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/randomid"
+)
+
+// StepID identifies a step of [Client.Upload] or [Client.WriteToDisk].
+type StepID string
+
+const (
+	StepGenerateSSHKey StepID = "generate-ssh-key"
+	StepCreateServer   StepID = "create-server"
+	StepCreateVolume   StepID = "create-volume"
+	StepAttachVolume   StepID = "attach-volume"
+	StepPowerOffServer StepID = "power-off-server"
+	StepEnableRescue   StepID = "enable-rescue"
+	StepBootServer     StepID = "boot-server"
+	StepOpenSSH        StepID = "open-ssh"
+	StepProbeRescue    StepID = "probe-rescue"
+	StepCleanDisk      StepID = "clean-disk"
+	StepHashDisk       StepID = "hash-disk"
+	StepWriteImage     StepID = "write-image"
+	StepExportImage    StepID = "export-image"
+	StepShutdownServer StepID = "shutdown-server"
+	StepCreateImage    StepID = "create-image"
+	StepDetachVolume   StepID = "detach-volume"
+
+	// Cleanup steps run after the other steps, even if one of them failed.
+
+	StepDeleteSSHKey StepID = "delete-ssh-key"
+	StepDeleteServer StepID = "delete-server"
+	StepDeleteVolume StepID = "delete-volume"
+)
+
+type EventType string
+
+const (
+	EventStepStarted  EventType = "step-started"
+	EventStepFinished EventType = "step-finished"
+	EventStepFailed   EventType = "step-failed"
+)
+
+// Event describes a change in the progress of [Client.Upload] or [Client.WriteToDisk]. Every step emits a
+// [EventStepStarted] event, followed by either [EventStepFinished] or [EventStepFailed].
+type Event struct {
+	Type EventType
+
+	// RunID is the random ID of the method call, also used in the names of the temporary resources.
+	RunID string
+
+	Step StepID
+
+	// Number of the step, as it is shown in the logs. Cleanup steps have no number and use 0.
+	Number int
+
+	Time time.Time
+
+	// Duration of the step. Only set for [EventStepFinished] and [EventStepFailed].
+	Duration time.Duration
+
+	// Resources known at the time of the event.
+	Resources Resources
+
+	// Err is the reason why the step failed. Only set for [EventStepFailed].
+	Err error
+}
+
+// Resources holds the IDs of the resources used by a run. Any ID is 0 until the resource is known.
+type Resources struct {
+	ServerID int64
+	SSHKeyID int64
+	ImageID  int64
+	VolumeID int64
+
+	// ActionID is the last action that was waited on in the step.
+	ActionID int64
+}
+
+// Observer receives [Event]s from all method calls of a [Client]. It is called synchronously and should not block.
+type Observer interface {
+	Observe(ctx context.Context, event Event)
+}
+
+// ObserverFunc is an adapter to use ordinary functions as an [Observer].
+type ObserverFunc func(ctx context.Context, event Event)
+
+func (f ObserverFunc) Observe(ctx context.Context, event Event) {
+	f(ctx, event)
+}
+
+// emitCleanup notifies the observer about a resource that was deleted by one of the cleanup methods. These are not part
+// of a run, so only a single [EventStepFinished] or [EventStepFailed] event is sent.
+func (s *Client) emitCleanup(ctx context.Context, id StepID, runID string, resources Resources, err error) {
+	if s.observer == nil {
+		return
+	}
+
+	eventType := EventStepFinished
+	if err != nil {
+		eventType = EventStepFailed
+	}
+
+	s.observer.Observe(ctx, Event{
+		Type:      eventType,
+		RunID:     runID,
+		Step:      id,
+		Time:      time.Now(),
+		Resources: resources,
+		Err:       err,
+	})
+}
+
+// run holds the state of a single call to [Client.Upload] or [Client.WriteToDisk].
+type run struct {
+	id        string
+	observer  Observer
+	resources Resources
+	journal   *journal.Journal
+	heartbeat *heartbeat
+
+	// Collected for the [UploadResult]
+	steps            []StepResult
+	warnings         []string
+	bytesTransferred int64
+	cleanup          CleanupResult
+}
+
+func (s *Client) newRun(ctx context.Context, method string) (context.Context, *run, error) {
+	id, err := randomid.Generate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger := contextlogger.From(ctx).With(
+		"library", "hcloudimages",
+		"method", method,
+		"run-id", id,
+	)
+	ctx = contextlogger.New(ctx, logger)
+
+	r := &run{id: id, observer: s.observer}
+
+	if s.journalDir != "" {
+		r.journal, err = journal.Create(s.journalDir, id, method)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.DebugContext(ctx, "writing journal", "journal", r.journal.Path())
+	}
+
+	return ctx, r, nil
+}
+
+// step is a single step of a [run]. It is created through [run.startStep] and must be ended with either
+// [step.done] or [step.fail].
+type step struct {
+	run      *run
+	id       StepID
+	number   int
+	start    time.Time
+	actionID int64
+}
+
+// startStep logs the message of the step and notifies the observer. Cleanup steps use the number 0.
+func (r *run) startStep(ctx context.Context, number int, id StepID, message string) *step {
+	logger := contextlogger.From(ctx)
+	if number > 0 {
+		logger.InfoContext(ctx, fmt.Sprintf("# Step %d: %s", number, message))
+	} else {
+		logger.InfoContext(ctx, "Cleanup: "+message)
+	}
+
+	st := &step{run: r, id: id, number: number, start: time.Now()}
+	st.emit(ctx, EventStepStarted, nil)
+	return st
+}
+
+// waitingOn records the action as the last one of the step.
+func (st *step) waitingOn(action *hcloud.Action) {
+	if action != nil {
+		st.actionID = action.ID
+	}
+}
+
+func (st *step) done(ctx context.Context) {
+	st.finish(ctx, EventStepFinished, nil)
+}
+
+// fail notifies the observer about the failed step and returns err.
+func (st *step) fail(ctx context.Context, err error) error {
+	st.finish(ctx, EventStepFailed, err)
+	return err
+}
+
+// finish records the outcome of the step in the run and notifies the observer.
+func (st *step) finish(ctx context.Context, eventType EventType, err error) {
+	now := time.Now()
+	st.run.steps = append(st.run.steps, StepResult{
+		Number:   st.number,
+		Step:     st.id,
+		Start:    st.start,
+		Duration: now.Sub(st.start),
+		Err:      err,
+	})
+
+	st.emit(ctx, eventType, err)
+}
+
+func (st *step) emit(ctx context.Context, eventType EventType, err error) {
+	if st.run.observer == nil {
+		return
+	}
+
+	event := Event{
+		Type:      eventType,
+		RunID:     st.run.id,
+		Step:      st.id,
+		Number:    st.number,
+		Time:      time.Now(),
+		Resources: st.run.resources,
+		Err:       err,
+	}
+	event.Resources.ActionID = st.actionID
+	if eventType != EventStepStarted {
+		event.Duration = event.Time.Sub(st.start)
+	}
+
+	st.run.observer.Observe(ctx, event)
+}
@@ -0,0 +1,111 @@
+package hcloudimages
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+func TestObserver(t *testing.T) {
+	var events []Event
+	client := NewClient(nil, WithObserver(ObserverFunc(func(_ context.Context, event Event) {
+		events = append(events, event)
+	})))
+
+	ctx, r, err := client.newRun(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := r.startStep(ctx, 1, StepCreateServer, "Creating server")
+	r.resources.ServerID = 42
+	st.waitingOn(&hcloud.Action{ID: 7})
+	time.Sleep(time.Millisecond)
+	st.done(ctx)
+
+	stepErr := errors.New("boot failed")
+	st = r.startStep(ctx, 2, StepBootServer, "Booting server")
+	if err := st.fail(ctx, stepErr); !errors.Is(err, stepErr) {
+		t.Errorf("fail() = %v, want %v", err, stepErr)
+	}
+
+	st = r.startStep(ctx, 0, StepDeleteServer, "Deleting server")
+	st.done(ctx)
+
+	want := []struct {
+		eventType EventType
+		step      StepID
+		number    int
+		resources Resources
+		err       error
+	}{
+		{eventType: EventStepStarted, step: StepCreateServer, number: 1},
+		{eventType: EventStepFinished, step: StepCreateServer, number: 1, resources: Resources{ServerID: 42, ActionID: 7}},
+		{eventType: EventStepStarted, step: StepBootServer, number: 2, resources: Resources{ServerID: 42}},
+		{eventType: EventStepFailed, step: StepBootServer, number: 2, resources: Resources{ServerID: 42}, err: stepErr},
+		{eventType: EventStepStarted, step: StepDeleteServer, resources: Resources{ServerID: 42}},
+		{eventType: EventStepFinished, step: StepDeleteServer, resources: Resources{ServerID: 42}},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("observed %d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, w := range want {
+		event := events[i]
+		if event.Type != w.eventType || event.Step != w.step || event.Number != w.number {
+			t.Errorf("event %d = %s %s %d, want %s %s %d", i, event.Type, event.Step, event.Number, w.eventType, w.step, w.number)
+		}
+		if event.Resources != w.resources {
+			t.Errorf("event %d has resources %+v, want %+v", i, event.Resources, w.resources)
+		}
+		if !errors.Is(event.Err, w.err) || (w.err == nil && event.Err != nil) {
+			t.Errorf("event %d has error %v, want %v", i, event.Err, w.err)
+		}
+		if event.RunID != r.id {
+			t.Errorf("event %d has run id %q, want %q", i, event.RunID, r.id)
+		}
+		if event.Time.IsZero() {
+			t.Errorf("event %d has no time", i)
+		}
+		if event.Type == EventStepStarted && event.Duration != 0 {
+			t.Errorf("event %d %s has duration %s", i, event.Type, event.Duration)
+		}
+	}
+	if events[1].Duration < time.Millisecond {
+		t.Errorf("finished event has duration %s, want at least 1ms", events[1].Duration)
+	}
+
+	// The steps are recorded for the result as well
+	if len(r.steps) != 3 {
+		t.Fatalf("run recorded %d steps, want 3", len(r.steps))
+	}
+	if r.steps[0].Err != nil || !errors.Is(r.steps[1].Err, stepErr) {
+		t.Errorf("run recorded errors %v and %v, want nil and %v", r.steps[0].Err, r.steps[1].Err, stepErr)
+	}
+}
+
+func TestEmitCleanup(t *testing.T) {
+	var events []Event
+	client := NewClient(nil, WithObserver(ObserverFunc(func(_ context.Context, event Event) {
+		events = append(events, event)
+	})))
+
+	deleteErr := errors.New("locked")
+	client.emitCleanup(context.Background(), StepDeleteServer, "abcd1234", Resources{ServerID: 42}, nil)
+	client.emitCleanup(context.Background(), StepDeleteSSHKey, "abcd1234", Resources{SSHKeyID: 7}, deleteErr)
+
+	if len(events) != 2 {
+		t.Fatalf("observed %d events, want 2", len(events))
+	}
+	if e := events[0]; e.Type != EventStepFinished || e.Step != StepDeleteServer || e.Resources.ServerID != 42 || e.RunID != "abcd1234" {
+		t.Errorf("event 0 = %+v, want a finished server deletion", e)
+	}
+	if e := events[1]; e.Type != EventStepFailed || e.Step != StepDeleteSSHKey || !errors.Is(e.Err, deleteErr) {
+		t.Errorf("event 1 = %+v, want a failed ssh key deletion", e)
+	}
+
+	// Without an observer nothing is sent
+	NewClient(nil).emitCleanup(context.Background(), StepDeleteServer, "abcd1234", Resources{}, nil)
+}
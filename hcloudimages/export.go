@@ -0,0 +1,438 @@
+package hcloudimages
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/progress"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/qcow2"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/sshsession"
+)
+
+// sparseBlockSize is the size of the blocks that are checked for zeros when a raw image is written to a file. It
+// matches the block size of most file systems, so every skipped block is a hole.
+const sparseBlockSize = 4096
+
+// exportTools are the commands that the rescue system needs to read the disk.
+var exportTools = []string{"dd", "lsblk"}
+
+// ExportOptions are the options for [Client.Export].
+type ExportOptions struct {
+	// Image is the snapshot or backup that is exported.
+	Image *hcloud.Image
+
+	// Output receives the exported image. If it is an [*os.File] of a regular file, the image is written from the
+	// start of the file and any previous content is removed. Zero blocks of raw images are skipped, so they do not take
+	// any space in the file. Other writers, like pipes, receive every byte of the image.
+	Output io.Writer
+
+	// Compression of the exported image, [CompressionNone], [CompressionZSTD] or [CompressionXZ]. The image is
+	// compressed on the client.
+	Compression Compression
+
+	// Format of the exported image, [FormatRaw] or [FormatQCOW2]. Zero clusters of qcow2 images are not allocated.
+	// qcow2 images are written to a temporary file first, unless Output is a regular file and Compression is
+	// [CompressionNone], as the metadata is only known once the whole disk was read.
+	Format Format
+
+	// Progress is optionally called every second while the disk is read. [Progress.BytesRead] is the number of bytes
+	// read from the disk and [Progress.TotalBytes] the size of the disk.
+	Progress func(Progress)
+
+	// ServerType can be optionally set to override the default server type for the architecture of the image. The
+	// disk of the server type must be at least as large as the disk of the image.
+	ServerType *hcloud.ServerType
+
+	// Location is the datacenter location for the temporary server. Defaults to fsn1 if not specified.
+	Location *hcloud.Location
+
+	// DryRun resolves and validates all inputs and logs a [Plan] of the API calls and commands, without creating any
+	// resources or writing to Output.
+	DryRun bool
+
+	// DebugSkipResourceCleanup will skip the cleanup of the temporary SSH Key and Server.
+	DebugSkipResourceCleanup bool
+}
+
+// Export reads the disk of a snapshot or backup on Hetzner Cloud and writes it as a disk image to
+// [ExportOptions.Output].
+//
+// As the Hetzner Cloud API has no way to download images, we create a temporary server from the image, boot it into
+// the rescue system and stream the root disk back over SSH. The image on the disk is never booted.
+//
+// The temporary server costs money. If the export fails, we might be unable to delete the server. Check out
+// [Client.CleanupTempResources] for a helper in this case.
+func (s *Client) Export(ctx context.Context, options ExportOptions) (err error) {
+	if err := validateExportOptions(options); err != nil {
+		return err
+	}
+
+	image, _, err := s.c.Image.GetByID(ctx, options.Image.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get image %d: %w", options.Image.ID, err)
+	}
+	if image == nil {
+		return fmt.Errorf("image %d not found", options.Image.ID)
+	}
+	if image.Type != hcloud.ImageTypeSnapshot && image.Type != hcloud.ImageTypeBackup {
+		return fmt.Errorf("image %d is a %s image, only snapshots and backups can be exported", image.ID, image.Type)
+	}
+	if image.Status != hcloud.ImageStatusAvailable {
+		return fmt.Errorf("image %d is not available yet", image.ID)
+	}
+	options.Image = image
+
+	if options.DryRun {
+		plan, err := s.planExport(ctx, options)
+		if err != nil {
+			return err
+		}
+		plan.log(ctx)
+		return nil
+	}
+
+	ctx, r, err := s.newRun(ctx, "export")
+	if err != nil {
+		return err
+	}
+	defer r.closeJournal(ctx)
+	defer r.joinCleanupError(&err)
+	logger := contextlogger.From(ctx)
+
+	resourceName := resourcePrefix + r.id
+	tempLabels := r.tempLabels(DefaultLabels)
+	r.heartbeat = s.startHeartbeat(ctx, tempLabels)
+	defer r.heartbeat.stop()
+
+	// 1. Create SSH Key
+	key, privateKey, keyCleanup, err := s.generateSSHKey(ctx, r, 1, resourceName, tempLabels)
+	if err != nil {
+		return err
+	}
+	defer keyCleanup(options.DebugSkipResourceCleanup)
+
+	// 2. Create Server from the image
+	server, serverCleanup, err := s.createServer(ctx, r, 2, resourceName, tempLabels, key, image, image.Architecture, options.ServerType, options.Location, options.DebugSkipResourceCleanup)
+	if serverCleanup != nil {
+		defer serverCleanup()
+	}
+	if err != nil {
+		return err
+	}
+	logger = logger.With("server", server.ID)
+
+	// 3-5. Boot into the rescue system
+	sshClient, err := s.bootRescue(ctx, r, 3, server, key, privateKey)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = sshClient.Close() }()
+
+	// 6. Probe the rescue system, to find the root disk
+	st := r.startStep(ctx, 6, StepProbeRescue, "Probing rescue system")
+	rescue, err := s.probeRescueSystem(ctx, sshClient, exportTools, "")
+	if err != nil {
+		return st.fail(ctx, err)
+	}
+	logger.DebugContext(ctx, "probed rescue system",
+		"tools", rescue.Tools,
+		"missing-tools", rescue.Missing,
+		"target-device", rescue.TargetDevice,
+		"target-device-size", rescue.TargetDeviceSize,
+	)
+	var missing []string
+	for _, tool := range exportTools {
+		if slices.Contains(rescue.Missing, tool) {
+			missing = append(missing, tool)
+		}
+	}
+	if len(missing) > 0 {
+		return st.fail(ctx, fmt.Errorf("%w: %s is missing", ErrRescueSystem, strings.Join(missing, ", ")))
+	}
+	st.done(ctx)
+
+	// 7. SSH On Server: Read the disk, write the image on the client
+	st = r.startStep(ctx, 7, StepExportImage, "Reading disk and writing image")
+	cmd := exportCommand(rescue.TargetDevice)
+	logger.DebugContext(ctx, "running read disk command", "cmd", cmd)
+
+	bytesRead, err := streamExport(ctx, sshClient, cmd, options, rescue.TargetDeviceSize)
+	r.bytesTransferred = bytesRead
+	if err != nil {
+		return st.fail(ctx, err)
+	}
+	st.done(ctx)
+
+	logger.InfoContext(ctx, "# Image was exported", "image", image.ID, "bytes", bytesRead)
+
+	// Resource cleanup is happening in `defer`
+	return nil
+}
+
+// validateExportOptions checks the options that do not need the API.
+func validateExportOptions(options ExportOptions) error {
+	if options.Image == nil {
+		return fmt.Errorf("image must be set")
+	}
+	if options.Output == nil && !options.DryRun {
+		return fmt.Errorf("output must be set")
+	}
+
+	switch options.Compression {
+	case CompressionNone, CompressionZSTD, CompressionXZ:
+	default:
+		return fmt.Errorf("unsupported export compression: %q", options.Compression)
+	}
+
+	switch options.Format {
+	case FormatRaw, FormatQCOW2:
+	default:
+		return fmt.Errorf("unsupported export format: %q", options.Format)
+	}
+
+	return nil
+}
+
+// exportCommand returns the command that writes the disk to stdout.
+func exportCommand(device string) string {
+	return fmt.Sprintf("dd if=%s bs=4M", device)
+}
+
+// streamExport runs cmd on the rescue system and writes the disk of size bytes from its stdout to
+// [ExportOptions.Output]. It returns the number of bytes read from the disk.
+func streamExport(ctx context.Context, sshClient *ssh.Client, cmd string, options ExportOptions, size int64) (int64, error) {
+	output, finish, cleanup, err := exportOutput(options, size)
+	defer cleanup()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrExportImage, err)
+	}
+
+	// The session is closed if writing the image fails, so the rescue system does not wait for us to read the rest
+	streamCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	tracker := &progress.Tracker{}
+	stdout := tracker.Receiver(&cancelingWriter{w: output, cancel: cancel})
+	var stderr bytes.Buffer
+
+	stopProgress := func() {}
+	if options.Progress != nil {
+		stopProgress = startProgress(options.Progress, size, tracker, false)
+	}
+	err = sshsession.StreamOutput(streamCtx, sshClient, cmd, nil, stdout, &stderr)
+	stopProgress()
+
+	contextlogger.From(ctx).DebugContext(ctx, stderr.String())
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		return tracker.Read(), err
+	case err != nil && context.Cause(streamCtx) != nil:
+		return tracker.Read(), fmt.Errorf("%w: failed to write the image: %w", ErrExportImage, context.Cause(streamCtx))
+	case err != nil:
+		return tracker.Read(), fmt.Errorf("%w: failed to read the disk: %w: %s", ErrExportImage, err, strings.TrimSpace(stderr.String()))
+	case tracker.Read() != size:
+		return tracker.Read(), fmt.Errorf("%w: read %d bytes, but the disk has %d bytes", ErrExportImage, tracker.Read(), size)
+	}
+
+	if err := finish(); err != nil {
+		return tracker.Read(), fmt.Errorf("%w: failed to write the image: %w", ErrExportImage, err)
+	}
+	return tracker.Read(), nil
+}
+
+// exportOutput returns the writer that the raw disk of size bytes is written to. finish completes the image in
+// [ExportOptions.Output] once the whole disk was written, cleanup removes temporary files. cleanup is also returned with
+// an error.
+func exportOutput(options ExportOptions, size int64) (w io.Writer, finish func() error, cleanup func(), err error) {
+	cleanup = func() {}
+
+	file := regularFile(options.Output)
+	if file != nil {
+		// Skipped blocks must not contain any previous content of the file
+		if err := file.Truncate(0); err != nil {
+			return nil, nil, cleanup, err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, cleanup, err
+		}
+	}
+
+	if options.Format == FormatRaw {
+		switch {
+		case options.Compression != CompressionNone:
+			compressed, err := exportCompressor(options.Output, options.Compression)
+			if err != nil {
+				return nil, nil, cleanup, err
+			}
+			return compressed, compressed.Close, cleanup, nil
+		case file != nil:
+			sparse := &sparseWriter{file: file}
+			return sparse, sparse.Close, cleanup, nil
+		default:
+			return options.Output, func() error { return nil }, cleanup, nil
+		}
+	}
+
+	// qcow2 images need random access to write the metadata after the disk was read
+	if file != nil && options.Compression == CompressionNone {
+		image, err := qcow2.NewWriter(file, size)
+		if err != nil {
+			return nil, nil, cleanup, err
+		}
+		return image, image.Close, cleanup, nil
+	}
+
+	temp, err := os.CreateTemp("", "hcloud-upload-image-*.qcow2")
+	if err != nil {
+		return nil, nil, cleanup, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	cleanup = func() {
+		_ = temp.Close()
+		_ = os.Remove(temp.Name())
+	}
+
+	image, err := qcow2.NewWriter(temp, size)
+	if err != nil {
+		return nil, nil, cleanup, err
+	}
+
+	finish = func() error {
+		if err := image.Close(); err != nil {
+			return err
+		}
+		if _, err := temp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		if options.Compression == CompressionNone {
+			_, err := io.Copy(options.Output, temp)
+			return err
+		}
+
+		compressed, err := exportCompressor(options.Output, options.Compression)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(compressed, temp); err != nil {
+			_ = compressed.Close()
+			return err
+		}
+		return compressed.Close()
+	}
+
+	return image, finish, cleanup, nil
+}
+
+// exportCompressor returns a writer that compresses the image into w. Closing it does not close w.
+func exportCompressor(w io.Writer, compression Compression) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionZSTD:
+		return zstd.NewWriter(w)
+	case CompressionXZ:
+		return xz.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported export compression: %q", compression)
+	}
+}
+
+// regularFile returns w if it is a regular file, which supports writing at offsets and holes. Pipes and terminals
+// return nil.
+func regularFile(w io.Writer) *os.File {
+	file, ok := w.(*os.File)
+	if !ok {
+		return nil
+	}
+
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	return file
+}
+
+// sparseWriter writes a raw image to an empty file. Blocks that only contain zeros are skipped and stay holes in the
+// file.
+type sparseWriter struct {
+	file   *os.File
+	offset int64
+}
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// isZero reports whether p only contains zeros.
+func isZero(p []byte) bool {
+	for len(p) > 0 {
+		n := min(len(p), len(zeroBlock))
+		if !bytes.Equal(p[:n], zeroBlock[:n]) {
+			return false
+		}
+		p = p[n:]
+	}
+	return true
+}
+
+func (s *sparseWriter) Write(p []byte) (int, error) {
+	// Start of the data in p that is not written yet, or -1 if the last block was zero
+	start := -1
+
+	for i := 0; i < len(p); {
+		// Blocks are aligned to the offset in the file, so they match the blocks of the file system
+		n := min(len(p)-i, sparseBlockSize-int((s.offset+int64(i))%sparseBlockSize))
+		zero := bytes.Equal(p[i:i+n], zeroBlock[:n])
+
+		switch {
+		case !zero && start < 0:
+			start = i
+		case zero && start >= 0:
+			if _, err := s.file.WriteAt(p[start:i], s.offset+int64(start)); err != nil {
+				return start, err
+			}
+			start = -1
+		}
+		i += n
+	}
+
+	if start >= 0 {
+		if _, err := s.file.WriteAt(p[start:], s.offset+int64(start)); err != nil {
+			return start, err
+		}
+	}
+
+	s.offset += int64(len(p))
+	return len(p), nil
+}
+
+// Close extends the file to the size of the image, in case it ends with skipped blocks. It does not close the file.
+func (s *sparseWriter) Close() error {
+	return s.file.Truncate(s.offset)
+}
+
+// cancelingWriter cancels the SSH session if writing the image fails.
+type cancelingWriter struct {
+	w      io.Writer
+	cancel context.CancelCauseFunc
+}
+
+func (c *cancelingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		c.cancel(err)
+		return n, err
+	}
+	return n, nil
+}
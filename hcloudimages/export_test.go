@@ -0,0 +1,147 @@
+package hcloudimages
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/qcow2"
+)
+
+func TestExportOutput(t *testing.T) {
+	// Data, a hole of several blocks, data and a hole at the end
+	disk := make([]byte, 300*1024+100)
+	for i := range 5000 {
+		disk[i] = byte(i%251 + 1)
+	}
+	for i := 200 * 1024; i < 200*1024+7000; i++ {
+		disk[i] = byte(i%13 + 1)
+	}
+
+	tests := []struct {
+		name        string
+		file        bool
+		compression Compression
+		format      Format
+	}{
+		{name: "raw file", file: true},
+		{name: "raw stream"},
+		{name: "zstd stream", compression: CompressionZSTD},
+		{name: "xz file", file: true, compression: CompressionXZ},
+		{name: "qcow2 file", file: true, format: FormatQCOW2},
+		{name: "qcow2 stream", format: FormatQCOW2},
+		{name: "zstd qcow2 file", file: true, compression: CompressionZSTD, format: FormatQCOW2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			var output io.Writer = &buf
+
+			path := filepath.Join(t.TempDir(), "image")
+			if tt.file {
+				// Any previous content must be removed
+				if err := os.WriteFile(path, bytes.Repeat([]byte{0xff}, 2*len(disk)), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				file, err := os.OpenFile(path, os.O_RDWR, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() { _ = file.Close() }()
+				output = file
+			}
+
+			w, finish, cleanup, err := exportOutput(ExportOptions{Output: output, Compression: tt.compression, Format: tt.format}, int64(len(disk)))
+			defer cleanup()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Writes that are not aligned to the blocks
+			for chunk := range slices.Chunk(disk, 3000) {
+				if _, err := w.Write(chunk); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := finish(); err != nil {
+				t.Fatal(err)
+			}
+
+			image := buf.Bytes()
+			if tt.file {
+				image, err = os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var r io.Reader = bytes.NewReader(image)
+			switch tt.compression {
+			case CompressionZSTD:
+				zr, err := zstd.NewReader(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer zr.Close()
+				r = zr
+			case CompressionXZ:
+				r, err = xz.NewReader(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.format == FormatQCOW2 {
+				img, err := qcow2.Open(bytes.NewReader(got))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err = io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !bytes.Equal(got, disk) {
+				t.Errorf("exported image does not match the disk, got %d bytes, want %d", len(got), len(disk))
+			}
+		})
+	}
+}
+
+func TestValidateExportOptions(t *testing.T) {
+	image := &hcloud.Image{ID: 1}
+
+	tests := []struct {
+		name    string
+		options ExportOptions
+		wantErr bool
+	}{
+		{name: "raw", options: ExportOptions{Image: image, Output: io.Discard}},
+		{name: "zstd qcow2", options: ExportOptions{Image: image, Output: io.Discard, Compression: CompressionZSTD, Format: FormatQCOW2}},
+		{name: "dry run without output", options: ExportOptions{Image: image, DryRun: true}},
+		{name: "no image", options: ExportOptions{Output: io.Discard}, wantErr: true},
+		{name: "no output", options: ExportOptions{Image: image}, wantErr: true},
+		{name: "gzip", options: ExportOptions{Image: image, Output: io.Discard, Compression: CompressionGZIP}, wantErr: true},
+		{name: "vmdk", options: ExportOptions{Image: image, Output: io.Discard, Format: FormatVMDK}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateExportOptions(tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateExportOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
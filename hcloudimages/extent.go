@@ -0,0 +1,104 @@
+package hcloudimages
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+const (
+	// extentMaxLength limits how many bytes of an extent are buffered on the client before it is sent.
+	extentMaxLength = 32 * 1024 * 1024
+
+	// Printed by the command built in [extentCommand] if the stream from the client ended without the end record.
+	extentsIncompleteMessage = "extent stream ended early"
+)
+
+// extentCommand returns the command that applies the extents sent through an [extentWriter] to device. Every extent
+// starts with a line "<op> <offset> <length>". "w" is followed by length bytes that are written at offset, "z" discards
+// the range instead, which then reads as zeros like after the "blkdiscard" of a full write. "e" ends the stream,
+// without it the command fails, so a broken connection is not mistaken for a complete image.
+//
+// If decompress is set, the stream is piped through it first, see [decompressTransferCommand].
+func extentCommand(device, decompress string) string {
+	loop := "complete=0 && " +
+		`while read -r op offset length; do case "$op" in ` +
+		fmt.Sprintf("w) dd of=%s bs=4M iflag=fullblock,count_bytes oflag=seek_bytes conv=notrunc seek=$offset count=$length status=none ;; ", device) +
+		fmt.Sprintf("z) blkdiscard --force --offset $offset --length $length %s ;; ", device) +
+		"e) complete=1 && break ;; " +
+		`*) echo "unexpected extent: $op" >&2 && exit 1 ;; ` +
+		"esac; done && " +
+		fmt.Sprintf(`if [ "$complete" != "1" ]; then echo "%s" >&2; exit 1; fi`, extentsIncompleteMessage)
+	if decompress != "" {
+		// The loop runs in a subshell of the pipeline, the group keeps the check in it
+		loop = fmt.Sprintf("%s | { %s; }", decompress, loop)
+	}
+
+	return fmt.Sprintf("bash -c '%s'", "set -euo pipefail && "+loop+" && sync")
+}
+
+// extentWriter sends blocks of the disk as extents for [extentCommand]. Adjacent blocks with the same operation are
+// merged into one extent. It is not safe for concurrent use.
+type extentWriter struct {
+	w io.Writer
+
+	// The pending extent, op is 0 if there is none
+	op             byte
+	offset, length int64
+	data           bytes.Buffer
+}
+
+// write adds a block that is written at offset.
+func (e *extentWriter) write(offset int64, block []byte) error {
+	if err := e.extend('w', offset, int64(len(block))); err != nil {
+		return err
+	}
+	e.data.Write(block)
+	return nil
+}
+
+// discard adds a block of length bytes at offset that is discarded.
+func (e *extentWriter) discard(offset, length int64) error {
+	return e.extend('z', offset, length)
+}
+
+// extend adds the block to the pending extent, or sends the pending extent and starts a new one if the block does
+// not continue it.
+func (e *extentWriter) extend(op byte, offset, length int64) error {
+	if e.op != op || e.offset+e.length != offset || (op == 'w' && e.length >= extentMaxLength) {
+		if err := e.flush(); err != nil {
+			return err
+		}
+		e.op, e.offset = op, offset
+	}
+	e.length += length
+	return nil
+}
+
+// flush sends the pending extent.
+func (e *extentWriter) flush() error {
+	if e.op == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(e.w, "%c %d %d\n", e.op, e.offset, e.length); err != nil {
+		return err
+	}
+	if e.op == 'w' {
+		if _, err := e.w.Write(e.data.Bytes()); err != nil {
+			return err
+		}
+	}
+	e.op, e.length = 0, 0
+	e.data.Reset()
+	return nil
+}
+
+// close sends the pending extent and ends the stream. It must only be called once the whole image was read
+// successfully.
+func (e *extentWriter) close() error {
+	if err := e.flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(e.w, "e 0 0\n")
+	return err
+}
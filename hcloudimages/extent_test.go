@@ -0,0 +1,73 @@
+package hcloudimages
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestExtentWriter(t *testing.T) {
+	var stream bytes.Buffer
+	extents := &extentWriter{w: &stream}
+
+	steps := []func() error{
+		func() error { return extents.write(0, []byte("ab")) },
+		func() error { return extents.write(2, []byte("cd")) },
+		// Not adjacent
+		func() error { return extents.write(10, []byte("ef")) },
+		func() error { return extents.discard(12, 4) },
+		func() error { return extents.discard(16, 4) },
+		func() error { return extents.write(20, []byte("gh")) },
+		extents.close,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := "w 0 4\nabcdw 10 2\nefz 12 8\nw 20 2\ngh" + "e 0 0\n"
+	if got := stream.String(); got != want {
+		t.Errorf("extentWriter wrote %q, want %q", got, want)
+	}
+
+	disk := bytes.Repeat([]byte{'x'}, 22)
+	if err := applyExtents(disk, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(disk), "abcdxxxxxxef\x00\x00\x00\x00\x00\x00\x00\x00gh"; got != want {
+		t.Errorf("disk = %q, want %q", got, want)
+	}
+}
+
+// applyExtents writes the extents of the stream to disk, like the command of [extentCommand].
+func applyExtents(disk []byte, stream io.Reader) error {
+	r := bufio.NewReader(stream)
+	for {
+		var op byte
+		var offset, length int
+		if _, err := fmt.Fscanf(r, "%c %d %d\n", &op, &offset, &length); err != nil {
+			return err
+		}
+
+		switch op {
+		case 'w':
+			if _, err := io.ReadFull(r, disk[offset:offset+length]); err != nil {
+				return err
+			}
+		case 'z':
+			clear(disk[offset : offset+length])
+		case 'e':
+			if _, err := r.ReadByte(); !errors.Is(err, io.EOF) {
+				return fmt.Errorf("data after the end of the stream")
+			}
+			return nil
+		default:
+			return fmt.Errorf("unexpected extent %q", op)
+		}
+	}
+}
@@ -6,7 +6,9 @@ toolchain go1.26.4
 
 require (
 	github.com/hetznercloud/hcloud-go/v2 v2.40.0
+	github.com/klauspost/compress v1.18.0
 	github.com/stretchr/testify v1.11.1
+	github.com/ulikunitz/xz v0.5.15
 	golang.org/x/crypto v0.51.0
 )
 
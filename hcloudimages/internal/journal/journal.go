@@ -0,0 +1,200 @@
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/randomid"
+)
+
+type ResourceType string
+
+const (
+	ResourceServer ResourceType = "server"
+	ResourceSSHKey ResourceType = "ssh-key"
+	ResourceVolume ResourceType = "volume"
+)
+
+type Resource struct {
+	Type      ResourceType `json:"type"`
+	ID        int64        `json:"id"`
+	Name      string       `json:"name"`
+	CreatedAt time.Time    `json:"created_at"`
+	Deleted   bool         `json:"deleted"`
+}
+
+// State is the content of a journal file.
+type State struct {
+	RunID     string     `json:"run_id"`
+	Method    string     `json:"method"`
+	StartedAt time.Time  `json:"started_at"`
+	Resources []Resource `json:"resources"`
+}
+
+// Journal records the resources created by a single run in a file. Every change is written to the file immediately,
+// so the resources can still be found if the process crashes.
+//
+// All methods are safe to call on a nil Journal, they do nothing in that case.
+type Journal struct {
+	mu    sync.Mutex
+	path  string
+	state State
+}
+
+// Path returns the path of the journal file for runID in dir. runID must have the format of [randomid.Generate], so
+// the path can not point outside of dir.
+func Path(dir, runID string) (string, error) {
+	if !randomid.Valid(runID) {
+		return "", fmt.Errorf("invalid run id: %q", runID)
+	}
+	return filepath.Join(dir, runID+".json"), nil
+}
+
+// Create starts a new journal file for the run in dir.
+func Create(dir, runID, method string) (*Journal, error) {
+	path, err := Path(dir, runID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+
+	j := &Journal{
+		path: path,
+		state: State{
+			RunID:     runID,
+			Method:    method,
+			StartedAt: time.Now().UTC(),
+			Resources: []Resource{},
+		},
+	}
+
+	return j, j.save()
+}
+
+// Open reads an existing journal file.
+func Open(path string) (*Journal, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	j := &Journal{path: path}
+	if err := json.Unmarshal(content, &j.state); err != nil {
+		return nil, fmt.Errorf("failed to parse journal %q: %w", path, err)
+	}
+
+	return j, nil
+}
+
+func (j *Journal) Path() string {
+	if j == nil {
+		return ""
+	}
+	return j.path
+}
+
+func (j *Journal) RunID() string {
+	if j == nil {
+		return ""
+	}
+	return j.state.RunID
+}
+
+// Add records a newly created resource.
+func (j *Journal) Add(resourceType ResourceType, id int64, name string) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.state.Resources = append(j.state.Resources, Resource{
+		Type:      resourceType,
+		ID:        id,
+		Name:      name,
+		CreatedAt: time.Now().UTC(),
+	})
+
+	return j.save()
+}
+
+// MarkDeleted records that the resource was deleted.
+func (j *Journal) MarkDeleted(resourceType ResourceType, id int64) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for i, resource := range j.state.Resources {
+		if resource.Type == resourceType && resource.ID == id {
+			j.state.Resources[i].Deleted = true
+		}
+	}
+
+	return j.save()
+}
+
+// Pending returns all resources that were not deleted yet.
+func (j *Journal) Pending() []Resource {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	pending := make([]Resource, 0, len(j.state.Resources))
+	for _, resource := range j.state.Resources {
+		if !resource.Deleted {
+			pending = append(pending, resource)
+		}
+	}
+
+	return pending
+}
+
+// Remove deletes the journal file. It should be called once all resources are deleted.
+func (j *Journal) Remove() error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	err := os.Remove(j.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove journal: %w", err)
+	}
+	return nil
+}
+
+// save writes the state to a temporary file and renames it, so the journal is never left half-written.
+func (j *Journal) save() error {
+	content, err := json.MarshalIndent(j.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode journal: %w", err)
+	}
+
+	tmpPath := j.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0o600); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package journal
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := Create(dir, "abcd1234", "upload")
+	require.NoError(t, err)
+	path, err := Path(dir, "abcd1234")
+	require.NoError(t, err)
+	assert.Equal(t, path, j.Path())
+
+	require.NoError(t, j.Add(ResourceSSHKey, 1, "hcloud-upload-image-abcd1234"))
+	require.NoError(t, j.Add(ResourceServer, 2, "hcloud-upload-image-abcd1234"))
+	require.NoError(t, j.MarkDeleted(ResourceSSHKey, 1))
+
+	// Simulate a crash by reading the journal from disk
+	loaded, err := Open(j.Path())
+	require.NoError(t, err)
+	assert.Equal(t, "abcd1234", loaded.RunID())
+
+	pending := loaded.Pending()
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, ResourceServer, pending[0].Type)
+		assert.Equal(t, int64(2), pending[0].ID)
+	}
+
+	require.NoError(t, loaded.Remove())
+	_, err = Open(j.Path())
+	assert.Error(t, err)
+}
+
+func TestPath(t *testing.T) {
+	path, err := Path("/var/lib/journal", "abcd1234")
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/journal/abcd1234.json", filepath.ToSlash(path))
+
+	for _, runID := range []string{"", "../../etc/passwd", "abcd/123", "ABCD1234", "abcd12345", "abcd123\n"} {
+		_, err := Path("/var/lib/journal", runID)
+		assert.Error(t, err, "run id %q", runID)
+	}
+
+	_, err = Create(t.TempDir(), "../abcd1234", "upload")
+	assert.Error(t, err)
+}
+
+func TestNilJournal(t *testing.T) {
+	var j *Journal
+
+	assert.NoError(t, j.Add(ResourceServer, 1, "foo"))
+	assert.NoError(t, j.MarkDeleted(ResourceServer, 1))
+	assert.Empty(t, j.Pending())
+	assert.NoError(t, j.Remove())
+}
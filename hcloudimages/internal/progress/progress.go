@@ -0,0 +1,102 @@
+package progress
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Tracker counts the bytes that are read from the image and written to the disk.
+type Tracker struct {
+	read    atomic.Int64
+	written atomic.Int64
+
+	mu   sync.Mutex
+	line []byte
+}
+
+// Read returns the number of bytes read through [Tracker.Reader].
+func (t *Tracker) Read() int64 {
+	return t.read.Load()
+}
+
+// Add counts n bytes as read that are not read through [Tracker.Reader], e.g. holes of sparse files that are skipped.
+func (t *Tracker) Add(n int64) {
+	t.read.Add(n)
+}
+
+// Written returns the number of bytes that dd reported as copied.
+func (t *Tracker) Written() int64 {
+	return t.written.Load()
+}
+
+// Reader wraps r and counts all bytes read from it.
+func (t *Tracker) Reader(r io.Reader) io.Reader {
+	return &countingReader{r: r, n: &t.read}
+}
+
+// Write parses the output of "dd status=progress". dd separates its progress lines with carriage returns, every line
+// starts with the number of bytes copied so far. Any other output is ignored.
+func (t *Tracker) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, b := range p {
+		if b != '\r' && b != '\n' {
+			t.line = append(t.line, b)
+			continue
+		}
+
+		if n, ok := parseDDLine(t.line); ok {
+			t.written.Store(n)
+		}
+		t.line = t.line[:0]
+	}
+
+	return len(p), nil
+}
+
+// parseDDLine parses lines like "1073741824 bytes (1.1 GB, 1.0 GiB) copied, 5 s, 215 MB/s".
+func parseDDLine(line []byte) (int64, bool) {
+	number, rest, found := bytes.Cut(line, []byte(" bytes"))
+	if !found || !bytes.Contains(rest, []byte("copied")) {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(string(number), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// Receiver wraps w and counts all bytes written to it as read, for images that are received from the server instead
+// of sent to it.
+func (t *Tracker) Receiver(w io.Writer) io.Writer {
+	return &countingWriter{w: w, n: &t.read}
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
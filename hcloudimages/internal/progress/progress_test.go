@@ -0,0 +1,56 @@
+package progress
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackerWrite(t *testing.T) {
+	tracker := &Tracker{}
+
+	_, _ = io.WriteString(tracker, "104857600 bytes (105 MB, 100 MiB) copied, 1 s, 105 MB/s\r2097152")
+	assert.Equal(t, int64(104857600), tracker.Written())
+
+	// Lines can be split across multiple writes
+	_, _ = io.WriteString(tracker, "00 bytes (210 MB, 200 MiB) copied, 2 s, 105 MB/s\r")
+	assert.Equal(t, int64(209715200), tracker.Written())
+
+	// Summary at the end
+	_, _ = io.WriteString(tracker, "\n50+0 records in\n50+0 records out\n209715201 bytes (210 MB, 200 MiB) copied, 2.1 s, 100 MB/s\n")
+	assert.Equal(t, int64(209715201), tracker.Written())
+
+	_, _ = io.WriteString(tracker, "dd: error writing '/dev/sda': No space left on device\n")
+	assert.Equal(t, int64(209715201), tracker.Written())
+}
+
+func TestTrackerReader(t *testing.T) {
+	tracker := &Tracker{}
+
+	n, err := io.Copy(io.Discard, tracker.Reader(strings.NewReader("hello world")))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+	assert.Equal(t, int64(11), tracker.Read())
+}
+
+func TestTrackerAdd(t *testing.T) {
+	tracker := &Tracker{}
+
+	_, err := io.Copy(io.Discard, tracker.Reader(strings.NewReader("hello")))
+	assert.NoError(t, err)
+	tracker.Add(1024)
+	assert.Equal(t, int64(1029), tracker.Read())
+}
+
+func TestTrackerReceiver(t *testing.T) {
+	tracker := &Tracker{}
+
+	var buf strings.Builder
+	n, err := io.Copy(tracker.Receiver(&buf), strings.NewReader("hello world"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+	assert.Equal(t, "hello world", buf.String())
+	assert.Equal(t, int64(11), tracker.Read())
+}
@@ -0,0 +1,320 @@
+// Package qcow2 reads and writes the virtual disk of qcow2 images, so they can be converted from and to raw images
+// without qemu-img.
+//
+// Only standalone images are supported for reading: backing files, encryption, external data files and extended L2 entries
+// return an error. Compressed clusters are supported with deflate compression.
+//
+// See https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt for the format.
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Magic are the first bytes of every qcow2 image.
+var Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+var (
+	ErrNotQCOW2    = errors.New("not a qcow2 image")
+	ErrUnsupported = errors.New("unsupported qcow2 image")
+)
+
+const (
+	headerSizeV2 = 72
+	headerSizeV3 = 104
+
+	minClusterBits = 9
+	maxClusterBits = 21
+
+	// Same limit as in qemu, protects against huge allocations for broken images
+	maxL1Size = 32 * 1024 * 1024 / 8
+
+	// Incompatible feature bits
+	featureDirty            = 1 << 0
+	featureCorrupt          = 1 << 1
+	featureExternalDataFile = 1 << 2
+	featureCompressionType  = 1 << 3
+	featureExtendedL2       = 1 << 4
+
+	compressionDeflate = 0
+
+	// Bits 9-55 of L1 and L2 entries hold the offset in the image file
+	offsetMask = 0x00fffffffffffe00
+
+	l2Compressed = 1 << 62
+	l2Zero       = 1 << 0
+)
+
+type header struct {
+	Magic                 [4]byte
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+
+	// Version 3 only
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+}
+
+// Image is the virtual disk of a qcow2 image. It is not safe for concurrent use.
+type Image struct {
+	r           io.ReaderAt
+	version     uint32
+	size        int64
+	clusterBits uint32
+	clusterSize int64
+	l1          []uint64
+
+	// The last L2 table and compressed cluster that were read, conversions read the image sequentially.
+	l2Offset      uint64
+	l2            []uint64
+	clusterEntry  uint64
+	clusterBuffer []byte
+}
+
+// Open reads the header and L1 table of the qcow2 image in r.
+func Open(r io.ReaderAt) (*Image, error) {
+	buf := make([]byte, headerSizeV3+1)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	buf = buf[:n]
+
+	if len(buf) < headerSizeV2 || !bytes.Equal(buf[:4], Magic) {
+		return nil, ErrNotQCOW2
+	}
+
+	var h header
+	if err := binary.Read(bytes.NewReader(padHeader(buf)), binary.BigEndian, &h); err != nil {
+		return nil, fmt.Errorf("failed to parse header: %w", err)
+	}
+
+	switch h.Version {
+	case 2:
+		h.IncompatibleFeatures = 0
+	case 3:
+		if len(buf) < headerSizeV3 {
+			return nil, fmt.Errorf("%w: truncated header", ErrNotQCOW2)
+		}
+	default:
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupported, h.Version)
+	}
+
+	if err := h.validate(buf); err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		r:           r,
+		version:     h.Version,
+		size:        int64(h.Size),
+		clusterBits: h.ClusterBits,
+		clusterSize: int64(1) << h.ClusterBits,
+		l1:          make([]uint64, h.L1Size),
+	}
+
+	// Every L1 entry covers one L2 table, which covers clusterSize/8 clusters
+	l2Entries := uint64(img.clusterSize / 8)
+	if need := (h.Size + uint64(img.clusterSize)*l2Entries - 1) / (uint64(img.clusterSize) * l2Entries); uint64(h.L1Size) < need {
+		return nil, fmt.Errorf("%w: L1 table too small for virtual size", ErrNotQCOW2)
+	}
+
+	l1 := make([]byte, 8*int64(h.L1Size))
+	if _, err := r.ReadAt(l1, int64(h.L1TableOffset)); err != nil {
+		return nil, fmt.Errorf("failed to read L1 table: %w", err)
+	}
+	for i := range img.l1 {
+		img.l1[i] = binary.BigEndian.Uint64(l1[i*8:])
+	}
+
+	return img, nil
+}
+
+// padHeader makes sure that version 2 headers can be parsed into [header].
+func padHeader(buf []byte) []byte {
+	if len(buf) >= headerSizeV3 {
+		return buf[:headerSizeV3]
+	}
+	return append(buf[:len(buf):len(buf)], make([]byte, headerSizeV3-len(buf))...)
+}
+
+func (h *header) validate(buf []byte) error {
+	if h.ClusterBits < minClusterBits || h.ClusterBits > maxClusterBits {
+		return fmt.Errorf("%w: invalid cluster size 2^%d", ErrNotQCOW2, h.ClusterBits)
+	}
+	if h.BackingFileOffset != 0 {
+		return fmt.Errorf("%w: backing files are not supported", ErrUnsupported)
+	}
+	if h.CryptMethod != 0 {
+		return fmt.Errorf("%w: encrypted images are not supported", ErrUnsupported)
+	}
+	if h.L1Size > maxL1Size {
+		return fmt.Errorf("%w: L1 table too large", ErrNotQCOW2)
+	}
+	if h.Size > 1<<62 {
+		return fmt.Errorf("%w: invalid virtual size %d", ErrNotQCOW2, h.Size)
+	}
+
+	features := h.IncompatibleFeatures
+	if features&featureCorrupt != 0 {
+		return fmt.Errorf("%w: image is marked as corrupt", ErrUnsupported)
+	}
+	if features&featureExternalDataFile != 0 {
+		return fmt.Errorf("%w: external data files are not supported", ErrUnsupported)
+	}
+	if features&featureExtendedL2 != 0 {
+		return fmt.Errorf("%w: extended L2 entries are not supported", ErrUnsupported)
+	}
+	if features&featureCompressionType != 0 {
+		// The compression type is the first byte after the fixed v3 header
+		if h.HeaderLength <= headerSizeV3 || len(buf) <= headerSizeV3 {
+			return fmt.Errorf("%w: missing compression type", ErrNotQCOW2)
+		}
+		if compression := buf[headerSizeV3]; compression != compressionDeflate {
+			return fmt.Errorf("%w: compression type %d is not supported", ErrUnsupported, compression)
+		}
+	}
+	// The dirty bit only affects the refcounts, which we do not need for reading
+	if unknown := features &^ (featureDirty | featureCompressionType); unknown != 0 {
+		return fmt.Errorf("%w: unknown incompatible features %#x", ErrUnsupported, unknown)
+	}
+
+	return nil
+}
+
+// Size returns the size of the virtual disk in bytes.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+// ReadAt reads the virtual disk at off. Unallocated areas read as zeros.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("qcow2: negative offset")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		if off >= img.size {
+			return n, io.EOF
+		}
+
+		inCluster := off & (img.clusterSize - 1)
+		chunk := min(int64(len(p)), img.clusterSize-inCluster, img.size-off)
+
+		if err := img.readCluster(p[:chunk], off>>img.clusterBits, inCluster); err != nil {
+			return n, err
+		}
+
+		n += int(chunk)
+		off += chunk
+		p = p[chunk:]
+	}
+
+	return n, nil
+}
+
+// readCluster fills p with the data of the cluster at index, starting at inCluster.
+func (img *Image) readCluster(p []byte, index, inCluster int64) error {
+	entry, err := img.l2Entry(index)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case entry&l2Compressed != 0:
+		data, err := img.compressedCluster(entry)
+		if err != nil {
+			return err
+		}
+		copy(p, data[inCluster:])
+	case img.version >= 3 && entry&l2Zero != 0, entry&offsetMask == 0:
+		clear(p)
+	default:
+		n, err := img.r.ReadAt(p, int64(entry&offsetMask)+inCluster)
+		if errors.Is(err, io.EOF) && n < len(p) {
+			return fmt.Errorf("%w: data cluster beyond end of file", ErrNotQCOW2)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// l2Entry returns the L2 entry of the cluster at index, or 0 if no L2 table is allocated for it.
+func (img *Image) l2Entry(index int64) (uint64, error) {
+	l2Entries := img.clusterSize / 8
+	l1Index := index / l2Entries
+	if l1Index >= int64(len(img.l1)) {
+		return 0, nil
+	}
+
+	l2Offset := img.l1[l1Index] & offsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+
+	if l2Offset != img.l2Offset || img.l2 == nil {
+		buf := make([]byte, img.clusterSize)
+		if _, err := img.r.ReadAt(buf, int64(l2Offset)); err != nil {
+			return 0, fmt.Errorf("failed to read L2 table: %w", err)
+		}
+
+		img.l2 = make([]uint64, l2Entries)
+		for i := range img.l2 {
+			img.l2[i] = binary.BigEndian.Uint64(buf[i*8:])
+		}
+		img.l2Offset = l2Offset
+	}
+
+	return img.l2[index%l2Entries], nil
+}
+
+// compressedCluster returns the decompressed data of the cluster described by entry.
+func (img *Image) compressedCluster(entry uint64) ([]byte, error) {
+	if entry == img.clusterEntry && img.clusterBuffer != nil {
+		return img.clusterBuffer, nil
+	}
+
+	// The descriptor holds the offset in the lower x bits and the number of additional 512 byte sectors above
+	x := 62 - (img.clusterBits - 8)
+	offset := int64(entry & (1<<x - 1))
+	sectors := int64((entry>>x)&(1<<(img.clusterBits-8)-1)) + 1
+	compressedSize := sectors*512 - offset&511
+
+	compressed := make([]byte, compressedSize)
+	n, err := img.r.ReadAt(compressed, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read compressed cluster: %w", err)
+	}
+
+	data := make([]byte, img.clusterSize)
+	_, err = io.ReadFull(flate.NewReader(bytes.NewReader(compressed[:n])), data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decompress cluster: %w", ErrNotQCOW2, err)
+	}
+
+	img.clusterEntry = entry
+	img.clusterBuffer = data
+	return data, nil
+}
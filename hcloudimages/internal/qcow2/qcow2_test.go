@@ -0,0 +1,150 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testClusterBits = 16
+
+// testImage builds a qcow2 image with 64 KiB clusters and the following virtual disk:
+//
+//	cluster 0: data
+//	cluster 1: unallocated
+//	cluster 2: compressed data
+//	cluster 3: zero flag (version 3 only)
+//	cluster 4: half of a cluster with data
+//
+// It returns the image file and the expected virtual disk.
+func testImage(t *testing.T, version uint32) ([]byte, []byte) {
+	t.Helper()
+
+	clusterSize := 1 << testClusterBits
+	size := 4*clusterSize + clusterSize/2
+
+	pattern := func(seed byte) []byte {
+		data := make([]byte, clusterSize)
+		for i := range data {
+			data[i] = seed + byte(i%251)
+		}
+		return data
+	}
+
+	var compressed bytes.Buffer
+	w, err := flate.NewWriter(&compressed, flate.BestCompression)
+	require.NoError(t, err)
+	_, err = w.Write(pattern(2))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// File layout in clusters: header, L1, L2, data 0, data 4, compressed data 2
+	file := make([]byte, 5*clusterSize)
+	l1Offset := uint64(1 * clusterSize)
+	l2Offset := uint64(2 * clusterSize)
+	data0Offset := uint64(3 * clusterSize)
+	data4Offset := uint64(4 * clusterSize)
+	compressedOffset := uint64(5*clusterSize + 100)
+
+	h := header{
+		Version:       version,
+		ClusterBits:   testClusterBits,
+		Size:          uint64(size),
+		L1Size:        1,
+		L1TableOffset: l1Offset,
+	}
+	copy(h.Magic[:], Magic)
+	if version == 3 {
+		h.HeaderLength = headerSizeV3
+		h.RefcountOrder = 4
+	}
+	var hdr bytes.Buffer
+	require.NoError(t, binary.Write(&hdr, binary.BigEndian, h))
+	copy(file, hdr.Bytes())
+
+	binary.BigEndian.PutUint64(file[l1Offset:], l2Offset)
+
+	binary.BigEndian.PutUint64(file[l2Offset:], data0Offset)
+	x := 62 - (testClusterBits - 8)
+	sectors := (uint64(compressed.Len())+compressedOffset%512+511)/512 - 1
+	binary.BigEndian.PutUint64(file[l2Offset+2*8:], l2Compressed|sectors<<x|compressedOffset)
+	if version == 3 {
+		// Points at data 0, but must read as zeros
+		binary.BigEndian.PutUint64(file[l2Offset+3*8:], data0Offset|l2Zero)
+	}
+	binary.BigEndian.PutUint64(file[l2Offset+4*8:], data4Offset)
+
+	copy(file[data0Offset:], pattern(0))
+	copy(file[data4Offset:], pattern(4))
+
+	file = append(file, make([]byte, 100)...)
+	file = append(file, compressed.Bytes()...)
+
+	want := make([]byte, size)
+	copy(want, pattern(0))
+	copy(want[2*clusterSize:], pattern(2))
+	copy(want[4*clusterSize:], pattern(4))
+
+	return file, want
+}
+
+func TestImage(t *testing.T) {
+	for _, version := range []uint32{2, 3} {
+		file, want := testImage(t, version)
+
+		img, err := Open(bytes.NewReader(file))
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(want)), img.Size())
+
+		got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(want, got), "virtual disk of version %d does not match", version)
+
+		// Unaligned reads across cluster boundaries
+		buf := make([]byte, 1000)
+		n, err := img.ReadAt(buf, 2*(1<<testClusterBits)-500)
+		require.NoError(t, err)
+		assert.Equal(t, 1000, n)
+		assert.Equal(t, want[2*(1<<testClusterBits)-500:][:1000], buf)
+
+		n, err = img.ReadAt(buf, img.Size()-10)
+		assert.Equal(t, 10, n)
+		assert.ErrorIs(t, err, io.EOF)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	valid, _ := testImage(t, 3)
+
+	modify := func(f func(file []byte)) []byte {
+		file := bytes.Clone(valid)
+		f(file)
+		return file
+	}
+
+	tests := []struct {
+		name string
+		file []byte
+		want error
+	}{
+		{"empty", nil, ErrNotQCOW2},
+		{"raw", make([]byte, 512), ErrNotQCOW2},
+		{"version", modify(func(file []byte) { binary.BigEndian.PutUint32(file[4:], 4) }), ErrUnsupported},
+		{"backing file", modify(func(file []byte) { binary.BigEndian.PutUint64(file[8:], 512) }), ErrUnsupported},
+		{"encrypted", modify(func(file []byte) { binary.BigEndian.PutUint32(file[32:], 1) }), ErrUnsupported},
+		{"cluster size", modify(func(file []byte) { binary.BigEndian.PutUint32(file[20:], 30) }), ErrNotQCOW2},
+		{"extended l2", modify(func(file []byte) { binary.BigEndian.PutUint64(file[72:], featureExtendedL2) }), ErrUnsupported},
+		{"l1 too small", modify(func(file []byte) { binary.BigEndian.PutUint64(file[24:], 1<<40) }), ErrNotQCOW2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Open(bytes.NewReader(tt.file))
+			assert.ErrorIs(t, err, tt.want)
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// writerClusterBits is the cluster size of written images, 64 KiB like the default of qemu-img.
+	writerClusterBits = 16
+
+	// Refcounts of written images have 16 bits, the only width that version 2 images support as well.
+	writerRefcountOrder = 4
+
+	// Bit 63 of L1 and L2 entries marks clusters with a refcount of exactly one
+	flagCopied = 1 << 63
+)
+
+var ErrBeyondSize = errors.New("qcow2: write beyond the virtual size")
+
+// Writer writes a virtual disk sequentially into a new version 3 qcow2 image. Clusters that only contain zeros are not
+// allocated and take no space in the image. The header, L1 table and refcounts are written by [Writer.Close], the
+// image is not valid before. It is not safe for concurrent use.
+type Writer struct {
+	w           io.WriterAt
+	size        int64
+	clusterSize int64
+	l2Entries   int64
+
+	l1 []uint64
+
+	// The L2 table that the current clusters are added to, it is written once the next one is needed.
+	l2      []uint64
+	l2Index int64
+
+	// Virtual disk data of the current cluster
+	cluster  []byte
+	buffered int
+	written  int64
+
+	// Offset of the next free cluster in the image file
+	next int64
+}
+
+// NewWriter returns a [Writer] for a virtual disk of size bytes, which writes the image to w starting at offset 0.
+func NewWriter(w io.WriterAt, size int64) (*Writer, error) {
+	if size < 0 || size > 1<<62 {
+		return nil, fmt.Errorf("qcow2: invalid virtual size %d", size)
+	}
+
+	clusterSize := int64(1) << writerClusterBits
+	l2Entries := clusterSize / 8
+	l1Size := (size + clusterSize*l2Entries - 1) / (clusterSize * l2Entries)
+	l1Clusters := max((l1Size*8+clusterSize-1)/clusterSize, 1)
+
+	return &Writer{
+		w:           w,
+		size:        size,
+		clusterSize: clusterSize,
+		l2Entries:   l2Entries,
+		l1:          make([]uint64, l1Size),
+		l2Index:     -1,
+		cluster:     make([]byte, clusterSize),
+		// The header is in the first cluster, followed by the L1 table
+		next: (1 + l1Clusters) * clusterSize,
+	}, nil
+}
+
+// Write adds p to the virtual disk, after the data of all previous calls.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.written+int64(w.buffered)+int64(len(p)) > w.size {
+		return 0, ErrBeyondSize
+	}
+
+	n := 0
+	for len(p) > 0 {
+		copied := copy(w.cluster[w.buffered:], p)
+		w.buffered += copied
+		n += copied
+		p = p[copied:]
+
+		if w.buffered == len(w.cluster) {
+			if err := w.flushCluster(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// flushCluster allocates and writes the current cluster, unless it only contains zeros.
+func (w *Writer) flushCluster() error {
+	index := w.written / w.clusterSize
+	w.written += int64(w.buffered)
+	w.buffered = 0
+
+	if isZero(w.cluster) {
+		return nil
+	}
+
+	if l1Index := index / w.l2Entries; l1Index != w.l2Index {
+		if err := w.flushL2(); err != nil {
+			return err
+		}
+		w.l2 = make([]uint64, w.l2Entries)
+		w.l2Index = l1Index
+		w.l1[l1Index] = uint64(w.allocate()) | flagCopied
+	}
+
+	offset := w.allocate()
+	if _, err := w.w.WriteAt(w.cluster, offset); err != nil {
+		return err
+	}
+	w.l2[index%w.l2Entries] = uint64(offset) | flagCopied
+
+	return nil
+}
+
+// flushL2 writes the current L2 table, if there is one.
+func (w *Writer) flushL2() error {
+	if w.l2 == nil {
+		return nil
+	}
+
+	_, err := w.w.WriteAt(encodeTable(w.l2), int64(w.l1[w.l2Index]&offsetMask))
+	return err
+}
+
+// allocate returns the offset of the next free cluster in the image file.
+func (w *Writer) allocate() int64 {
+	offset := w.next
+	w.next += w.clusterSize
+	return offset
+}
+
+// Close writes the remaining data and the metadata of the image. The virtual disk after the written data reads as
+// zeros. Close does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.buffered > 0 {
+		// The last cluster might only be partially covered by the virtual disk
+		clear(w.cluster[w.buffered:])
+		if err := w.flushCluster(); err != nil {
+			return err
+		}
+	}
+	if err := w.flushL2(); err != nil {
+		return err
+	}
+
+	if _, err := w.w.WriteAt(encodeTable(w.l1), w.clusterSize); err != nil {
+		return err
+	}
+
+	refcountTableOffset, refcountTableClusters, err := w.writeRefcounts()
+	if err != nil {
+		return err
+	}
+
+	h := header{
+		Version:               3,
+		ClusterBits:           writerClusterBits,
+		Size:                  uint64(w.size),
+		L1Size:                uint32(len(w.l1)),
+		L1TableOffset:         uint64(w.clusterSize),
+		RefcountTableOffset:   uint64(refcountTableOffset),
+		RefcountTableClusters: uint32(refcountTableClusters),
+		RefcountOrder:         writerRefcountOrder,
+		HeaderLength:          headerSizeV3,
+	}
+	copy(h.Magic[:], Magic)
+
+	// The rest of the cluster stays zero, which ends the header extensions
+	hdr := bytes.NewBuffer(make([]byte, 0, w.clusterSize))
+	if err := binary.Write(hdr, binary.BigEndian, h); err != nil {
+		return err
+	}
+	hdr.Write(make([]byte, w.clusterSize-int64(hdr.Len())))
+	_, err = w.w.WriteAt(hdr.Bytes(), 0)
+	return err
+}
+
+// writeRefcounts writes the refcount table and blocks after all other clusters. Every cluster of the image, including
+// the refcount clusters themselves, has a refcount of one. It returns the offset of the refcount table and its size
+// in clusters.
+func (w *Writer) writeRefcounts() (int64, int64, error) {
+	used := w.next / w.clusterSize
+	perBlock := w.clusterSize * 8 / (1 << writerRefcountOrder)
+
+	// The refcount clusters need refcounts as well, so their number grows until it covers itself
+	total, blocks, tableClusters := used, int64(0), int64(0)
+	for {
+		blocks = (total + perBlock - 1) / perBlock
+		tableClusters = (blocks*8 + w.clusterSize - 1) / w.clusterSize
+		if used+blocks+tableClusters == total {
+			break
+		}
+		total = used + blocks + tableClusters
+	}
+
+	tableOffset := w.next
+	table := make([]uint64, tableClusters*w.clusterSize/8)
+	for i := range blocks {
+		table[i] = uint64(tableOffset + (tableClusters+i)*w.clusterSize)
+	}
+	if _, err := w.w.WriteAt(encodeTable(table), tableOffset); err != nil {
+		return 0, 0, err
+	}
+
+	block := make([]byte, w.clusterSize)
+	for i := range blocks {
+		clear(block)
+		for j := range min(perBlock, total-i*perBlock) {
+			binary.BigEndian.PutUint16(block[j*2:], 1)
+		}
+		if _, err := w.w.WriteAt(block, int64(table[i])); err != nil {
+			return 0, 0, err
+		}
+	}
+	w.next += (tableClusters + blocks) * w.clusterSize
+
+	return tableOffset, tableClusters, nil
+}
+
+func encodeTable(table []uint64) []byte {
+	buf := make([]byte, len(table)*8)
+	for i, entry := range table {
+		binary.BigEndian.PutUint64(buf[i*8:], entry)
+	}
+	return buf
+}
+
+var zeroCluster = make([]byte, 1<<writerClusterBits)
+
+func isZero(p []byte) bool {
+	for len(p) > 0 {
+		n := min(len(p), len(zeroCluster))
+		if !bytes.Equal(p[:n], zeroCluster[:n]) {
+			return false
+		}
+		p = p[n:]
+	}
+	return true
+}
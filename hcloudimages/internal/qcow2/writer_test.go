@@ -0,0 +1,110 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memFile is an in-memory [io.WriterAt] that grows as needed.
+type memFile struct {
+	data []byte
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func TestWriter(t *testing.T) {
+	clusterSize := 1 << writerClusterBits
+	// Spans two L2 tables and ends with half a cluster
+	size := 512*1024*1024 + 2*clusterSize + clusterSize/2
+
+	pattern := func(seed byte, n int) []byte {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = seed + byte(i%251)
+		}
+		return data
+	}
+
+	var file memFile
+	w, err := NewWriter(&file, int64(size))
+	require.NoError(t, err)
+
+	// Unaligned writes: data, zeros across the first L2 table, data in the second L2 table
+	first := pattern(1, clusterSize+100)
+	last := pattern(2, clusterSize+clusterSize/2)
+	zeros := size - len(first) - len(last)
+
+	_, err = w.Write(first)
+	require.NoError(t, err)
+	_, err = io.CopyN(w, zeroReader{}, int64(zeros))
+	require.NoError(t, err)
+	_, err = w.Write(last)
+	require.NoError(t, err)
+
+	_, err = w.Write([]byte{1})
+	assert.ErrorIs(t, err, ErrBeyondSize)
+	require.NoError(t, w.Close())
+
+	// Header, L1, 2 data and 1 L2 cluster per table, refcount table and block
+	assert.Len(t, file.data, (2+2*3+2)*clusterSize)
+
+	img, err := Open(bytes.NewReader(file.data))
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), img.Size())
+
+	got := make([]byte, len(first))
+	_, err = img.ReadAt(got, 0)
+	require.NoError(t, err)
+	assert.Equal(t, first, got)
+
+	got = make([]byte, len(last))
+	_, err = img.ReadAt(got, int64(size-len(last)))
+	require.NoError(t, err)
+	assert.Equal(t, last, got)
+
+	got = make([]byte, 3*clusterSize)
+	_, err = img.ReadAt(got, int64(len(first)))
+	require.NoError(t, err)
+	assert.True(t, isZero(got), "zero clusters do not read as zeros")
+
+	// Every cluster of the file is referenced exactly once
+	var h header
+	require.NoError(t, binary.Read(bytes.NewReader(file.data), binary.BigEndian, &h))
+	assert.Equal(t, uint32(writerRefcountOrder), h.RefcountOrder)
+	block := binary.BigEndian.Uint64(file.data[h.RefcountTableOffset:])
+	for i := range len(file.data) / clusterSize {
+		assert.Equal(t, uint16(1), binary.BigEndian.Uint16(file.data[block+uint64(i)*2:]), "refcount of cluster %d", i)
+	}
+	assert.Equal(t, uint16(0), binary.BigEndian.Uint16(file.data[block+uint64(len(file.data)/clusterSize)*2:]))
+}
+
+func TestWriterEmpty(t *testing.T) {
+	var file memFile
+	w, err := NewWriter(&file, 4096)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	img, err := Open(bytes.NewReader(file.data))
+	require.NoError(t, err)
+
+	got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, 4096), got)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
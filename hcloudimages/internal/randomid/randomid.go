@@ -8,8 +8,11 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"regexp"
 )
 
+var pattern = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
 func Generate() (string, error) {
 	b := make([]byte, 4)
 	_, err := rand.Read(b)
@@ -18,3 +21,9 @@ func Generate() (string, error) {
 	}
 	return hex.EncodeToString(b), nil
 }
+
+// Valid reports whether id has the format of the IDs returned by [Generate]. IDs from users must be checked before
+// they are used in file paths or label selectors.
+func Valid(id string) bool {
+	return pattern.MatchString(id)
+}
@@ -19,4 +19,14 @@ func TestGenerateRandomID(t *testing.T) {
 	assert.Len(t, found1, 8)
 	assert.Len(t, found2, 8)
 	assert.NotEqual(t, found1, found2)
+
+	assert.True(t, Valid(found1))
+	assert.True(t, Valid(found2))
+}
+
+func TestValid(t *testing.T) {
+	assert.True(t, Valid("abcd1234"))
+	for _, id := range []string{"", "abcd123", "abcd12345", "ABCD1234", "../abcd1", "abcd123\n", "abcd123g"} {
+		assert.False(t, Valid(id), "id %q", id)
+	}
 }
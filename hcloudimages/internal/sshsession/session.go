@@ -1,21 +1,70 @@
 package sshsession
 
 import (
+	"bytes"
+	"context"
 	"io"
+	"sync"
 
 	"golang.org/x/crypto/ssh"
 )
 
-func Run(client *ssh.Client, cmd string, stdin io.Reader) ([]byte, error) {
+func Run(ctx context.Context, client *ssh.Client, cmd string, stdin io.Reader) ([]byte, error) {
+	var output bytes.Buffer
+	err := Stream(ctx, client, cmd, stdin, &output)
+	return output.Bytes(), err
+}
+
+// Stream runs cmd like [Run], but writes the combined output to output while the command is running.
+//
+// If ctx is cancelled, the session is closed and Stream returns the context error.
+func Stream(ctx context.Context, client *ssh.Client, cmd string, stdin io.Reader, output io.Writer) error {
+	// Stdout and Stderr are copied in separate goroutines
+	w := &syncWriter{w: output}
+	return StreamOutput(ctx, client, cmd, stdin, w, w)
+}
+
+// StreamOutput runs cmd like [Stream], but writes stdout and stderr to separate writers, e.g. for commands that write
+// data to stdout. stdout and stderr are written to from different goroutines.
+func StreamOutput(ctx context.Context, client *ssh.Client, cmd string, stdin io.Reader, stdout, stderr io.Writer) error {
 	sess, err := client.NewSession()
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer func() { _ = sess.Close() }()
 
 	if stdin != nil {
 		sess.Stdin = stdin
 	}
-	return sess.CombinedOutput(cmd)
+
+	sess.Stdout = stdout
+	sess.Stderr = stderr
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = sess.Close()
+		case <-done:
+		}
+	}()
+
+	err = sess.Run(cmd)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
 }
@@ -0,0 +1,179 @@
+package hcloudimages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/journal"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/randomid"
+)
+
+// WithJournalDir enables the run journal. Every call to [Client.Upload] and [Client.WriteToDisk] writes a JSON file
+// named after its run ID into dir, that lists all temporary resources it created. The file is updated immediately
+// whenever a resource is created or deleted, and removed once all resources were deleted.
+//
+// If the process crashes or is killed, the leftover resources of the run can be removed with [Client.CleanupRun] or
+// [Client.CleanupJournal], without touching resources of other runs.
+func WithJournalDir(dir string) ClientOption {
+	return func(c *Client) {
+		c.journalDir = dir
+	}
+}
+
+// track records a created resource in the journal of the run. A failure to write the journal is logged, but does not
+// abort the run.
+func (r *run) track(ctx context.Context, resourceType journal.ResourceType, id int64, name string) {
+	if err := r.journal.Add(resourceType, id, name); err != nil {
+		contextlogger.From(ctx).WarnContext(ctx, "failed to add resource to journal", "error", err)
+	}
+}
+
+// untrack records a deleted resource in the journal of the run.
+func (r *run) untrack(ctx context.Context, resourceType journal.ResourceType, id int64) {
+	if err := r.journal.MarkDeleted(resourceType, id); err != nil {
+		contextlogger.From(ctx).WarnContext(ctx, "failed to mark resource as deleted in journal", "error", err)
+	}
+}
+
+// closeJournal removes the journal if all resources of the run were deleted. Otherwise, it is kept for a later
+// cleanup.
+func (r *run) closeJournal(ctx context.Context) {
+	if r.journal == nil {
+		return
+	}
+
+	logger := contextlogger.From(ctx)
+
+	if pending := r.journal.Pending(); len(pending) > 0 {
+		logger.InfoContext(ctx, "Keeping journal of temporary resources, remove them with the cleanup command", "journal", r.journal.Path())
+		return
+	}
+
+	if err := r.journal.Remove(); err != nil {
+		logger.WarnContext(ctx, "failed to remove journal", "error", err)
+	}
+}
+
+// CleanupRun deletes all temporary resources that the run with the ID runID left over. If a journal directory is set
+// through [WithJournalDir] and contains the journal of the run, the resources recorded in it are deleted first.
+// Afterward, any resources with the [RunIDLabel] of the run are deleted.
+func (s *Client) CleanupRun(ctx context.Context, runID string) error {
+	if !randomid.Valid(runID) {
+		return fmt.Errorf("invalid run id: %q", runID)
+	}
+
+	if s.journalDir != "" {
+		path, err := journal.Path(s.journalDir, runID)
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Stat(path)
+		switch {
+		case err == nil:
+			if err := s.CleanupJournal(ctx, path); err != nil {
+				return err
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return fmt.Errorf("failed to read journal: %w", err)
+		}
+	}
+
+	return s.CleanupTempResourcesWithOpts(ctx, CleanupOptions{RunID: runID})
+}
+
+// CleanupJournal deletes all temporary resources recorded in the journal file at path, that were not deleted yet.
+// Resources that no longer exist are skipped. The journal file is removed once all resources are deleted.
+//
+// Unlike [Client.CleanupTempResources], this only affects the resources of a single run.
+func (s *Client) CleanupJournal(ctx context.Context, path string) error {
+	j, err := journal.Open(path)
+	if err != nil {
+		return err
+	}
+
+	logger := contextlogger.From(ctx).With(
+		"library", "hcloudimages",
+		"method", "cleanup",
+		"run-id", j.RunID(),
+	)
+
+	pending := j.Pending()
+	if len(pending) == 0 {
+		logger.InfoContext(ctx, "No resources left in journal")
+	}
+
+	cleanupErr := &CleanupError{}
+	errs := []error{}
+	for _, resource := range pending {
+		logger := logger.With("type", resource.Type, "id", resource.ID)
+
+		var err error
+		var step StepID
+		var resources Resources
+		switch resource.Type {
+		case journal.ResourceServer:
+			step, resources = StepDeleteServer, Resources{ServerID: resource.ID}
+			err = s.deleteServer(ctx, resource.ID)
+		case journal.ResourceSSHKey:
+			step, resources = StepDeleteSSHKey, Resources{SSHKeyID: resource.ID}
+			_, err = s.c.SSHKey.Delete(ctx, &hcloud.SSHKey{ID: resource.ID})
+		case journal.ResourceVolume:
+			step, resources = StepDeleteVolume, Resources{VolumeID: resource.ID}
+			err = s.deleteVolume(ctx, &hcloud.Volume{ID: resource.ID})
+		default:
+			err = fmt.Errorf("unknown resource type %q", resource.Type)
+		}
+
+		if err != nil && !hcloud.IsError(err, hcloud.ErrorCodeNotFound) {
+			logger.WarnContext(ctx, "failed to delete resource", "error", err)
+			switch resource.Type {
+			case journal.ResourceServer:
+				cleanupErr.addServer(resource.ID, err)
+			case journal.ResourceSSHKey:
+				cleanupErr.addSSHKey(resource.ID, err)
+			case journal.ResourceVolume:
+				cleanupErr.addVolume(resource.ID, err)
+			default:
+				errs = append(errs, fmt.Errorf("failed to delete %s %d: %w", resource.Type, resource.ID, err))
+			}
+			if step != "" {
+				s.emitCleanup(ctx, step, j.RunID(), resources, err)
+			}
+			continue
+		}
+
+		if err == nil {
+			s.emitCleanup(ctx, step, j.RunID(), resources, nil)
+		}
+
+		logger.InfoContext(ctx, "Deleted resource")
+		if err := j.MarkDeleted(resource.Type, resource.ID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if cleanupErr.Err != nil {
+		errs = append(errs, cleanupErr)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	return j.Remove()
+}
+
+// deleteServer deletes the server and waits until it is gone.
+func (s *Client) deleteServer(ctx context.Context, id int64) error {
+	result, _, err := s.c.Server.DeleteWithResult(ctx, &hcloud.Server{ID: id})
+	if err != nil {
+		return err
+	}
+
+	return s.c.Action.WaitFor(ctx, result.Action)
+}
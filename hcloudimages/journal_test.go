@@ -0,0 +1,30 @@
+package hcloudimages
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanupRunInvalidID(t *testing.T) {
+	dir := t.TempDir()
+	// A file outside of the journal directory, which must not be read
+	outside := filepath.Join(filepath.Dir(dir), "outside.json")
+	if err := os.WriteFile(outside, []byte(`{"run_id": "abcd1234", "resources": []}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(outside) }()
+
+	// Without an API client, any request would panic
+	client := NewClient(nil, WithJournalDir(dir))
+
+	for _, runID := range []string{"../outside", "abcd1234,foo=bar", ""} {
+		if err := client.CleanupRun(context.Background(), runID); err == nil {
+			t.Errorf("CleanupRun(%q) succeeded, want an error", runID)
+		}
+	}
+	if err := client.CleanupTempResourcesWithOpts(context.Background(), CleanupOptions{RunID: "abcd1234,foo=bar"}); err == nil {
+		t.Errorf("CleanupTempResourcesWithOpts() with an invalid run id succeeded, want an error")
+	}
+}
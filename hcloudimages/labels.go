@@ -0,0 +1,231 @@
+package hcloudimages
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
+)
+
+const (
+	// RunIDLabel is set on all temporary resources and contains the ID of the run that created them.
+	RunIDLabel = "apricote.de/run-id"
+
+	// CreatedAtLabel is set on all temporary resources and contains the unix timestamp of their creation.
+	CreatedAtLabel = "apricote.de/created-at"
+
+	// HeartbeatLabel is set on all temporary resources and contains a unix timestamp. It is updated every
+	// [heartbeatInterval] while the run that created them is still active.
+	HeartbeatLabel = "apricote.de/heartbeat"
+)
+
+var (
+	heartbeatInterval = 1 * time.Minute
+
+	// A run is considered active if its heartbeat is more recent than this.
+	heartbeatTimeout = 5 * time.Minute
+)
+
+// tempLabels returns the labels for the temporary resources of the run.
+func (r *run) tempLabels(labels map[string]string) map[string]string {
+	result := maps.Clone(labels)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	result[RunIDLabel] = r.id
+	result[CreatedAtLabel] = now
+	result[HeartbeatLabel] = now
+
+	return result
+}
+
+// heartbeat periodically updates the [HeartbeatLabel] of the temporary resources of a run, so
+// [Client.CleanupTempResourcesWithOpts] can tell active runs apart from crashed ones.
+//
+// All methods are safe to call on a nil heartbeat.
+type heartbeat struct {
+	client *hcloud.Client
+	labels map[string]string
+
+	mu      sync.Mutex
+	sshKeys []*hcloud.SSHKey
+	servers []*hcloud.Server
+	volumes []*hcloud.Volume
+
+	stopOnce sync.Once
+	quit     chan struct{}
+	stopped  chan struct{}
+}
+
+func (s *Client) startHeartbeat(ctx context.Context, labels map[string]string) *heartbeat {
+	hb := &heartbeat{
+		client:  s.c,
+		labels:  maps.Clone(labels),
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(hb.stopped)
+
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				hb.beat(ctx)
+			case <-hb.quit:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return hb
+}
+
+func (hb *heartbeat) addSSHKey(key *hcloud.SSHKey) {
+	if hb == nil {
+		return
+	}
+
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	hb.sshKeys = append(hb.sshKeys, key)
+}
+
+func (hb *heartbeat) addServer(server *hcloud.Server) {
+	if hb == nil {
+		return
+	}
+
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	hb.servers = append(hb.servers, server)
+}
+
+func (hb *heartbeat) addVolume(volume *hcloud.Volume) {
+	if hb == nil {
+		return
+	}
+
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	hb.volumes = append(hb.volumes, volume)
+}
+
+// removeVolume stops updating the volume, because it is deleted before the end of the run.
+func (hb *heartbeat) removeVolume(volume *hcloud.Volume) {
+	if hb == nil {
+		return
+	}
+
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	hb.volumes = slices.DeleteFunc(hb.volumes, func(v *hcloud.Volume) bool { return v.ID == volume.ID })
+}
+
+// beat updates the labels of all resources. Errors are only logged, as the next beat might succeed.
+func (hb *heartbeat) beat(ctx context.Context) {
+	logger := contextlogger.From(ctx)
+
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	hb.labels[HeartbeatLabel] = strconv.FormatInt(time.Now().Unix(), 10)
+
+	for _, key := range hb.sshKeys {
+		_, _, err := hb.client.SSHKey.Update(ctx, key, hcloud.SSHKeyUpdateOpts{Labels: hb.labels})
+		if err != nil {
+			logger.DebugContext(ctx, "failed to update heartbeat of ssh key", "ssh-key", key.ID, "error", err)
+		}
+	}
+
+	for _, server := range hb.servers {
+		_, _, err := hb.client.Server.Update(ctx, server, hcloud.ServerUpdateOpts{Labels: hb.labels})
+		if err != nil {
+			logger.DebugContext(ctx, "failed to update heartbeat of server", "server", server.ID, "error", err)
+		}
+	}
+
+	for _, volume := range hb.volumes {
+		_, _, err := hb.client.Volume.Update(ctx, volume, hcloud.VolumeUpdateOpts{Labels: hb.labels})
+		if err != nil {
+			logger.DebugContext(ctx, "failed to update heartbeat of volume", "volume", volume.ID, "error", err)
+		}
+	}
+}
+
+// stop ends the heartbeat. It must be called before the resources are deleted. It is safe to call multiple times.
+func (hb *heartbeat) stop() {
+	if hb == nil {
+		return
+	}
+
+	hb.stopOnce.Do(func() {
+		close(hb.quit)
+		<-hb.stopped
+	})
+}
+
+// CleanupOptions limit which resources are deleted by [Client.CleanupTempResourcesWithOpts].
+type CleanupOptions struct {
+	// OlderThan only deletes resources that were created at least this long ago.
+	OlderThan time.Duration
+
+	// RunID only deletes the resources of the run with this ID.
+	RunID string
+
+	// IgnoreActive skips resources whose [HeartbeatLabel] was updated recently, as their run is most likely still in
+	// progress. Resources created by older versions do not have this label and are always deleted.
+	IgnoreActive bool
+
+	// DryRun only logs the resources that would be deleted.
+	DryRun bool
+}
+
+// shouldCleanup decides if a resource with the given labels and creation time is deleted.
+func shouldCleanup(labels map[string]string, created time.Time, opts CleanupOptions, now time.Time) bool {
+	if opts.RunID != "" && labels[RunIDLabel] != opts.RunID {
+		return false
+	}
+
+	if opts.OlderThan > 0 {
+		if createdAt, ok := parseUnixLabel(labels, CreatedAtLabel); ok {
+			created = createdAt
+		}
+
+		if now.Sub(created) < opts.OlderThan {
+			return false
+		}
+	}
+
+	if opts.IgnoreActive {
+		if lastHeartbeat, ok := parseUnixLabel(labels, HeartbeatLabel); ok && now.Sub(lastHeartbeat) < heartbeatTimeout {
+			return false
+		}
+	}
+
+	return true
+}
+
+func parseUnixLabel(labels map[string]string, key string) (time.Time, bool) {
+	value, ok := labels[key]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(seconds, 0), true
+}
@@ -0,0 +1,82 @@
+package hcloudimages
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShouldCleanup(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	unix := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).Unix(), 10) }
+
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		created time.Time
+		opts    CleanupOptions
+		want    bool
+	}{
+		{
+			name:   "no options",
+			labels: map[string]string{},
+			want:   true,
+		},
+		{
+			name:   "matching run id",
+			labels: map[string]string{RunIDLabel: "abcd1234"},
+			opts:   CleanupOptions{RunID: "abcd1234"},
+			want:   true,
+		},
+		{
+			name:   "other run id",
+			labels: map[string]string{RunIDLabel: "ffff0000"},
+			opts:   CleanupOptions{RunID: "abcd1234"},
+			want:   false,
+		},
+		{
+			name:   "older than from label",
+			labels: map[string]string{CreatedAtLabel: unix(-2 * time.Hour)},
+			opts:   CleanupOptions{OlderThan: time.Hour},
+			want:   true,
+		},
+		{
+			name:   "too new from label",
+			labels: map[string]string{CreatedAtLabel: unix(-30 * time.Minute)},
+			opts:   CleanupOptions{OlderThan: time.Hour},
+			want:   false,
+		},
+		{
+			name:    "older than from creation time",
+			labels:  map[string]string{},
+			created: now.Add(-2 * time.Hour),
+			opts:    CleanupOptions{OlderThan: time.Hour},
+			want:    true,
+		},
+		{
+			name:   "active heartbeat",
+			labels: map[string]string{HeartbeatLabel: unix(-time.Minute)},
+			opts:   CleanupOptions{IgnoreActive: true},
+			want:   false,
+		},
+		{
+			name:   "stale heartbeat",
+			labels: map[string]string{HeartbeatLabel: unix(-time.Hour)},
+			opts:   CleanupOptions{IgnoreActive: true},
+			want:   true,
+		},
+		{
+			name:   "no heartbeat",
+			labels: map[string]string{},
+			opts:   CleanupOptions{IgnoreActive: true},
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldCleanup(tt.labels, tt.created, tt.opts, now); got != tt.want {
+				t.Errorf("shouldCleanup() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
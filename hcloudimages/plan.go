@@ -0,0 +1,556 @@
+package hcloudimages
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/labelutil"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/randomid"
+)
+
+// Plan describes what a call to [Client.Upload], [Client.WriteToDisk], [Client.WriteToVolume] or [Client.Export] would
+// do if [WriteOptions.DryRun] or [ExportOptions.DryRun] is set.
+type Plan struct {
+	// ServerType is the name of the server type for the temporary server. Empty for [Client.WriteToDisk].
+	ServerType string
+
+	// Location is the name of the location of the temporary server. Empty for [Client.WriteToDisk].
+	Location string
+
+	// Source describes where the image is read from.
+	Source string
+
+	// ImageCompression and ImageFormat of the image, after [CompressionAuto] and [FormatAuto] were resolved. For
+	// [Client.Export], of the exported image.
+	ImageCompression Compression
+	ImageFormat      Format
+
+	// Command is the command that would run on the rescue system to write the image, or to read the disk for
+	// [Client.Export].
+	Command string
+
+	Steps []PlannedStep
+}
+
+// PlannedStep is a single step of a [Plan].
+type PlannedStep struct {
+	// Number of the step, as it is shown in the logs. Cleanup steps have no number and use 0.
+	Number int
+
+	Step StepID
+
+	// Description of what the step does, including the names of resources that would be created or deleted.
+	Description string
+
+	// Operation is the API call or command that the step would use, e.g. "POST /servers" or "ssh: shutdown now".
+	Operation string
+}
+
+// log prints the plan through the logger in ctx.
+func (p *Plan) log(ctx context.Context) {
+	logger := contextlogger.From(ctx)
+
+	logger.InfoContext(ctx, "# Dry run: no resources will be created or changed",
+		"source", p.Source,
+		"compression", describeCompression(p.ImageCompression),
+		"format", describeFormat(p.ImageFormat),
+	)
+	for _, step := range p.Steps {
+		message := "Cleanup (dry run): " + step.Description
+		if step.Number > 0 {
+			message = fmt.Sprintf("# Step %d (dry run): %s", step.Number, step.Description)
+		}
+		logger.InfoContext(ctx, message, "operation", step.Operation)
+	}
+}
+
+func (s *Client) planUpload(ctx context.Context, options UploadOptions) (*Plan, error) {
+	id, err := randomid.Generate()
+	if err != nil {
+		return nil, err
+	}
+	resourceName := resourcePrefix + id
+
+	if err := validateTargetDevice(options.TargetDevice); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+
+	serverImage := defaultImage.Name
+	if options.BaseImage != nil {
+		options, err = s.getBaseImage(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+		options.Processing = ProcessingClient
+		serverImage = fmt.Sprintf("%d, the base image", options.BaseImage.ID)
+	}
+
+	if err := s.planServer(ctx, plan, options.Architecture, options.ServerType, options.Location); err != nil {
+		return nil, err
+	}
+
+	labels := labelutil.Merge(DefaultLabels, options.Labels)
+
+	plan.Steps = append(plan.Steps,
+		PlannedStep{
+			Number:      1,
+			Step:        StepGenerateSSHKey,
+			Description: fmt.Sprintf("Create temporary ssh key %q", resourceName),
+			Operation:   "POST /ssh_keys",
+		},
+		PlannedStep{
+			Number: 2,
+			Step:   StepCreateServer,
+			Description: fmt.Sprintf("Create temporary server %q (server type %s, location %s, image %s)",
+				resourceName, plan.ServerType, plan.Location, serverImage,
+			),
+			Operation: "POST /servers",
+		},
+	)
+
+	next, err := s.planWrite(ctx, plan, options.WriteOptions, options.BaseImage != nil, 3, resourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.Steps = append(plan.Steps,
+		PlannedStep{
+			Number:      next,
+			Step:        StepCreateImage,
+			Description: fmt.Sprintf("Create snapshot with labels %q", labelutil.Selector(labels)),
+			Operation:   "POST /servers/{id}/actions/create_image",
+		},
+	)
+
+	if !options.DebugSkipResourceCleanup {
+		plan.Steps = append(plan.Steps,
+			PlannedStep{
+				Step:        StepDeleteServer,
+				Description: fmt.Sprintf("Delete temporary server %q", resourceName),
+				Operation:   "DELETE /servers/{id}",
+			},
+			PlannedStep{
+				Step:        StepDeleteSSHKey,
+				Description: fmt.Sprintf("Delete temporary ssh key %q", resourceName),
+				Operation:   "DELETE /ssh_keys/{id}",
+			},
+		)
+	}
+
+	return plan, nil
+}
+
+// planServer resolves the server type and location of the temporary server for the plan.
+func (s *Client) planServer(ctx context.Context, plan *Plan, architecture hcloud.Architecture, serverType *hcloud.ServerType, location *hcloud.Location) error {
+	// Server Type
+	if serverType == nil {
+		var ok bool
+		serverType, ok = serverTypePerArchitecture[architecture]
+		if !ok {
+			return fmt.Errorf("unknown architecture %q, valid options: %q, %q", architecture, hcloud.ArchitectureX86, hcloud.ArchitectureARM)
+		}
+	}
+	resolvedServerType, _, err := s.c.ServerType.Get(ctx, serverType.Name)
+	if err != nil {
+		return fmt.Errorf("failed to get server type %q: %w", serverType.Name, err)
+	}
+	if resolvedServerType == nil {
+		return fmt.Errorf("server type %q not found", serverType.Name)
+	}
+	plan.ServerType = resolvedServerType.Name
+
+	// Location
+	if location == nil {
+		location = defaultLocation
+	}
+	resolvedLocation, _, err := s.c.Location.Get(ctx, location.Name)
+	if err != nil {
+		return fmt.Errorf("failed to get location %q: %w", location.Name, err)
+	}
+	if resolvedLocation == nil {
+		return fmt.Errorf("location %q not found", location.Name)
+	}
+	plan.Location = resolvedLocation.Name
+
+	return nil
+}
+
+func (s *Client) planWriteToDisk(ctx context.Context, options WriteOptions) (*Plan, error) {
+	id, err := randomid.Generate()
+	if err != nil {
+		return nil, err
+	}
+	resourceName := resourcePrefix + id
+
+	if err := validateTargetDevice(options.TargetDevice); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+
+	plan.Steps = append(plan.Steps,
+		PlannedStep{
+			Number:      1,
+			Step:        StepGenerateSSHKey,
+			Description: fmt.Sprintf("Create temporary ssh key %q", resourceName),
+			Operation:   "POST /ssh_keys",
+		},
+		PlannedStep{
+			Number:      2,
+			Step:        StepPowerOffServer,
+			Description: fmt.Sprintf("Shut down server %q (%d)", options.Server.Name, options.Server.ID),
+			Operation:   fmt.Sprintf("POST /servers/%d/actions/poweroff", options.Server.ID),
+		},
+	)
+
+	_, err = s.planWrite(ctx, plan, options, false, 3, options.Server.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.Steps = append(plan.Steps,
+		PlannedStep{
+			Step:        StepDeleteSSHKey,
+			Description: fmt.Sprintf("Delete temporary ssh key %q", resourceName),
+			Operation:   "DELETE /ssh_keys/{id}",
+		},
+	)
+
+	return plan, nil
+}
+
+func (s *Client) planWriteToVolume(ctx context.Context, options WriteToVolumeOptions) (*Plan, error) {
+	id, err := randomid.Generate()
+	if err != nil {
+		return nil, err
+	}
+	resourceName := resourcePrefix + id
+
+	plan := &Plan{}
+
+	if err := s.planServer(ctx, plan, options.Architecture, options.ServerType, options.Location); err != nil {
+		return nil, err
+	}
+
+	plan.Steps = append(plan.Steps,
+		PlannedStep{
+			Number:      1,
+			Step:        StepGenerateSSHKey,
+			Description: fmt.Sprintf("Create temporary ssh key %q", resourceName),
+			Operation:   "POST /ssh_keys",
+		},
+		PlannedStep{
+			Number: 2,
+			Step:   StepCreateServer,
+			Description: fmt.Sprintf("Create temporary server %q (server type %s, location %s, image %s)",
+				resourceName, plan.ServerType, plan.Location, defaultImage.Name,
+			),
+			Operation: "POST /servers",
+		},
+	)
+
+	if options.Volume != nil {
+		options.TargetDevice = volumeDevice(options.Volume)
+		plan.Steps = append(plan.Steps, PlannedStep{
+			Number:      3,
+			Step:        StepAttachVolume,
+			Description: fmt.Sprintf("Attach volume %q (%d) to server %q", options.Volume.Name, options.Volume.ID, resourceName),
+			Operation:   fmt.Sprintf("POST /volumes/%d/actions/attach", options.Volume.ID),
+		})
+	} else {
+		name := options.VolumeName
+		if name == "" {
+			name = resourceName
+		}
+		options.TargetDevice = "/dev/disk/by-id/scsi-0HC_Volume_{id}"
+		plan.Steps = append(plan.Steps, PlannedStep{
+			Number: 3,
+			Step:   StepCreateVolume,
+			Description: fmt.Sprintf("Create %d GB volume %q with labels %q attached to server %q",
+				options.VolumeSize, name, labelutil.Selector(options.Labels), resourceName,
+			),
+			Operation: "POST /volumes",
+		})
+	}
+
+	next, err := s.planWrite(ctx, plan, options.WriteOptions, false, 4, resourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.Steps = append(plan.Steps,
+		PlannedStep{
+			Number:      next,
+			Step:        StepDetachVolume,
+			Description: "Detach volume",
+			Operation:   "POST /volumes/{id}/actions/detach",
+		},
+	)
+
+	if !options.DebugSkipResourceCleanup {
+		plan.Steps = append(plan.Steps,
+			PlannedStep{
+				Step:        StepDeleteServer,
+				Description: fmt.Sprintf("Delete temporary server %q", resourceName),
+				Operation:   "DELETE /servers/{id}",
+			},
+			PlannedStep{
+				Step:        StepDeleteSSHKey,
+				Description: fmt.Sprintf("Delete temporary ssh key %q", resourceName),
+				Operation:   "DELETE /ssh_keys/{id}",
+			},
+		)
+	}
+
+	return plan, nil
+}
+
+// planWrite adds the steps of [Client.write] to the plan and returns the number of the next step.
+func (s *Client) planWrite(ctx context.Context, plan *Plan, options WriteOptions, delta bool, initialStep int, serverName string) (int, error) {
+	source, err := describeSource(ctx, options)
+	if err != nil {
+		return 0, err
+	}
+
+	options, err = detectImage(ctx, options)
+	if err != nil {
+		return 0, err
+	}
+	plan.ImageCompression = options.ImageCompression
+	plan.ImageFormat = options.ImageFormat
+
+	if options.ArchiveMember != "" {
+		source += fmt.Sprintf(", archive member %q", options.ArchiveMember)
+	}
+	switch {
+	case options.Processing == ProcessingClient:
+		source += ", processed on the client"
+		options = convertedOptions(options, options.ImageReader, 0)
+	case options.Processing == ProcessingRescue:
+	case options.Processing != ProcessingAuto:
+		return 0, fmt.Errorf("unknown processing: %q", options.Processing)
+	case convertOnClient(options, stagingLimit(options, nil)):
+		source += ", converted from qcow2 to raw on the client"
+		options = convertedOptions(options, options.ImageReader, 0)
+	}
+	if err := validateTransferCompression(options.TransferCompression); err != nil {
+		return 0, err
+	}
+	if compressTransfer(options) {
+		source += fmt.Sprintf(", compressed with %s for the transfer", options.TransferCompression)
+	}
+	plan.Source = source
+
+	// The root disk is only detected once the rescue system is running
+	env := rescueEnvironment{TargetDevice: "{root-disk}"}
+	if options.TargetDevice != "" {
+		env.TargetDevice = options.TargetDevice
+	}
+
+	if useScratchVolume(options) {
+		env.ScratchDevice = "/dev/disk/by-id/scsi-0HC_Volume_{id}"
+		plan.Steps = append(plan.Steps, PlannedStep{
+			Number:      initialStep,
+			Step:        StepCreateVolume,
+			Description: fmt.Sprintf("Create temporary %d GB scratch volume attached to server %q", options.ScratchVolumeSize, serverName),
+			Operation:   "POST /volumes",
+		})
+		initialStep++
+	}
+
+	tools := transferTools(append(writeTools(options), requiredTools(options)...), options)
+	prepareDisk := PlannedStep{
+		Number:      initialStep + 4,
+		Step:        StepCleanDisk,
+		Description: "Clean existing disk",
+		Operation:   "ssh: blkdiscard --force " + env.TargetDevice,
+	}
+	write := fmt.Sprintf("Write image from %s to disk", source)
+
+	_, _, sparse := sparseFile(options)
+	switch {
+	case delta:
+		tools = append(tools, deltaTools...)
+		prepareDisk = PlannedStep{
+			Number:      initialStep + 4,
+			Step:        StepHashDisk,
+			Description: "Hash existing disk",
+			Operation:   "ssh: " + hashCommand(env.TargetDevice),
+		}
+		write = fmt.Sprintf("Write changed blocks of image from %s to disk", source)
+		plan.Command = extentCommand(env.TargetDevice, decompressTransferCommand(options))
+	case sparse:
+		write = fmt.Sprintf("Write data of image from %s to disk, holes and blocks of zeros are not sent", source)
+		plan.Command = extentCommand(env.TargetDevice, decompressTransferCommand(options))
+	default:
+		plan.Command, err = assembleCommand(options, env)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	planBootRescue(plan, initialStep, serverName)
+	plan.Steps = append(plan.Steps,
+		PlannedStep{
+			Number:      initialStep + 3,
+			Step:        StepProbeRescue,
+			Description: "Check the tools and free space of the rescue system",
+			Operation:   "ssh: " + probeCommand(tools, options.TargetDevice),
+		},
+		prepareDisk,
+		PlannedStep{
+			Number:      initialStep + 5,
+			Step:        StepWriteImage,
+			Description: write,
+			Operation:   "ssh: " + plan.Command,
+		},
+		PlannedStep{
+			Number:      initialStep + 6,
+			Step:        StepShutdownServer,
+			Description: "Shut down server",
+			Operation:   "ssh: shutdown now",
+		},
+	)
+
+	if env.ScratchDevice != "" {
+		plan.Steps = append(plan.Steps, PlannedStep{
+			Step:        StepDeleteVolume,
+			Description: "Delete temporary scratch volume",
+			Operation:   "DELETE /volumes/{id}",
+		})
+	}
+
+	return initialStep + 7, nil
+}
+
+// planBootRescue adds the steps of [Client.bootRescue] to the plan.
+func planBootRescue(plan *Plan, initialStep int, serverName string) {
+	plan.Steps = append(plan.Steps,
+		PlannedStep{
+			Number:      initialStep + 0,
+			Step:        StepEnableRescue,
+			Description: fmt.Sprintf("Activate rescue system on server %q", serverName),
+			Operation:   "POST /servers/{id}/actions/enable_rescue",
+		},
+		PlannedStep{
+			Number:      initialStep + 1,
+			Step:        StepBootServer,
+			Description: fmt.Sprintf("Boot server %q", serverName),
+			Operation:   "POST /servers/{id}/actions/poweron",
+		},
+		PlannedStep{
+			Number:      initialStep + 2,
+			Step:        StepOpenSSH,
+			Description: "Open SSH connection to the rescue system",
+			Operation:   "ssh root@{server-ip}",
+		},
+	)
+}
+
+func (s *Client) planExport(ctx context.Context, options ExportOptions) (*Plan, error) {
+	id, err := randomid.Generate()
+	if err != nil {
+		return nil, err
+	}
+	resourceName := resourcePrefix + id
+
+	plan := &Plan{
+		Source:           fmt.Sprintf("image %d (%.0f GB disk)", options.Image.ID, options.Image.DiskSize),
+		ImageCompression: options.Compression,
+		ImageFormat:      options.Format,
+		Command:          exportCommand("{root-disk}"),
+	}
+
+	if err := s.planServer(ctx, plan, options.Image.Architecture, options.ServerType, options.Location); err != nil {
+		return nil, err
+	}
+
+	plan.Steps = append(plan.Steps,
+		PlannedStep{
+			Number:      1,
+			Step:        StepGenerateSSHKey,
+			Description: fmt.Sprintf("Create temporary ssh key %q", resourceName),
+			Operation:   "POST /ssh_keys",
+		},
+		PlannedStep{
+			Number: 2,
+			Step:   StepCreateServer,
+			Description: fmt.Sprintf("Create temporary server %q (server type %s, location %s, image %d)",
+				resourceName, plan.ServerType, plan.Location, options.Image.ID,
+			),
+			Operation: "POST /servers",
+		},
+	)
+
+	planBootRescue(plan, 3, resourceName)
+
+	plan.Steps = append(plan.Steps,
+		PlannedStep{
+			Number:      6,
+			Step:        StepProbeRescue,
+			Description: "Find the root disk of the rescue system",
+			Operation:   "ssh: " + probeCommand(exportTools, ""),
+		},
+		PlannedStep{
+			Number: 7,
+			Step:   StepExportImage,
+			Description: fmt.Sprintf("Read the disk and write it as %s image with compression %s",
+				describeFormat(options.Format), describeCompression(options.Compression),
+			),
+			Operation: "ssh: " + plan.Command,
+		},
+	)
+
+	if !options.DebugSkipResourceCleanup {
+		plan.Steps = append(plan.Steps,
+			PlannedStep{
+				Step:        StepDeleteServer,
+				Description: fmt.Sprintf("Delete temporary server %q", resourceName),
+				Operation:   "DELETE /servers/{id}",
+			},
+			PlannedStep{
+				Step:        StepDeleteSSHKey,
+				Description: fmt.Sprintf("Delete temporary ssh key %q", resourceName),
+				Operation:   "DELETE /ssh_keys/{id}",
+			},
+		)
+	}
+
+	return plan, nil
+}
+
+// describeSource checks that the image is available and returns a human-readable description of it.
+func describeSource(ctx context.Context, options WriteOptions) (string, error) {
+	if options.ImageURL == nil {
+		if options.ImageSize > 0 {
+			return fmt.Sprintf("local file (%d bytes)", options.ImageSize), nil
+		}
+		return "local file", nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, options.ImageURL.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid image url: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to check image url: %w", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to check image url: unexpected status code %d", resp.StatusCode)
+	}
+
+	if resp.ContentLength > 0 {
+		return fmt.Sprintf("%s (%d bytes)", options.ImageURL, resp.ContentLength), nil
+	}
+	return options.ImageURL.String(), nil
+}
@@ -0,0 +1,509 @@
+package hcloudimages
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/exp/mockutil"
+)
+
+// stepIDs returns the IDs of the planned steps, in order.
+func stepIDs(plan *Plan) []StepID {
+	ids := make([]StepID, 0, len(plan.Steps))
+	for _, step := range plan.Steps {
+		ids = append(ids, step.Step)
+	}
+	return ids
+}
+
+// plannedStep returns the first planned step with the id.
+func plannedStep(t *testing.T, plan *Plan, id StepID) PlannedStep {
+	t.Helper()
+	for _, step := range plan.Steps {
+		if step.Step == id {
+			return step
+		}
+	}
+	t.Fatalf("plan has no step %s: %v", id, stepIDs(plan))
+	return PlannedStep{}
+}
+
+// writeSteps are the steps of [Client.write] for a full write of the image.
+var writeSteps = []StepID{StepEnableRescue, StepBootServer, StepOpenSSH, StepProbeRescue, StepCleanDisk, StepWriteImage, StepShutdownServer}
+
+func TestPlanUpload(t *testing.T) {
+	imageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/image.raw.xz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("image"))
+	}))
+	defer imageServer.Close()
+
+	sparse, err := os.Create(filepath.Join(t.TempDir(), "image.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = sparse.Close() }()
+	if err := sparse.Truncate(1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	uploadSteps := slices.Concat(
+		[]StepID{StepGenerateSSHKey, StepCreateServer},
+		writeSteps,
+		[]StepID{StepCreateImage, StepDeleteServer, StepDeleteSSHKey},
+	)
+
+	tests := []struct {
+		name     string
+		options  UploadOptions
+		requests []mockutil.Request
+
+		wantErr        bool
+		wantServerType string
+		wantLocation   string
+		wantSource     string
+		wantSteps      []StepID
+		wantCommand    string
+		// Strings that have to be part of the description of the create-server step and the probe command
+		wantServer string
+		wantProbe  string
+	}{
+		{
+			name: "remote image",
+			options: UploadOptions{
+				WriteOptions: WriteOptions{
+					ImageURL:         mustParseURL(imageServer.URL + "/image.raw.xz"),
+					ImageCompression: CompressionXZ,
+				},
+				Architecture: hcloud.ArchitectureX86,
+			},
+			requests:       []mockutil.Request{getServerTypeRequest, getLocationRequest},
+			wantServerType: "cx23",
+			wantLocation:   "fsn1",
+			wantSource:     imageServer.URL + "/image.raw.xz (5 bytes)",
+			wantSteps:      uploadSteps,
+			wantCommand:    `bash -c 'set -euo pipefail && wget --no-verbose -O - "` + imageServer.URL + `/image.raw.xz" | xz -cd | dd of={root-disk} bs=4M conv=sparse && sync'`,
+			wantServer:     "image ubuntu-24.04",
+			wantProbe:      "wget xz",
+		},
+		{
+			name: "remote image that does not exist",
+			options: UploadOptions{
+				WriteOptions: WriteOptions{ImageURL: mustParseURL(imageServer.URL + "/missing.raw")},
+				Architecture: hcloud.ArchitectureX86,
+			},
+			requests: []mockutil.Request{getServerTypeRequest, getLocationRequest},
+			wantErr:  true,
+		},
+		{
+			name: "local image",
+			options: UploadOptions{
+				WriteOptions: WriteOptions{ImageReader: bytes.NewReader([]byte("image")), ImageSize: 5},
+				Architecture: hcloud.ArchitectureX86,
+			},
+			requests:       []mockutil.Request{getServerTypeRequest, getLocationRequest},
+			wantServerType: "cx23",
+			wantLocation:   "fsn1",
+			wantSource:     "local file (5 bytes)",
+			wantSteps:      uploadSteps,
+			wantCommand:    "bash -c 'set -euo pipefail && dd of={root-disk} bs=4M conv=sparse && sync'",
+		},
+		{
+			name: "server type and location",
+			options: UploadOptions{
+				WriteOptions: WriteOptions{ImageReader: bytes.NewReader([]byte("image"))},
+				ServerType:   &hcloud.ServerType{Name: "cax21"},
+				Location:     &hcloud.Location{Name: "nbg1"},
+			},
+			requests: []mockutil.Request{
+				{
+					Method: "GET", Path: "/server_types?name=cax21",
+					Status:  http.StatusOK,
+					JSONRaw: `{"server_types": [{"id": 2, "name": "cax21", "architecture": "arm"}]}`,
+				},
+				{
+					Method: "GET", Path: "/locations?name=nbg1",
+					Status:  http.StatusOK,
+					JSONRaw: `{"locations": [{"id": 2, "name": "nbg1"}]}`,
+				},
+			},
+			wantServerType: "cax21",
+			wantLocation:   "nbg1",
+			wantSource:     "local file",
+			wantSteps:      uploadSteps,
+			wantCommand:    "bash -c 'set -euo pipefail && dd of={root-disk} bs=4M conv=sparse && sync'",
+			wantServer:     "(server type cax21, location nbg1, image ubuntu-24.04)",
+		},
+		{
+			name: "unknown server type",
+			options: UploadOptions{
+				WriteOptions: WriteOptions{ImageReader: bytes.NewReader([]byte("image"))},
+				ServerType:   &hcloud.ServerType{Name: "cx1"},
+			},
+			requests: []mockutil.Request{
+				{
+					Method: "GET", Path: "/server_types?name=cx1",
+					Status:  http.StatusOK,
+					JSONRaw: `{"server_types": []}`,
+				},
+			},
+			wantErr: true,
+		},
+		{
+			// Without a size, the image would be converted on the client with the default processing
+			name: "rescue processing",
+			options: UploadOptions{
+				WriteOptions: WriteOptions{
+					ImageReader: bytes.NewReader([]byte("image")),
+					ImageFormat: FormatQCOW2,
+					Processing:  ProcessingRescue,
+				},
+				Architecture: hcloud.ArchitectureX86,
+			},
+			requests:       []mockutil.Request{getServerTypeRequest, getLocationRequest},
+			wantServerType: "cx23",
+			wantLocation:   "fsn1",
+			wantSource:     "local file",
+			wantSteps:      uploadSteps,
+			wantCommand:    "bash -c 'set -euo pipefail && tee image.qcow2 > /dev/null && qemu-img dd -f qcow2 -O raw if=image.qcow2 of={root-disk} bs=4M && sync'",
+			wantProbe:      "qemu-img",
+		},
+		{
+			name: "scratch volume",
+			options: UploadOptions{
+				WriteOptions: WriteOptions{
+					ImageReader:       bytes.NewReader([]byte("image")),
+					ImageSize:         5,
+					ImageFormat:       FormatQCOW2,
+					ScratchVolumeSize: 20,
+				},
+				Architecture: hcloud.ArchitectureX86,
+			},
+			requests:       []mockutil.Request{getServerTypeRequest, getLocationRequest},
+			wantServerType: "cx23",
+			wantLocation:   "fsn1",
+			wantSource:     "local file (5 bytes)",
+			wantSteps: slices.Concat(
+				[]StepID{StepGenerateSSHKey, StepCreateServer, StepCreateVolume},
+				writeSteps,
+				[]StepID{StepDeleteVolume, StepCreateImage, StepDeleteServer, StepDeleteSSHKey},
+			),
+			wantCommand: "bash -c 'set -euo pipefail && mkdir -p /mnt/scratch && mount /dev/disk/by-id/scsi-0HC_Volume_{id} /mnt/scratch && cd /mnt/scratch && tee image.qcow2 > /dev/null && qemu-img dd -f qcow2 -O raw if=image.qcow2 of={root-disk} bs=4M && sync'",
+			wantProbe:   "mount qemu-img",
+		},
+		{
+			name: "base image",
+			options: UploadOptions{
+				WriteOptions: WriteOptions{ImageReader: bytes.NewReader([]byte("image"))},
+				BaseImage:    &hcloud.Image{ID: 123},
+			},
+			requests: []mockutil.Request{
+				{
+					Method: "GET", Path: "/images/123",
+					Status:  http.StatusOK,
+					JSONRaw: `{"image": {"id": 123, "type": "snapshot", "status": "available", "architecture": "x86"}}`,
+				},
+				getServerTypeRequest,
+				getLocationRequest,
+			},
+			wantServerType: "cx23",
+			wantLocation:   "fsn1",
+			wantSource:     "local file, processed on the client",
+			wantSteps: []StepID{
+				StepGenerateSSHKey, StepCreateServer,
+				StepEnableRescue, StepBootServer, StepOpenSSH, StepProbeRescue, StepHashDisk, StepWriteImage, StepShutdownServer,
+				StepCreateImage, StepDeleteServer, StepDeleteSSHKey,
+			},
+			wantCommand: extentCommand("{root-disk}", ""),
+			wantServer:  "image 123, the base image",
+			wantProbe:   "split sha256sum",
+		},
+		{
+			name: "base image that is not a snapshot",
+			options: UploadOptions{
+				WriteOptions: WriteOptions{ImageReader: bytes.NewReader([]byte("image"))},
+				BaseImage:    &hcloud.Image{ID: 1},
+			},
+			requests: []mockutil.Request{
+				{
+					Method: "GET", Path: "/images/1",
+					Status:  http.StatusOK,
+					JSONRaw: `{"image": {"id": 1, "type": "system", "status": "available", "architecture": "x86"}}`,
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "sparse local raw image",
+			options: UploadOptions{
+				WriteOptions: WriteOptions{ImageReader: sparse, ImageSize: 1024 * 1024},
+				Architecture: hcloud.ArchitectureX86,
+			},
+			requests:       []mockutil.Request{getServerTypeRequest, getLocationRequest},
+			wantServerType: "cx23",
+			wantLocation:   "fsn1",
+			wantSource:     "local file (1048576 bytes)",
+			wantSteps:      uploadSteps,
+			wantCommand:    extentCommand("{root-disk}", ""),
+		},
+		{
+			name: "transfer compression",
+			options: UploadOptions{
+				WriteOptions: WriteOptions{ImageReader: bytes.NewReader([]byte("image")), TransferCompression: CompressionZSTD},
+				Architecture: hcloud.ArchitectureX86,
+			},
+			requests:       []mockutil.Request{getServerTypeRequest, getLocationRequest},
+			wantServerType: "cx23",
+			wantLocation:   "fsn1",
+			wantSource:     "local file, compressed with zstd for the transfer",
+			wantSteps:      uploadSteps,
+			wantCommand:    "bash -c 'set -euo pipefail && zstd -cd | dd of={root-disk} bs=4M conv=sparse && sync'",
+			wantProbe:      "zstd",
+		},
+		{
+			name: "transfer compression of a sparse image",
+			options: UploadOptions{
+				WriteOptions: WriteOptions{ImageReader: sparse, TransferCompression: CompressionZSTD},
+				Architecture: hcloud.ArchitectureX86,
+			},
+			requests:       []mockutil.Request{getServerTypeRequest, getLocationRequest},
+			wantServerType: "cx23",
+			wantLocation:   "fsn1",
+			wantSource:     "local file, compressed with zstd for the transfer",
+			wantSteps:      uploadSteps,
+			wantCommand:    extentCommand("{root-disk}", "zstd -cd"),
+		},
+		{
+			name: "transfer compression of a compressed image",
+			options: UploadOptions{
+				WriteOptions: WriteOptions{
+					ImageReader:         bytes.NewReader([]byte("image")),
+					ImageCompression:    CompressionXZ,
+					TransferCompression: CompressionZSTD,
+				},
+				Architecture: hcloud.ArchitectureX86,
+			},
+			requests:       []mockutil.Request{getServerTypeRequest, getLocationRequest},
+			wantServerType: "cx23",
+			wantLocation:   "fsn1",
+			wantSource:     "local file",
+			wantSteps:      uploadSteps,
+			wantCommand:    "bash -c 'set -euo pipefail && xz -cd | dd of={root-disk} bs=4M conv=sparse && sync'",
+		},
+		{
+			name: "unsupported transfer compression",
+			options: UploadOptions{
+				WriteOptions: WriteOptions{ImageReader: bytes.NewReader([]byte("image")), TransferCompression: CompressionXZ},
+				Architecture: hcloud.ArchitectureX86,
+			},
+			requests: []mockutil.Request{getServerTypeRequest, getLocationRequest},
+			wantErr:  true,
+		},
+		{
+			name: "skip cleanup",
+			options: UploadOptions{
+				WriteOptions:             WriteOptions{ImageReader: bytes.NewReader([]byte("image"))},
+				Architecture:             hcloud.ArchitectureX86,
+				DebugSkipResourceCleanup: true,
+			},
+			requests:       []mockutil.Request{getServerTypeRequest, getLocationRequest},
+			wantServerType: "cx23",
+			wantLocation:   "fsn1",
+			wantSource:     "local file",
+			wantSteps:      uploadSteps[:len(uploadSteps)-2],
+			wantCommand:    "bash -c 'set -euo pipefail && dd of={root-disk} bs=4M conv=sparse && sync'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, tt.requests)
+
+			tt.options.DryRun = true
+			result, err := client.UploadWithResult(context.Background(), tt.options)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("UploadWithResult() returned plan %+v, want an error", result.Plan)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			plan := result.Plan
+
+			if plan.ServerType != tt.wantServerType || plan.Location != tt.wantLocation {
+				t.Errorf("plan uses server type %q in %q, want %q in %q", plan.ServerType, plan.Location, tt.wantServerType, tt.wantLocation)
+			}
+			if plan.Source != tt.wantSource {
+				t.Errorf("plan has source %q, want %q", plan.Source, tt.wantSource)
+			}
+			if got := stepIDs(plan); !slices.Equal(got, tt.wantSteps) {
+				t.Errorf("plan has steps %v, want %v", got, tt.wantSteps)
+			}
+			if plan.Command != tt.wantCommand {
+				t.Errorf("plan has command %q, want %q", plan.Command, tt.wantCommand)
+			}
+			if write := plannedStep(t, plan, StepWriteImage); write.Operation != "ssh: "+tt.wantCommand {
+				t.Errorf("write step has operation %q, want the command", write.Operation)
+			}
+			if server := plannedStep(t, plan, StepCreateServer); !strings.Contains(server.Description, tt.wantServer) {
+				t.Errorf("create-server step has description %q, want %q", server.Description, tt.wantServer)
+			}
+			if probe := plannedStep(t, plan, StepProbeRescue); !strings.Contains(probe.Operation, tt.wantProbe) {
+				t.Errorf("probe step has operation %q, want %q", probe.Operation, tt.wantProbe)
+			}
+
+			// Steps are numbered in order, the cleanup steps come last and have no number
+			number := 0
+			for _, step := range plan.Steps {
+				switch {
+				case step.Number == number+1:
+					number = step.Number
+				case step.Number != 0:
+					t.Errorf("step %s has number %d after step %d", step.Step, step.Number, number)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanWriteToDisk(t *testing.T) {
+	// The server exists already, so the API is not used
+	client := newTestClient(t, nil)
+
+	plan, err := client.planWriteToDisk(context.Background(), WriteOptions{
+		ImageReader:  bytes.NewReader([]byte("image")),
+		TargetDevice: "/dev/sdb",
+		Server:       &hcloud.Server{ID: 42, Name: "my-server"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantSteps := slices.Concat([]StepID{StepGenerateSSHKey, StepPowerOffServer}, writeSteps, []StepID{StepDeleteSSHKey})
+	if got := stepIDs(plan); !slices.Equal(got, wantSteps) {
+		t.Errorf("plan has steps %v, want %v", got, wantSteps)
+	}
+	if plan.ServerType != "" || plan.Location != "" {
+		t.Errorf("plan uses server type %q in %q, want none", plan.ServerType, plan.Location)
+	}
+	if want := "bash -c 'set -euo pipefail && dd of=/dev/sdb bs=4M conv=sparse && sync'"; plan.Command != want {
+		t.Errorf("plan has command %q, want %q", plan.Command, want)
+	}
+	if step := plannedStep(t, plan, StepPowerOffServer); step.Operation != "POST /servers/42/actions/poweroff" {
+		t.Errorf("power-off step has operation %q", step.Operation)
+	}
+	if step := plannedStep(t, plan, StepBootServer); !strings.Contains(step.Description, `"my-server"`) {
+		t.Errorf("boot step has description %q, want the name of the server", step.Description)
+	}
+
+	if _, err := client.planWriteToDisk(context.Background(), WriteOptions{
+		ImageReader:  bytes.NewReader([]byte("image")),
+		TargetDevice: "/dev/sdb; rm -rf /",
+		Server:       &hcloud.Server{ID: 42, Name: "my-server"},
+	}); err == nil {
+		t.Errorf("planWriteToDisk() with an invalid target device succeeded")
+	}
+}
+
+func TestPlanWriteToVolume(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     WriteToVolumeOptions
+		wantSteps   []StepID
+		wantCommand string
+	}{
+		{
+			name: "new volume",
+			options: WriteToVolumeOptions{
+				WriteOptions: WriteOptions{ImageReader: bytes.NewReader([]byte("image"))},
+				VolumeSize:   10,
+				Architecture: hcloud.ArchitectureX86,
+			},
+			wantSteps: slices.Concat(
+				[]StepID{StepGenerateSSHKey, StepCreateServer, StepCreateVolume},
+				writeSteps,
+				[]StepID{StepDetachVolume, StepDeleteServer, StepDeleteSSHKey},
+			),
+			wantCommand: "bash -c 'set -euo pipefail && dd of=/dev/disk/by-id/scsi-0HC_Volume_{id} bs=4M conv=sparse && sync'",
+		},
+		{
+			name: "existing volume",
+			options: WriteToVolumeOptions{
+				WriteOptions: WriteOptions{ImageReader: bytes.NewReader([]byte("image"))},
+				Volume:       &hcloud.Volume{ID: 7, Name: "data", LinuxDevice: "/dev/disk/by-id/scsi-0HC_Volume_7"},
+				Architecture: hcloud.ArchitectureX86,
+			},
+			wantSteps: slices.Concat(
+				[]StepID{StepGenerateSSHKey, StepCreateServer, StepAttachVolume},
+				writeSteps,
+				[]StepID{StepDetachVolume, StepDeleteServer, StepDeleteSSHKey},
+			),
+			wantCommand: "bash -c 'set -euo pipefail && dd of=/dev/disk/by-id/scsi-0HC_Volume_7 bs=4M conv=sparse && sync'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, []mockutil.Request{getServerTypeRequest, getLocationRequest})
+
+			plan, err := client.planWriteToVolume(context.Background(), tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := stepIDs(plan); !slices.Equal(got, tt.wantSteps) {
+				t.Errorf("plan has steps %v, want %v", got, tt.wantSteps)
+			}
+			if plan.Command != tt.wantCommand {
+				t.Errorf("plan has command %q, want %q", plan.Command, tt.wantCommand)
+			}
+			if plan.ServerType != "cx23" || plan.Location != "fsn1" {
+				t.Errorf("plan uses server type %q in %q, want cx23 in fsn1", plan.ServerType, plan.Location)
+			}
+		})
+	}
+}
+
+func TestPlanExport(t *testing.T) {
+	client := newTestClient(t, []mockutil.Request{getServerTypeRequest, getLocationRequest})
+
+	plan, err := client.planExport(context.Background(), ExportOptions{
+		Image:       &hcloud.Image{ID: 123, Architecture: hcloud.ArchitectureX86, DiskSize: 10},
+		Compression: CompressionZSTD,
+		Format:      FormatQCOW2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantSteps := []StepID{
+		StepGenerateSSHKey, StepCreateServer, StepEnableRescue, StepBootServer, StepOpenSSH, StepProbeRescue, StepExportImage,
+		StepDeleteServer, StepDeleteSSHKey,
+	}
+	if got := stepIDs(plan); !slices.Equal(got, wantSteps) {
+		t.Errorf("plan has steps %v, want %v", got, wantSteps)
+	}
+	if plan.Source != "image 123 (10 GB disk)" {
+		t.Errorf("plan has source %q", plan.Source)
+	}
+	if plan.ImageCompression != CompressionZSTD || plan.ImageFormat != FormatQCOW2 {
+		t.Errorf("plan has compression %q and format %q, want zstd and qcow2", plan.ImageCompression, plan.ImageFormat)
+	}
+	if plan.Command != exportCommand("{root-disk}") {
+		t.Errorf("plan has command %q, want %q", plan.Command, exportCommand("{root-disk}"))
+	}
+	if step := plannedStep(t, plan, StepCreateServer); !strings.Contains(step.Description, "image 123") {
+		t.Errorf("create-server step has description %q, want the exported image", step.Description)
+	}
+}
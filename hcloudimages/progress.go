@@ -0,0 +1,102 @@
+package hcloudimages
+
+import (
+	"time"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/progress"
+)
+
+const progressInterval = 1 * time.Second
+
+// Progress describes how far writing the image to the disk has come. It is periodically passed to
+// [WriteOptions.Progress] while the image is written, and to [ExportOptions.Progress] while the disk is exported.
+type Progress struct {
+	// BytesRead is the number of bytes of the image file that were transferred so far. This is always known for
+	// [WriteOptions.ImageReader]. For [WriteOptions.ImageURL] it is only known for uncompressed raw images, otherwise
+	// it is 0. For [Client.Export] it is the number of bytes read from the disk. Holes and blocks of zeros of local raw
+	// images are not sent, but still counted.
+	BytesRead int64
+
+	// BytesWritten is the number of bytes written to the disk so far, as reported by dd. This is only known for raw
+	// images, otherwise it is 0.
+	BytesWritten int64
+
+	// TotalBytes is the size of the image file from [WriteOptions.ImageSize] and can be compared against BytesRead.
+	// It is 0 if the size is unknown. For [Client.Export] it is the size of the disk.
+	TotalBytes int64
+
+	// Elapsed is the time since the transfer started.
+	Elapsed time.Duration
+
+	// Throughput is the average number of bytes per second since the transfer started. It is based on BytesRead if
+	// known, otherwise on BytesWritten.
+	Throughput float64
+
+	// ETA is the estimated time until the transfer is done. It is 0 if it can not be estimated.
+	ETA time.Duration
+}
+
+// reportProgress calls [WriteOptions.Progress] every [progressInterval] until the returned function is called. The
+// returned function reports a final update before it returns.
+func reportProgress(options WriteOptions, tracker *progress.Tracker) func() {
+	// The image file is written to the disk as-is
+	writtenIsRead := options.ImageReader == nil && options.ImageCompression == CompressionNone && options.ImageFormat == FormatRaw
+
+	return startProgress(options.Progress, options.ImageSize, tracker, writtenIsRead)
+}
+
+// startProgress calls fn every [progressInterval] with the bytes counted by tracker, until the returned function is
+// called. If writtenIsRead is set, the bytes written are reported as read as well.
+func startProgress(fn func(Progress), total int64, tracker *progress.Tracker, writtenIsRead bool) func() {
+	start := time.Now()
+
+	report := func() {
+		p := Progress{
+			BytesRead:    tracker.Read(),
+			BytesWritten: tracker.Written(),
+			TotalBytes:   total,
+			Elapsed:      time.Since(start),
+		}
+
+		if writtenIsRead {
+			p.BytesRead = p.BytesWritten
+		}
+
+		done := p.BytesRead
+		if done == 0 {
+			done = p.BytesWritten
+		}
+		if seconds := p.Elapsed.Seconds(); seconds > 0 {
+			p.Throughput = float64(done) / seconds
+		}
+
+		if p.TotalBytes > 0 && p.BytesRead > 0 && p.BytesRead < p.TotalBytes && p.Throughput > 0 {
+			p.ETA = time.Duration(float64(p.TotalBytes-p.BytesRead) / p.Throughput * float64(time.Second))
+		}
+
+		fn(p)
+	}
+
+	ticker := time.NewTicker(progressInterval)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(stop)
+		<-stopped
+		report()
+	}
+}
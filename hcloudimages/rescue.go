@@ -0,0 +1,255 @@
+package hcloudimages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/sshsession"
+)
+
+// rescueSystem describes what the rescue system is capable of, as measured by [Client.probeRescueSystem].
+type rescueSystem struct {
+	// Tools maps the available tools to the first line of their version output.
+	Tools map[string]string
+
+	// Missing are the tools that are not available.
+	Missing []string
+
+	// StagingAvailable is the free space in bytes of the memory-backed root file system, which images are staged on
+	// if they need random access.
+	StagingAvailable int64
+
+	// TargetDevice is the block device that the image is written to, TargetDeviceSize its size in bytes.
+	TargetDevice     string
+	TargetDeviceSize int64
+
+	// MemoryAvailable is the memory in bytes that is available without swapping.
+	MemoryAvailable int64
+}
+
+// blockDevice is a disk as listed by lsblk.
+type blockDevice struct {
+	Path      string
+	Size      int64
+	Type      string
+	ReadOnly  bool
+	Removable bool
+}
+
+// writeTools returns the commands that the rescue system always needs to write the image. Unlike [requiredTools],
+// processing the image on the client does not help if these are missing.
+func writeTools(options WriteOptions) []string {
+	tools := []string{"blkdiscard", "dd"}
+	if options.TargetDevice == "" {
+		tools = append(tools, "lsblk")
+	}
+	if useScratchVolume(options) {
+		tools = append(tools, "mount")
+	}
+	return tools
+}
+
+// probeCommand returns the command that prints the capabilities of the rescue system, which are parsed by
+// [parseProbe]. If target is empty, all disks and Volumes are listed to find the root disk.
+func probeCommand(tools []string, target string) string {
+	script := fmt.Sprintf(`for tool in %s; do if command -v "$tool" > /dev/null; then echo "tool $tool $("$tool" --version < /dev/null 2>&1 | head -n 1)"; else echo "missing $tool"; fi; done`, strings.Join(tools, " "))
+	script += `; echo "staging $(df -B1 --output=avail . | tail -n 1)"`
+	if target != "" {
+		script += fmt.Sprintf(`; if [ -b %s ]; then echo "target %s $(blockdev --getsize64 %s)"; fi`, target, target, target)
+	} else {
+		script += `; lsblk --bytes --nodeps --paths --noheadings --raw --output NAME,SIZE,TYPE,RO,RM | sed "s/^/disk /"`
+		script += `; for link in /dev/disk/by-id/scsi-0HC_Volume_*; do if [ -e "$link" ]; then echo "volume $(readlink -f "$link")"; fi; done`
+	}
+	script += `; grep MemAvailable /proc/meminfo`
+
+	return fmt.Sprintf("bash -c '%s'", script)
+}
+
+// parseProbe parses the output of [probeCommand] for target.
+func parseProbe(output []byte, target string) (rescueSystem, error) {
+	rescue := rescueSystem{Tools: map[string]string{}}
+
+	parseSize := func(line, value string, unit int64) (int64, error) {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected line %q: %w", line, err)
+		}
+		return size * unit, nil
+	}
+
+	var disks []blockDevice
+	var volumes []string
+
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var err error
+		switch {
+		case fields[0] == "tool" && len(fields) >= 2:
+			rescue.Tools[fields[1]] = strings.Join(fields[2:], " ")
+		case fields[0] == "missing" && len(fields) == 2:
+			rescue.Missing = append(rescue.Missing, fields[1])
+		case fields[0] == "staging" && len(fields) == 2:
+			rescue.StagingAvailable, err = parseSize(line, fields[1], 1)
+		case fields[0] == "target" && len(fields) == 3:
+			rescue.TargetDevice = fields[1]
+			rescue.TargetDeviceSize, err = parseSize(line, fields[2], 1)
+		case fields[0] == "disk" && len(fields) == 6:
+			disk := blockDevice{Path: fields[1], Type: fields[3], ReadOnly: fields[4] == "1", Removable: fields[5] == "1"}
+			disk.Size, err = parseSize(line, fields[2], 1)
+			disks = append(disks, disk)
+		case fields[0] == "volume" && len(fields) == 2:
+			volumes = append(volumes, fields[1])
+		case fields[0] == "MemAvailable:" && len(fields) == 3 && fields[2] == "kB":
+			rescue.MemoryAvailable, err = parseSize(line, fields[1], 1024)
+		default:
+			err = fmt.Errorf("unexpected line %q", line)
+		}
+		if err != nil {
+			return rescue, err
+		}
+	}
+
+	switch {
+	case rescue.StagingAvailable == 0:
+		return rescue, fmt.Errorf("failed to measure the free space of the root file system")
+	case rescue.MemoryAvailable == 0:
+		return rescue, fmt.Errorf("failed to measure the available memory")
+	}
+
+	if target != "" {
+		if rescue.TargetDevice == "" {
+			return rescue, fmt.Errorf("%w: %s is not a block device", ErrTargetDevice, target)
+		}
+		return rescue, nil
+	}
+
+	root, err := findRootDisk(disks, volumes)
+	if err != nil {
+		return rescue, err
+	}
+	rescue.TargetDevice, rescue.TargetDeviceSize = root.Path, root.Size
+	return rescue, nil
+}
+
+// findRootDisk returns the root disk of the server. Writing to the wrong disk would destroy its data, so it is only
+// returned if there is exactly one disk that could be the root disk.
+func findRootDisk(disks []blockDevice, volumes []string) (blockDevice, error) {
+	var candidates []blockDevice
+	for _, disk := range disks {
+		if disk.Type != "disk" || disk.ReadOnly || disk.Removable || disk.Size == 0 || slices.Contains(volumes, disk.Path) {
+			continue
+		}
+		candidates = append(candidates, disk)
+	}
+
+	switch len(candidates) {
+	case 0:
+		return blockDevice{}, fmt.Errorf("%w: no root disk found, set the target device explicitly", ErrTargetDevice)
+	case 1:
+		return candidates[0], nil
+	default:
+		paths := make([]string, 0, len(candidates))
+		for _, disk := range candidates {
+			paths = append(paths, disk.Path)
+		}
+		return blockDevice{}, fmt.Errorf("%w: found more than one possible root disk (%s), set the target device explicitly",
+			ErrTargetDevice, strings.Join(paths, ", "))
+	}
+}
+
+// validateTargetDevice checks that [WriteOptions.TargetDevice] can be used in the commands on the rescue system.
+func validateTargetDevice(device string) error {
+	if device != "" && !targetDevicePattern.MatchString(device) {
+		return fmt.Errorf("invalid target device: %q", device)
+	}
+	return nil
+}
+
+// probeRescueSystem checks which of the tools the rescue system has, how much space is available for the image and
+// which device it is written to. If target is empty, the root disk is detected.
+func (s *Client) probeRescueSystem(ctx context.Context, sshClient *ssh.Client, tools []string, target string) (rescueSystem, error) {
+	if err := validateTargetDevice(target); err != nil {
+		return rescueSystem{}, err
+	}
+
+	output, err := sshsession.Run(ctx, sshClient, probeCommand(tools, target), nil)
+	if err != nil {
+		return rescueSystem{}, fmt.Errorf("%w: failed to probe the rescue system: %w: %s", ErrRescueSystem, err, strings.TrimSpace(string(output)))
+	}
+
+	rescue, err := parseProbe(output, target)
+	if err != nil {
+		if errors.Is(err, ErrTargetDevice) {
+			return rescueSystem{}, err
+		}
+		return rescueSystem{}, fmt.Errorf("%w: failed to probe the rescue system: %w", ErrRescueSystem, err)
+	}
+	return rescue, nil
+}
+
+// checkRescueSystem verifies that the rescue system can write the image. It reports whether the image needs to be
+// processed on the client instead, which is only done for [ProcessingAuto].
+func checkRescueSystem(options WriteOptions, rescue rescueSystem) (bool, error) {
+	for _, tool := range writeTools(options) {
+		if slices.Contains(rescue.Missing, tool) {
+			return false, fmt.Errorf("%w: %s is missing", ErrRescueSystem, tool)
+		}
+	}
+
+	canUseClient := options.Processing == ProcessingAuto && supportedOnClient(options)
+
+	var missing []string
+	for _, tool := range requiredTools(options) {
+		if slices.Contains(rescue.Missing, tool) {
+			missing = append(missing, tool)
+		}
+	}
+	if len(missing) > 0 {
+		if canUseClient {
+			return true, nil
+		}
+		return false, fmt.Errorf("%w: %s is missing", ErrRescueSystem, strings.Join(missing, ", "))
+	}
+
+	if limit := stagingLimit(options, &rescue); stagesImage(options) && options.ImageSize > limit {
+		if canUseClient {
+			return true, nil
+		}
+
+		staging := "rescue system root disk"
+		if useScratchVolume(options) {
+			staging = "scratch volume"
+		}
+		kind := string(options.ImageFormat)
+		if options.ImageCompression == CompressionZIP {
+			kind = string(CompressionZIP)
+		}
+		return false, fmt.Errorf("%w: %s image has %d MB, but only %d MB are available on the %s",
+			ErrNoSpaceLeft, kind, options.ImageSize/(1024*1024), limit/(1024*1024), staging)
+	}
+
+	return false, checkTargetDevice(options, rescue)
+}
+
+// checkTargetDevice verifies that the image fits on the target device, if its size is known.
+func checkTargetDevice(options WriteOptions, rescue rescueSystem) error {
+	if options.ImageCompression != CompressionNone || options.ImageFormat != FormatRaw {
+		// The size of the image on the disk is not known
+		return nil
+	}
+	if options.ImageSize > rescue.TargetDeviceSize {
+		return fmt.Errorf("%w: image has %d MB, but %s only has %d MB",
+			ErrNoSpaceLeft, options.ImageSize/(1024*1024), rescue.TargetDevice, rescue.TargetDeviceSize/(1024*1024))
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package hcloudimages
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseProbe(t *testing.T) {
+	const common = `tool blkdiscard blkdiscard from util-linux 2.38.1
+tool dd dd (coreutils) 9.1
+missing lz4
+staging 1006632960
+MemAvailable:    3456789 kB
+`
+
+	tests := []struct {
+		name       string
+		output     string
+		target     string
+		wantDevice string
+		wantSize   int64
+		wantErr    error
+	}{
+		{
+			name: "root disk",
+			output: common + `disk /dev/sda 40960000000 disk 0 0
+disk /dev/sdb 10737418240 disk 0 0
+disk /dev/sr0 1073741312 rom 1 1
+volume /dev/sdb
+`,
+			wantDevice: "/dev/sda",
+			wantSize:   40960000000,
+		},
+		{
+			name:       "nvme root disk",
+			output:     common + "disk /dev/nvme0n1 40960000000 disk 0 0\n",
+			wantDevice: "/dev/nvme0n1",
+			wantSize:   40960000000,
+		},
+		{
+			name:    "ambiguous root disk",
+			output:  common + "disk /dev/vda 40960000000 disk 0 0\ndisk /dev/vdb 40960000000 disk 0 0\n",
+			wantErr: ErrTargetDevice,
+		},
+		{
+			name:    "no root disk",
+			output:  common + "disk /dev/sda 10737418240 disk 0 0\nvolume /dev/sda\n",
+			wantErr: ErrTargetDevice,
+		},
+		{
+			name:       "explicit target",
+			output:     common + "target /dev/disk/by-id/scsi-0HC_Volume_123 10737418240\n",
+			target:     "/dev/disk/by-id/scsi-0HC_Volume_123",
+			wantDevice: "/dev/disk/by-id/scsi-0HC_Volume_123",
+			wantSize:   10737418240,
+		},
+		{
+			name:    "explicit target is not a block device",
+			output:  common,
+			target:  "/dev/sdz",
+			wantErr: ErrTargetDevice,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProbe([]byte(tt.output), tt.target)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseProbe() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.TargetDevice != tt.wantDevice || got.TargetDeviceSize != tt.wantSize {
+				t.Errorf("parseProbe() target = %s (%d), want %s (%d)", got.TargetDevice, got.TargetDeviceSize, tt.wantDevice, tt.wantSize)
+			}
+			if got.Tools["dd"] != "dd (coreutils) 9.1" || len(got.Tools) != 2 {
+				t.Errorf("parseProbe() tools = %v", got.Tools)
+			}
+			if len(got.Missing) != 1 || got.Missing[0] != "lz4" {
+				t.Errorf("parseProbe() missing = %v, want [lz4]", got.Missing)
+			}
+			if got.StagingAvailable != 1006632960 || got.MemoryAvailable != 3456789*1024 {
+				t.Errorf("parseProbe() = %+v", got)
+			}
+		})
+	}
+
+	if _, err := parseProbe([]byte("disk /dev/sda \nstaging 1\n"), ""); err == nil {
+		t.Errorf("parseProbe() with missing disk size did not fail")
+	}
+}
+
+func TestCheckRescueSystem(t *testing.T) {
+	const mb = 1024 * 1024
+
+	rescue := rescueSystem{
+		StagingAvailable: 960 * mb,
+		MemoryAvailable:  2000 * mb,
+		TargetDevice:     "/dev/sda",
+		TargetDeviceSize: 40000 * mb,
+	}
+	withMissing := func(tools ...string) rescueSystem {
+		r := rescue
+		r.Missing = tools
+		return r
+	}
+
+	tests := []struct {
+		name          string
+		options       WriteOptions
+		rescue        rescueSystem
+		wantUseClient bool
+		wantErr       error
+	}{
+		{
+			name:    "raw",
+			options: WriteOptions{ImageSize: 10000 * mb},
+			rescue:  rescue,
+		},
+		{
+			name:    "raw larger than root disk",
+			options: WriteOptions{ImageSize: 50000 * mb},
+			rescue:  rescue,
+			wantErr: ErrNoSpaceLeft,
+		},
+		{
+			name:    "missing dd",
+			options: WriteOptions{},
+			rescue:  withMissing("dd"),
+			wantErr: ErrRescueSystem,
+		},
+		{
+			name:          "missing xz",
+			options:       WriteOptions{ImageCompression: CompressionXZ},
+			rescue:        withMissing("xz"),
+			wantUseClient: true,
+		},
+		{
+			name:    "missing xz with processing in the rescue system",
+			options: WriteOptions{ImageCompression: CompressionXZ, Processing: ProcessingRescue},
+			rescue:  withMissing("xz"),
+			wantErr: ErrRescueSystem,
+		},
+		{
+			name:    "missing lz4",
+			options: WriteOptions{ImageCompression: CompressionLZ4},
+			rescue:  withMissing("lz4"),
+			wantErr: ErrRescueSystem,
+		},
+		{
+			name:          "qcow2 larger than staging",
+			options:       WriteOptions{ImageFormat: FormatQCOW2, ImageCompression: CompressionXZ, ImageSize: 1000 * mb},
+			rescue:        rescue,
+			wantUseClient: true,
+		},
+		{
+			name:    "vmdk larger than staging",
+			options: WriteOptions{ImageFormat: FormatVMDK, ImageSize: 1000 * mb},
+			rescue:  rescue,
+			wantErr: ErrNoSpaceLeft,
+		},
+		{
+			name:    "qcow2 on scratch volume",
+			options: WriteOptions{ImageFormat: FormatQCOW2, ImageSize: 5000 * mb, ScratchVolumeSize: 10},
+			rescue:  rescue,
+		},
+		{
+			name:    "vdi larger than memory",
+			options: WriteOptions{ImageFormat: FormatVDI, ImageSize: 900 * mb},
+			rescue:  rescueSystem{StagingAvailable: 2000 * mb, MemoryAvailable: 800 * mb, TargetDeviceSize: 40000 * mb},
+			wantErr: ErrNoSpaceLeft,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useClient, err := checkRescueSystem(tt.options, tt.rescue)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("checkRescueSystem() error = %v, want %v", err, tt.wantErr)
+			}
+			if useClient != tt.wantUseClient {
+				t.Errorf("checkRescueSystem() = %v, want %v", useClient, tt.wantUseClient)
+			}
+		})
+	}
+}
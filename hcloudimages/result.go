@@ -0,0 +1,146 @@
+package hcloudimages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
+)
+
+const (
+	imagePollInterval = 2 * time.Second
+)
+
+// UploadResult describes a call to [Client.UploadWithResult].
+type UploadResult struct {
+	// Image is the resulting snapshot, as refreshed from the API after it became available. It is nil if the upload
+	// failed or [WriteOptions.DryRun] is set.
+	Image *hcloud.Image
+
+	// RunID is the random ID of the call, also used in the names and labels of the temporary resources.
+	RunID string
+
+	// Server is the temporary server, as it was returned on creation. It no longer exists once the cleanup succeeded.
+	Server *hcloud.Server
+
+	// ServerType and Location of the temporary server.
+	ServerType *hcloud.ServerType
+	Location   *hcloud.Location
+
+	// ImageCompression and ImageFormat of the image, after [CompressionAuto] and [FormatAuto] were resolved.
+	ImageCompression Compression
+	ImageFormat      Format
+
+	// Steps lists every step that was started, in order, including the cleanup steps.
+	Steps []StepResult
+
+	// BytesTransferred is the number of bytes of the image file that were read. For [WriteOptions.ImageURL] the image
+	// is downloaded by the rescue system, the value is then taken from [WriteOptions.ImageSize] and is 0 if the size
+	// is unknown.
+	BytesTransferred int64
+
+	Cleanup CleanupResult
+
+	// Warnings holds non-fatal problems that were logged during the upload, e.g. a failed shutdown.
+	Warnings []string
+
+	// Plan is only set if [WriteOptions.DryRun] is set.
+	Plan *Plan
+}
+
+// StepResult records the outcome of a single step.
+type StepResult struct {
+	// Number of the step, as it is shown in the logs. Cleanup steps have no number and use 0.
+	Number int
+
+	Step StepID
+
+	Start    time.Time
+	Duration time.Duration
+
+	// Err is the reason why the step failed, nil if it succeeded.
+	Err error
+}
+
+// CleanupResult describes which of the temporary resources were deleted at the end of a run.
+type CleanupResult struct {
+	// Skipped is set if the cleanup was disabled through [UploadOptions.DebugSkipResourceCleanup].
+	Skipped bool
+
+	SSHKeyDeleted bool
+	ServerDeleted bool
+	VolumeDeleted bool
+
+	// Err lists the resources that could not be deleted, nil if there were none.
+	Err *CleanupError
+}
+
+// cleanupError returns the [CleanupError] of the run, to record resources that could not be deleted.
+func (r *run) cleanupError() *CleanupError {
+	if r.cleanup.Err == nil {
+		r.cleanup.Err = &CleanupError{}
+	}
+	return r.cleanup.Err
+}
+
+// joinCleanupError adds the [CleanupError] of the run to *err if the run failed. Successful runs only report it through
+// the [UploadResult], as the image was still created.
+func (r *run) joinCleanupError(err *error) {
+	if *err != nil && r.cleanup.Err != nil {
+		*err = errors.Join(*err, r.cleanup.Err)
+	}
+}
+
+// warn logs a non-fatal problem and records it for the [UploadResult].
+func (r *run) warn(ctx context.Context, message string, args ...any) {
+	contextlogger.From(ctx).WarnContext(ctx, message, args...)
+
+	var sb strings.Builder
+	sb.WriteString(message)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&sb, " %v=%v", args[i], args[i+1])
+	}
+	r.warnings = append(r.warnings, sb.String())
+}
+
+// result copies the state of the run into result.
+func (r *run) result(result *UploadResult) {
+	result.RunID = r.id
+	result.Steps = r.steps
+	result.BytesTransferred = r.bytesTransferred
+	result.Cleanup = r.cleanup
+	result.Warnings = r.warnings
+}
+
+// waitForImage polls the image until it is available. Snapshots are usually available as soon as the create action
+// finished, but the size fields are only filled in afterward.
+func (s *Client) waitForImage(ctx context.Context, image *hcloud.Image) (*hcloud.Image, error) {
+	for {
+		refreshed, _, err := s.c.Image.GetByID(ctx, image.ID)
+		if err != nil {
+			return nil, err
+		}
+		if refreshed == nil {
+			return nil, fmt.Errorf("image %d not found", image.ID)
+		}
+
+		switch refreshed.Status {
+		case hcloud.ImageStatusAvailable:
+			return refreshed, nil
+		case hcloud.ImageStatusCreating:
+		default:
+			return nil, fmt.Errorf("image %d has unexpected status %q", image.ID, refreshed.Status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(imagePollInterval):
+		}
+	}
+}
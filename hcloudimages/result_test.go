@@ -0,0 +1,274 @@
+package hcloudimages
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/exp/mockutil"
+)
+
+var (
+	createSSHKeyRequest = mockutil.Request{
+		Method: "POST", Path: "/ssh_keys",
+		Status:  http.StatusCreated,
+		JSONRaw: `{"ssh_key": {"id": 1, "name": "hcloud-upload-image-abcd1234", "fingerprint": "fp", "public_key": "key"}}`,
+	}
+	deleteSSHKeyRequest = mockutil.Request{
+		Method: "DELETE", Path: "/ssh_keys/1",
+		Status: http.StatusNoContent,
+	}
+)
+
+// stepResults returns the IDs of the steps and whether they failed.
+func stepResults(steps []StepResult) []string {
+	results := make([]string, 0, len(steps))
+	for _, step := range steps {
+		result := string(step.Step)
+		if step.Err != nil {
+			result += " failed"
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func TestUploadWithResultFailure(t *testing.T) {
+	createServerFailed := mockutil.Request{
+		Method: "POST", Path: "/servers",
+		Status:  http.StatusUnprocessableEntity,
+		JSONRaw: apiError(hcloud.ErrorCodeResourceLimitExceeded),
+	}
+	createServerActionFailed := mockutil.Request{
+		Method: "POST", Path: "/servers",
+		Status: http.StatusCreated,
+		JSONRaw: `{
+			"server": {"id": 42, "name": "hcloud-upload-image-abcd1234"},
+			"action": {"id": 2, "status": "error", "error": {"code": "action_failed", "message": "boot failed"}},
+			"next_actions": []
+		}`,
+	}
+
+	tests := []struct {
+		name     string
+		requests []mockutil.Request
+
+		wantSteps   []string
+		wantCleanup CleanupResult
+		// IDs of the resources that could not be deleted, nil if the cleanup succeeded
+		wantLeakedServers []int64
+		wantLeakedSSHKeys []int64
+	}{
+		{
+			name:        "server creation fails",
+			requests:    []mockutil.Request{createSSHKeyRequest, createServerFailed, deleteSSHKeyRequest},
+			wantSteps:   []string{"generate-ssh-key", "create-server failed", "delete-ssh-key"},
+			wantCleanup: CleanupResult{SSHKeyDeleted: true},
+		},
+		{
+			name: "ssh key can not be deleted",
+			requests: []mockutil.Request{
+				createSSHKeyRequest,
+				createServerFailed,
+				{
+					Method: "DELETE", Path: "/ssh_keys/1",
+					Status:  http.StatusLocked,
+					JSONRaw: apiError(hcloud.ErrorCodeLocked),
+				},
+			},
+			wantSteps:         []string{"generate-ssh-key", "create-server failed", "delete-ssh-key failed"},
+			wantLeakedSSHKeys: []int64{1},
+		},
+		{
+			name: "server action fails",
+			requests: []mockutil.Request{
+				createSSHKeyRequest,
+				createServerActionFailed,
+				{
+					Method: "DELETE", Path: "/servers/42",
+					Status:  http.StatusOK,
+					JSONRaw: `{"action": {"id": 3, "status": "success"}}`,
+				},
+				deleteSSHKeyRequest,
+			},
+			wantSteps:   []string{"generate-ssh-key", "create-server failed", "delete-server", "delete-ssh-key"},
+			wantCleanup: CleanupResult{SSHKeyDeleted: true, ServerDeleted: true},
+		},
+		{
+			name: "server can not be deleted",
+			requests: []mockutil.Request{
+				createSSHKeyRequest,
+				createServerActionFailed,
+				{
+					Method: "DELETE", Path: "/servers/42",
+					Status:  http.StatusLocked,
+					JSONRaw: apiError(hcloud.ErrorCodeLocked),
+				},
+				deleteSSHKeyRequest,
+			},
+			wantSteps:         []string{"generate-ssh-key", "create-server failed", "delete-server failed", "delete-ssh-key"},
+			wantCleanup:       CleanupResult{SSHKeyDeleted: true},
+			wantLeakedServers: []int64{42},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, tt.requests)
+
+			result, err := client.UploadWithResult(context.Background(), UploadOptions{
+				WriteOptions: WriteOptions{ImageReader: bytes.NewReader([]byte("image")), ImageSize: 5},
+				Architecture: hcloud.ArchitectureX86,
+			})
+			if err == nil {
+				t.Fatal("UploadWithResult() succeeded, want an error")
+			}
+			if result == nil {
+				t.Fatal("UploadWithResult() returned no result")
+			}
+
+			if result.Image != nil || result.Plan != nil {
+				t.Errorf("result has image %v and plan %v, want none", result.Image, result.Plan)
+			}
+			if len(result.RunID) != 8 {
+				t.Errorf("result has run id %q", result.RunID)
+			}
+			if result.ImageCompression != CompressionNone || result.ImageFormat != FormatRaw {
+				t.Errorf("result has compression %q and format %q", result.ImageCompression, result.ImageFormat)
+			}
+			if got := stepResults(result.Steps); !slices.Equal(got, tt.wantSteps) {
+				t.Errorf("result has steps %v, want %v", got, tt.wantSteps)
+			}
+
+			// The cleanup runs in deferred functions, it must be finished before the result is filled in
+			cleanup := result.Cleanup
+			cleanup.Err = nil
+			if cleanup != tt.wantCleanup {
+				t.Errorf("result has cleanup %+v, want %+v", cleanup, tt.wantCleanup)
+			}
+
+			var cleanupErr *CleanupError
+			if tt.wantLeakedServers == nil && tt.wantLeakedSSHKeys == nil {
+				if result.Cleanup.Err != nil || errors.As(err, &cleanupErr) {
+					t.Errorf("UploadWithResult() returned cleanup error %v, want none", err)
+				}
+				return
+			}
+
+			if result.Cleanup.Err == nil {
+				t.Fatal("result has no cleanup error")
+			}
+			if !slices.Equal(result.Cleanup.Err.ServerIDs, tt.wantLeakedServers) || !slices.Equal(result.Cleanup.Err.SSHKeyIDs, tt.wantLeakedSSHKeys) {
+				t.Errorf("cleanup error has servers %v and ssh keys %v, want %v and %v",
+					result.Cleanup.Err.ServerIDs, result.Cleanup.Err.SSHKeyIDs, tt.wantLeakedServers, tt.wantLeakedSSHKeys)
+			}
+			// The run failed, so the cleanup error is part of the returned error
+			if !errors.As(err, &cleanupErr) || cleanupErr != result.Cleanup.Err {
+				t.Errorf("UploadWithResult() = %v, want it to include the cleanup error", err)
+			}
+		})
+	}
+}
+
+func TestJoinCleanupError(t *testing.T) {
+	r := &run{id: "abcd1234"}
+
+	// Without failed cleanups nothing is joined
+	runErr := errors.New("write failed")
+	err := runErr
+	r.joinCleanupError(&err)
+	if err != runErr {
+		t.Errorf("joinCleanupError() changed the error to %v", err)
+	}
+
+	deleteErr := errors.New("server is locked")
+	r.cleanupError().addServer(42, deleteErr)
+
+	// Successful runs only report the cleanup error through the result
+	err = nil
+	r.joinCleanupError(&err)
+	if err != nil {
+		t.Errorf("joinCleanupError() set the error of a successful run to %v", err)
+	}
+
+	err = runErr
+	r.joinCleanupError(&err)
+	var cleanupErr *CleanupError
+	if !errors.Is(err, runErr) || !errors.As(err, &cleanupErr) || !errors.Is(err, deleteErr) {
+		t.Errorf("joinCleanupError() = %v, want both errors", err)
+	}
+
+	r.warn(context.Background(), "shutdown failed", "server", 42, "error", "timeout")
+	r.cleanup.SSHKeyDeleted = true
+	r.bytesTransferred = 5
+
+	result := &UploadResult{}
+	r.result(result)
+	if result.RunID != r.id || result.BytesTransferred != 5 || !result.Cleanup.SSHKeyDeleted || result.Cleanup.Err != cleanupErr {
+		t.Errorf("result() = %+v", result)
+	}
+	if !slices.Equal(result.Warnings, []string{"shutdown failed server=42 error=timeout"}) {
+		t.Errorf("result() has warnings %q", result.Warnings)
+	}
+	if !strings.Contains(result.Cleanup.Err.Error(), "servers [42]") {
+		t.Errorf("cleanup error = %q, want the leaked server", result.Cleanup.Err)
+	}
+}
+
+func TestWaitForImage(t *testing.T) {
+	tests := []struct {
+		name    string
+		request mockutil.Request
+		wantErr bool
+	}{
+		{
+			name: "available",
+			request: mockutil.Request{
+				Method: "GET", Path: "/images/5",
+				Status:  http.StatusOK,
+				JSONRaw: `{"image": {"id": 5, "status": "available", "image_size": 1.5}}`,
+			},
+		},
+		{
+			name: "unexpected status",
+			request: mockutil.Request{
+				Method: "GET", Path: "/images/5",
+				Status:  http.StatusOK,
+				JSONRaw: `{"image": {"id": 5, "status": "unavailable"}}`,
+			},
+			wantErr: true,
+		},
+		{
+			name: "not found",
+			request: mockutil.Request{
+				Method: "GET", Path: "/images/5",
+				Status:  http.StatusNotFound,
+				JSONRaw: apiError(hcloud.ErrorCodeNotFound),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, []mockutil.Request{tt.request})
+
+			image, err := client.waitForImage(context.Background(), &hcloud.Image{ID: 5, Status: hcloud.ImageStatusCreating})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("waitForImage() = %+v, want an error", image)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if image.ID != 5 || image.ImageSize != 1.5 {
+				t.Errorf("waitForImage() = %+v, want the refreshed image", image)
+			}
+		})
+	}
+}
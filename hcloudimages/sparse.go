@@ -0,0 +1,139 @@
+package hcloudimages
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/progress"
+)
+
+const (
+	// sparseTransferBlockSize is the size of the blocks of a local raw image that are checked for zeros. Smaller blocks
+	// skip more zeros, but the rescue system runs dd once for every extent.
+	sparseTransferBlockSize = 1024 * 1024
+
+	// seekData and seekHole are the whence values of lseek that find the data and holes of sparse files. They are the
+	// same on Linux, macOS and FreeBSD. Other systems return an error, the whole file is then checked for zeros.
+	seekData = 3
+	seekHole = 4
+)
+
+// region is a range of a file from Start up to End.
+type region struct {
+	Start, End int64
+}
+
+// sparseFile returns the local raw image, if only its data is sent to the rescue system instead of the whole image.
+// The disk is discarded before the image is written, so holes and blocks of zeros are skipped.
+func sparseFile(options WriteOptions) (*os.File, int64, bool) {
+	if options.ImageURL != nil || options.ImageCompression != CompressionNone || options.ImageFormat != FormatRaw || options.ArchiveMember != "" {
+		return nil, 0, false
+	}
+
+	file, ok := options.ImageReader.(*os.File)
+	if !ok {
+		return nil, 0, false
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, 0, false
+	}
+	return file, info.Size(), true
+}
+
+// dataRegions returns the regions of the file that contain data, the rest are holes that read as zeros. If the file
+// system or operating system can not tell, the whole file is returned as data.
+func dataRegions(file *os.File, size int64) []region {
+	var regions []region
+	for offset := int64(0); offset < size; {
+		start, err := file.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// Only a hole is left until the end of the file
+			break
+		}
+		if err != nil {
+			return []region{{Start: 0, End: size}}
+		}
+		end, err := file.Seek(start, seekHole)
+		if err != nil {
+			return []region{{Start: 0, End: size}}
+		}
+		if start >= size {
+			break
+		}
+
+		regions = append(regions, region{Start: start, End: min(end, size)})
+		offset = end
+	}
+	return regions
+}
+
+// sparseStats describes the extents that [writeSparse] sent.
+type sparseStats struct {
+	// Size of the image, and how many bytes of it were sent
+	Size int64
+	Sent int64
+}
+
+// writeSparse sends the data of the image to w as extents for [extentCommand]. Only the data regions are read, blocks
+// that only contain zeros are skipped. All bytes of the image, including the skipped ones, are added to tracker.
+//
+// If checksum is set, the whole image is hashed, the holes as zeros. The stream is only ended if the checksum matches.
+func writeSparse(w io.Writer, image io.ReaderAt, size int64, regions []region, tracker *progress.Tracker, checksum *checksumVerifier) (sparseStats, error) {
+	stats := sparseStats{Size: size}
+	extents := &extentWriter{w: w}
+	block := make([]byte, sparseTransferBlockSize)
+
+	// skip counts the zeros from offset up to end as read
+	offset := int64(0)
+	skip := func(end int64) {
+		if checksum != nil {
+			for remaining := end - offset; remaining > 0; {
+				n := min(remaining, int64(len(zeroBlock)))
+				checksum.hash.Write(zeroBlock[:n])
+				remaining -= n
+			}
+		}
+		tracker.Add(end - offset)
+		offset = end
+	}
+
+	for _, r := range regions {
+		skip(r.Start)
+
+		for offset < r.End {
+			// Blocks are aligned to the image, so a block of zeros is found even if the region starts in the middle
+			buf := block[:min(sparseTransferBlockSize-offset%sparseTransferBlockSize, r.End-offset)]
+			if n, err := image.ReadAt(buf, offset); n < len(buf) {
+				return stats, fmt.Errorf("failed to read the image: %w", err)
+			}
+
+			if isZero(buf) {
+				skip(offset + int64(len(buf)))
+				continue
+			}
+
+			if checksum != nil {
+				checksum.hash.Write(buf)
+			}
+			if err := extents.write(offset, buf); err != nil {
+				return stats, err
+			}
+			stats.Sent += int64(len(buf))
+			tracker.Add(int64(len(buf)))
+			offset += int64(len(buf))
+		}
+	}
+	skip(size)
+
+	if checksum != nil {
+		if err := checksum.verify(); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, extents.close()
+}
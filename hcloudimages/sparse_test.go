@@ -0,0 +1,131 @@
+package hcloudimages
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/progress"
+)
+
+func TestWriteSparse(t *testing.T) {
+	size := 10*sparseTransferBlockSize + 123
+
+	// Data at the start, in the middle of a block that is otherwise a hole, and up to the unaligned end
+	data := []struct {
+		offset int
+		data   []byte
+	}{
+		{offset: 0, data: bytes.Repeat([]byte("start"), 1000)},
+		{offset: 4*sparseTransferBlockSize + 5000, data: []byte("middle")},
+		{offset: size - 10, data: []byte("end of img")},
+	}
+
+	path := filepath.Join(t.TempDir(), "image.raw")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = file.Close() }()
+	if err := file.Truncate(int64(size)); err != nil {
+		t.Fatal(err)
+	}
+
+	image := make([]byte, size)
+	for _, d := range data {
+		copy(image[d.offset:], d.data)
+		if _, err := file.WriteAt(d.data, int64(d.offset)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Zeros that are written as data, they are not sent either
+	if _, err := file.WriteAt(make([]byte, 2*sparseTransferBlockSize), 6*sparseTransferBlockSize); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(image)
+
+	tests := []struct {
+		name     string
+		checksum string
+		wantErr  error
+	}{
+		{name: "without checksum"},
+		{name: "matching checksum", checksum: hex.EncodeToString(sum[:])},
+		{name: "wrong checksum", checksum: "0000000000000000000000000000000000000000000000000000000000000000", wantErr: ErrChecksumMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checksum, err := newChecksumVerifier(tt.checksum)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var stream bytes.Buffer
+			tracker := &progress.Tracker{}
+			stats, err := writeSparse(&stream, file, int64(size), dataRegions(file, int64(size)), tracker, checksum)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("writeSparse() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := int64(3 * sparseTransferBlockSize); stats.Sent > want {
+				t.Errorf("writeSparse() sent %d bytes, want at most %d", stats.Sent, want)
+			}
+			if tracker.Read() != int64(size) {
+				t.Errorf("tracker counted %d bytes, want %d", tracker.Read(), size)
+			}
+
+			disk := make([]byte, size)
+			if err := applyExtents(disk, &stream); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(disk, image) {
+				t.Errorf("disk does not match the image after the extents were applied")
+			}
+		})
+	}
+}
+
+func TestDataRegions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.raw")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = file.Close() }()
+
+	if err := file.Truncate(16 * sparseTransferBlockSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte("data"), 8*sparseTransferBlockSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// File systems without support for holes report the whole file as data
+	regions := dataRegions(file, 16*sparseTransferBlockSize)
+	if len(regions) == 0 {
+		t.Fatal("dataRegions() returned no regions")
+	}
+	covered := false
+	for i, r := range regions {
+		if r.Start >= r.End || (i > 0 && r.Start < regions[i-1].End) {
+			t.Errorf("dataRegions() returned invalid regions %v", regions)
+		}
+		if r.Start <= 8*sparseTransferBlockSize && r.End >= 8*sparseTransferBlockSize+4 {
+			covered = true
+		}
+	}
+	if !covered {
+		t.Errorf("dataRegions() = %v, want a region with the data at %d", regions, 8*sparseTransferBlockSize)
+	}
+}
@@ -0,0 +1,81 @@
+package hcloudimages
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// validateTransferCompression checks that [WriteOptions.TransferCompression] is supported.
+func validateTransferCompression(compression Compression) error {
+	switch compression {
+	case CompressionNone, CompressionZSTD:
+		return nil
+	default:
+		return fmt.Errorf("unsupported transfer compression: %q", compression)
+	}
+}
+
+// compressTransfer reports whether the image is compressed with [WriteOptions.TransferCompression] while it is sent
+// to the rescue system. Images from an URL are downloaded by the rescue system, and compressed images are sent as
+// they are.
+func compressTransfer(options WriteOptions) bool {
+	return options.TransferCompression != CompressionNone && options.ImageURL == nil && options.ImageCompression == CompressionNone
+}
+
+// transferTools adds the tools that decompress the stream from the client to tools, if
+// [WriteOptions.TransferCompression] is set. They are only probed, the image is sent uncompressed if they are missing.
+func transferTools(tools []string, options WriteOptions) []string {
+	if options.TransferCompression == CompressionZSTD && !slices.Contains(tools, "zstd") {
+		tools = append(tools, "zstd")
+	}
+	return tools
+}
+
+// decompressTransferCommand returns the command that decompresses the stream from the client in the rescue system,
+// or "" if it is not compressed.
+func decompressTransferCommand(options WriteOptions) string {
+	if !compressTransfer(options) {
+		return ""
+	}
+	return "zstd -cd"
+}
+
+// compressStream compresses r with zstd while the returned reader is read. The returned function stops the
+// compression and returns the error of reading r. It must always be called, and may be called more than once.
+func compressStream(r io.Reader) (io.Reader, func() error) {
+	pr, pw := io.Pipe()
+	compressErr := make(chan error, 1)
+
+	go func() {
+		err := func() error {
+			// The fastest level keeps up with fast connections and still removes most of the zeros of a disk image
+			encoder, err := zstd.NewWriter(pw, zstd.WithEncoderLevel(zstd.SpeedFastest))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(encoder, r); err != nil {
+				// The frame is not finished, so the rescue system fails to decompress the stream
+				encoder.Reset(io.Discard)
+				return err
+			}
+			return encoder.Close()
+		}()
+		compressErr <- err
+		_ = pw.CloseWithError(err)
+	}()
+
+	stop := sync.OnceValue(func() error {
+		_ = pr.Close()
+		err := <-compressErr
+		if errors.Is(err, io.ErrClosedPipe) {
+			return nil
+		}
+		return err
+	})
+	return pr, stop
+}
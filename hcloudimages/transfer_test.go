@@ -0,0 +1,75 @@
+package hcloudimages
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressStream(t *testing.T) {
+	image := append(bytes.Repeat([]byte("data"), 100000), make([]byte, 4*1024*1024)...)
+	readErr := errors.New("read failed")
+
+	tests := []struct {
+		name    string
+		image   io.Reader
+		wantErr error
+	}{
+		{name: "complete image", image: bytes.NewReader(image)},
+		{name: "read error", image: io.MultiReader(bytes.NewReader(image[:1000]), iotest.ErrReader(readErr)), wantErr: readErr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed, stop := compressStream(tt.image)
+			defer func() { _ = stop() }()
+
+			decoder, err := zstd.NewReader(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer decoder.Close()
+			data, decodeErr := io.ReadAll(decoder)
+
+			if err := stop(); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("compressStream() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if decodeErr == nil {
+					t.Error("decompressing the incomplete stream succeeded")
+				}
+				return
+			}
+			if decodeErr != nil {
+				t.Fatal(decodeErr)
+			}
+			if !bytes.Equal(data, image) {
+				t.Errorf("decompressed %d bytes that do not match the image", len(data))
+			}
+		})
+	}
+}
+
+func TestCompressTransfer(t *testing.T) {
+	tests := []struct {
+		name    string
+		options WriteOptions
+		want    bool
+	}{
+		{name: "local raw", options: WriteOptions{TransferCompression: CompressionZSTD}, want: true},
+		{name: "local qcow2", options: WriteOptions{TransferCompression: CompressionZSTD, ImageFormat: FormatQCOW2}, want: true},
+		{name: "not enabled", options: WriteOptions{}},
+		{name: "compressed image", options: WriteOptions{TransferCompression: CompressionZSTD, ImageCompression: CompressionXZ}},
+		{name: "remote image", options: WriteOptions{TransferCompression: CompressionZSTD, ImageURL: mustParseURL("https://example.com/image.raw")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compressTransfer(tt.options); got != tt.want {
+				t.Errorf("compressTransfer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,470 @@
+package hcloudimages
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/contextlogger"
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/journal"
+)
+
+const (
+	// scratchMountpoint is where the scratch volume is mounted in the rescue system.
+	scratchMountpoint = "/mnt/scratch"
+)
+
+// volumeDevice returns the path of the volume in the rescue system.
+func volumeDevice(volume *hcloud.Volume) string {
+	if volume.LinuxDevice != "" {
+		return volume.LinuxDevice
+	}
+	return fmt.Sprintf("/dev/disk/by-id/scsi-0HC_Volume_%d", volume.ID)
+}
+
+// stagesImage reports whether the image is stored in the rescue system before it is written, because it needs random
+// access. Raw images are streamed directly to the disk.
+func stagesImage(options WriteOptions) bool {
+	return options.ImageFormat != FormatRaw || options.ImageCompression == CompressionZIP
+}
+
+// useScratchVolume reports whether a scratch volume is created for the image.
+func useScratchVolume(options WriteOptions) bool {
+	return options.ScratchVolumeSize > 0 && stagesImage(options)
+}
+
+// stagingLimit returns the size in bytes of the file system that images are staged on, if they need random access.
+// The root file system of the rescue system is backed by memory, so it is also limited by the available memory. It
+// returns 0 if the rescue system was not probed yet.
+func stagingLimit(options WriteOptions, rescue *rescueSystem) int64 {
+	switch {
+	case useScratchVolume(options):
+		return int64(options.ScratchVolumeSize) * 1024 * 1024 * 1024
+	case rescue != nil:
+		return min(rescue.StagingAvailable, rescue.MemoryAvailable)
+	default:
+		return 0
+	}
+}
+
+// createScratchVolume creates a volume for [WriteOptions.ScratchVolumeSize] and attaches it to the server. The
+// returned function deletes the volume again, it is also returned with an error if the volume was already created.
+func (s *Client) createScratchVolume(ctx context.Context, r *run, number int, resourceName string, labels map[string]string, options WriteOptions) (*hcloud.Volume, func(), error) {
+	logger := contextlogger.From(ctx)
+
+	st := r.startStep(ctx, number, StepCreateVolume, "Creating scratch volume")
+	result, _, err := s.c.Volume.Create(ctx, hcloud.VolumeCreateOpts{
+		Name:   resourceName,
+		Size:   options.ScratchVolumeSize,
+		Server: options.Server,
+		Labels: labels,
+		// Formatted by the API, so the rescue system only needs to mount it
+		Format:    hcloud.Ptr(hcloud.VolumeFormatExt4),
+		Automount: hcloud.Ptr(false),
+	})
+	if err != nil {
+		return nil, nil, st.fail(ctx, fmt.Errorf("creating the scratch volume failed: %w", err))
+	}
+	volume := result.Volume
+	logger.DebugContext(ctx, "Created volume", "volume", volume.ID)
+	r.resources.VolumeID = volume.ID
+	r.track(ctx, journal.ResourceVolume, volume.ID, volume.Name)
+	r.heartbeat.addVolume(volume)
+
+	cleanup := func() {
+		r.heartbeat.removeVolume(volume)
+
+		// The context might already be cancelled, but we still want to delete the volume
+		ctx, cancel := cleanupContext(ctx)
+		defer cancel()
+
+		st := r.startStep(ctx, 0, StepDeleteVolume, "Deleting scratch volume")
+
+		if err := s.deleteVolume(ctx, volume); err != nil {
+			r.warn(ctx, "Cleanup: scratch volume could not be deleted", "error", err)
+			r.cleanupError().addVolume(volume.ID, err)
+			_ = st.fail(ctx, err)
+			return
+		}
+		r.untrack(ctx, journal.ResourceVolume, volume.ID)
+		r.cleanup.VolumeDeleted = true
+		st.done(ctx)
+	}
+
+	st.waitingOn(result.Action)
+	err = s.c.Action.WaitFor(ctx, append(result.NextActions, result.Action)...)
+	if err != nil {
+		return nil, cleanup, st.fail(ctx, fmt.Errorf("creating the scratch volume failed: %w", err))
+	}
+	st.done(ctx)
+
+	return volume, cleanup, nil
+}
+
+// deleteVolume detaches the volume if necessary and deletes it.
+func (s *Client) deleteVolume(ctx context.Context, volume *hcloud.Volume) error {
+	current, _, err := s.c.Volume.GetByID(ctx, volume.ID)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		// Already gone
+		return nil
+	}
+
+	if current.Server != nil {
+		action, _, err := s.c.Volume.Detach(ctx, current)
+		if err != nil {
+			return fmt.Errorf("failed to detach volume: %w", err)
+		}
+		if err := s.c.Action.WaitFor(ctx, action); err != nil {
+			return fmt.Errorf("failed to detach volume: %w", err)
+		}
+	}
+
+	_, err = s.c.Volume.Delete(ctx, current)
+	return err
+}
+
+func (s *Client) cleanupTempVolumes(ctx context.Context, logger *slog.Logger, selector string, opts CleanupOptions) error {
+	allVolumes, err := s.c.Volume.AllWithOpts(ctx, hcloud.VolumeListOpts{ListOpts: hcloud.ListOpts{
+		LabelSelector: selector,
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to list volumes: %w", err)
+	}
+
+	now := time.Now()
+	volumes := make([]*hcloud.Volume, 0, len(allVolumes))
+	for _, volume := range allVolumes {
+		if !shouldCleanup(volume.Labels, volume.Created, opts, now) {
+			logger.InfoContext(ctx, "skipping volume", "volume", volume.ID, "run-id", volume.Labels[RunIDLabel])
+			continue
+		}
+		volumes = append(volumes, volume)
+	}
+
+	if len(volumes) == 0 {
+		logger.InfoContext(ctx, "No volumes found")
+		return nil
+	}
+
+	if opts.DryRun {
+		for _, volume := range volumes {
+			logger.InfoContext(ctx, "Dry run: would delete volume", "volume", volume.ID, "name", volume.Name)
+		}
+		return nil
+	}
+
+	cleanupErr := &CleanupError{}
+	for _, volume := range volumes {
+		err := s.deleteVolume(ctx, volume)
+		s.emitCleanup(ctx, StepDeleteVolume, volume.Labels[RunIDLabel], Resources{VolumeID: volume.ID}, err)
+		if err != nil {
+			cleanupErr.addVolume(volume.ID, err)
+			logger.WarnContext(ctx, "failed to delete volume", "volume", volume.ID, "error", err)
+			continue
+		}
+	}
+
+	if cleanupErr.Err != nil {
+		return cleanupErr
+	}
+
+	return nil
+}
+
+// WriteToVolumeOptions are the options for [Client.WriteToVolume].
+type WriteToVolumeOptions struct {
+	// WriteOptions describe the image. [WriteOptions.Server] and [WriteOptions.TargetDevice] are set by
+	// [Client.WriteToVolume].
+	WriteOptions
+
+	// Volume is an existing Volume that the image is written to. It must not be attached to a server. Any existing
+	// data on the Volume is lost.
+	//
+	// Mutually exclusive with [WriteToVolumeOptions.VolumeSize].
+	Volume *hcloud.Volume
+
+	// VolumeSize is the size in GB of a new Volume that is created for the image. The minimum size is 10 GB.
+	//
+	// Mutually exclusive with [WriteToVolumeOptions.Volume].
+	VolumeSize int
+
+	// VolumeName is the name of the new Volume. Defaults to the name of the temporary resources.
+	VolumeName string
+
+	// Labels will be added to the new Volume. Until the image was written, the Volume carries the labels of the
+	// temporary resources instead, so a cleanup removes it if the run crashed. Unlike for [Client.Upload], the
+	// [CreatedByLabel] is not kept, as [Client.CleanupTempResources] would delete the Volume otherwise.
+	Labels map[string]string
+
+	// Location is the location of the new Volume and the temporary server. Defaults to fsn1 if not specified. For an
+	// existing Volume, the location of the Volume is used.
+	Location *hcloud.Location
+
+	// Architecture and ServerType select the temporary server, like [UploadOptions.Architecture] and
+	// [UploadOptions.ServerType]. Defaults to [hcloud.ArchitectureX86].
+	Architecture hcloud.Architecture
+	ServerType   *hcloud.ServerType
+
+	// DebugSkipResourceCleanup will skip the cleanup of the temporary SSH Key and Server.
+	DebugSkipResourceCleanup bool
+}
+
+// WriteToVolume writes the specified image to a Volume on Hetzner Cloud.
+//
+// A temporary server is created in the location of the Volume, the Volume is attached to it, and the image is written
+// to the block device of the Volume. The Volume is detached again once the image was written, and the temporary server
+// is deleted. If a new Volume was created and writing the image fails, the Volume is deleted as well.
+//
+// If [WriteOptions.DryRun] is set, nothing is created and the returned Volume is nil.
+func (s *Client) WriteToVolume(ctx context.Context, options WriteToVolumeOptions) (volume *hcloud.Volume, err error) {
+	if (options.Volume == nil) == (options.VolumeSize == 0) {
+		return nil, fmt.Errorf("exactly one of Volume and VolumeSize must be set")
+	}
+	if options.Volume == nil && options.VolumeSize < 10 {
+		return nil, fmt.Errorf("volume size must be at least 10 GB, got %d", options.VolumeSize)
+	}
+	if options.Architecture == "" && options.ServerType == nil {
+		options.Architecture = hcloud.ArchitectureX86
+	}
+
+	if options.Volume != nil {
+		existing, _, err := s.c.Volume.GetByID(ctx, options.Volume.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get volume %d: %w", options.Volume.ID, err)
+		}
+		if existing == nil {
+			return nil, fmt.Errorf("volume %d not found", options.Volume.ID)
+		}
+		if existing.Server != nil {
+			return nil, fmt.Errorf("volume %d is attached to server %d, detach it first", existing.ID, existing.Server.ID)
+		}
+		options.Volume = existing
+		options.Location = existing.Location
+	}
+
+	if options.DryRun {
+		plan, err := s.planWriteToVolume(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+		plan.log(ctx)
+		return nil, nil
+	}
+
+	ctx, r, err := s.newRun(ctx, "write-to-volume")
+	if err != nil {
+		return nil, err
+	}
+	defer r.closeJournal(ctx)
+	defer r.joinCleanupError(&err)
+	logger := contextlogger.From(ctx)
+
+	options.WriteOptions, err = detectImage(ctx, options.WriteOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var removeTempFile func()
+	options.WriteOptions, removeTempFile, err = prepareImage(ctx, options.WriteOptions)
+	defer removeTempFile()
+	if err != nil {
+		return nil, err
+	}
+
+	resourceName := resourcePrefix + r.id
+	tempLabels := r.tempLabels(DefaultLabels)
+	r.heartbeat = s.startHeartbeat(ctx, tempLabels)
+	defer r.heartbeat.stop()
+
+	// 1. Create SSH Key
+	key, privateKey, keyCleanup, err := s.generateSSHKey(ctx, r, 1, resourceName, tempLabels)
+	if err != nil {
+		return nil, err
+	}
+	defer keyCleanup(options.DebugSkipResourceCleanup)
+
+	// 2. Create Server
+	server, serverCleanup, err := s.createServer(ctx, r, 2, resourceName, tempLabels, key, defaultImage, options.Architecture, options.ServerType, options.Location, options.DebugSkipResourceCleanup)
+	if serverCleanup != nil {
+		defer serverCleanup()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. Create or attach Volume
+	var written bool
+	if options.Volume != nil {
+		volume = options.Volume
+		err = s.attachVolume(ctx, r, 3, volume, server)
+	} else {
+		var volumeCleanup func()
+		volume, volumeCleanup, err = s.createVolume(ctx, r, 3, server, tempLabels, options)
+		if volumeCleanup != nil {
+			defer func() {
+				// Only delete the new Volume if it does not contain the image
+				if err != nil && !written {
+					volumeCleanup()
+				}
+			}()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger = logger.With("volume", volume.ID)
+
+	// Steps 4-10, or 4-11 with a scratch volume
+	options.Server = server
+	options.TargetDevice = volumeDevice(volume)
+	next, err := s.write(ctx, r, options.WriteOptions, false, 4, key, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The Volume contains the image now, it is kept even if a later step fails
+	written = true
+
+	// 11. Detach Volume
+	return s.finishVolume(ctx, r, next, volume, options)
+}
+
+// finishVolume detaches the Volume after the image was written to it. A new Volume is handed over to the caller through
+// [Client.releaseVolume] first, so it is not deleted if detaching fails.
+func (s *Client) finishVolume(ctx context.Context, r *run, number int, volume *hcloud.Volume, options WriteToVolumeOptions) (*hcloud.Volume, error) {
+	logger := contextlogger.From(ctx).With("volume", volume.ID)
+
+	if options.Volume == nil {
+		s.releaseVolume(ctx, r, volume, options.Labels)
+	}
+
+	st := r.startStep(ctx, number, StepDetachVolume, "Detaching Volume")
+	action, _, err := s.c.Volume.Detach(ctx, volume)
+	if err != nil {
+		return nil, st.fail(ctx, fmt.Errorf("detaching the volume failed: %w", err))
+	}
+	st.waitingOn(action)
+	if err = s.c.Action.WaitFor(ctx, action); err != nil {
+		return nil, st.fail(ctx, fmt.Errorf("detaching the volume failed: %w", err))
+	}
+	st.done(ctx)
+
+	logger.InfoContext(ctx, "# Image was written to the volume")
+
+	refreshed, _, err := s.c.Volume.GetByID(ctx, volume.ID)
+	if err != nil || refreshed == nil {
+		r.warn(ctx, "failed to refresh the volume", "error", err)
+		return volume, nil
+	}
+
+	// Resource cleanup is happening in `defer`
+	return refreshed, nil
+}
+
+// createVolume creates the Volume for [WriteToVolumeOptions.VolumeSize], attached to the server. Like the other
+// temporary resources, it is created with labels and recorded in the journal of the run until [Client.releaseVolume]
+// hands it over. The returned function deletes the Volume again, it is also returned with an error if the Volume was
+// already created.
+func (s *Client) createVolume(ctx context.Context, r *run, number int, server *hcloud.Server, labels map[string]string, options WriteToVolumeOptions) (*hcloud.Volume, func(), error) {
+	logger := contextlogger.From(ctx)
+
+	name := options.VolumeName
+	if name == "" {
+		name = resourcePrefix + r.id
+	}
+
+	st := r.startStep(ctx, number, StepCreateVolume, "Creating Volume")
+	result, _, err := s.c.Volume.Create(ctx, hcloud.VolumeCreateOpts{
+		Name:   name,
+		Size:   options.VolumeSize,
+		Server: server,
+		Labels: labels,
+		// The image brings its own partitions or file system
+		Automount: hcloud.Ptr(false),
+	})
+	if err != nil {
+		return nil, nil, st.fail(ctx, fmt.Errorf("creating the volume failed: %w", err))
+	}
+	volume := result.Volume
+	logger.DebugContext(ctx, "Created volume", "volume", volume.ID)
+	r.resources.VolumeID = volume.ID
+	r.track(ctx, journal.ResourceVolume, volume.ID, volume.Name)
+	r.heartbeat.addVolume(volume)
+
+	cleanup := func() {
+		r.heartbeat.removeVolume(volume)
+
+		// The context might already be cancelled, but we still want to delete the volume
+		ctx, cancel := cleanupContext(ctx)
+		defer cancel()
+
+		st := r.startStep(ctx, 0, StepDeleteVolume, "Deleting Volume")
+
+		if err := s.deleteVolume(ctx, volume); err != nil {
+			r.warn(ctx, "Cleanup: volume could not be deleted", "error", err)
+			r.cleanupError().addVolume(volume.ID, err)
+			_ = st.fail(ctx, err)
+			return
+		}
+		r.untrack(ctx, journal.ResourceVolume, volume.ID)
+		r.cleanup.VolumeDeleted = true
+		st.done(ctx)
+	}
+
+	st.waitingOn(result.Action)
+	err = s.c.Action.WaitFor(ctx, append(result.NextActions, result.Action)...)
+	if err != nil {
+		return nil, cleanup, st.fail(ctx, fmt.Errorf("creating the volume failed: %w", err))
+	}
+	st.done(ctx)
+
+	return volume, cleanup, nil
+}
+
+// releaseVolume replaces the labels of the temporary resources on a Volume from [Client.createVolume] with labels
+// and removes it from the journal, so it is no longer deleted by a cleanup. The Volume already holds the image, so if
+// the labels can not be updated, only a warning is logged.
+func (s *Client) releaseVolume(ctx context.Context, r *run, volume *hcloud.Volume, labels map[string]string) {
+	// Otherwise the next heartbeat would restore the labels
+	r.heartbeat.removeVolume(volume)
+
+	if labels == nil {
+		// Without any labels, the existing ones are not removed
+		labels = map[string]string{}
+	}
+	_, _, err := s.c.Volume.Update(ctx, volume, hcloud.VolumeUpdateOpts{Labels: labels})
+	if err != nil {
+		r.warn(ctx, "volume still has the labels of the temporary resources, remove them before running the cleanup command",
+			"volume", volume.ID, "error", err,
+		)
+	}
+	r.untrack(ctx, journal.ResourceVolume, volume.ID)
+}
+
+// attachVolume attaches the existing Volume to the server.
+func (s *Client) attachVolume(ctx context.Context, r *run, number int, volume *hcloud.Volume, server *hcloud.Server) error {
+	st := r.startStep(ctx, number, StepAttachVolume, "Attaching Volume")
+	r.resources.VolumeID = volume.ID
+
+	action, _, err := s.c.Volume.AttachWithOpts(ctx, volume, hcloud.VolumeAttachOpts{
+		Server:    server,
+		Automount: hcloud.Ptr(false),
+	})
+	if err != nil {
+		return st.fail(ctx, fmt.Errorf("attaching the volume failed: %w", err))
+	}
+
+	st.waitingOn(action)
+	if err := s.c.Action.WaitFor(ctx, action); err != nil {
+		return st.fail(ctx, fmt.Errorf("attaching the volume failed: %w", err))
+	}
+	st.done(ctx)
+
+	return nil
+}
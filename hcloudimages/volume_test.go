@@ -0,0 +1,396 @@
+package hcloudimages
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/exp/mockutil"
+
+	"github.com/apricote/hcloud-upload-image/hcloudimages/v2/internal/journal"
+)
+
+// pendingVolumes returns the IDs of the volumes in the journals in dir that were not deleted yet. It is also called by
+// the fake API, so it does not stop the test.
+func pendingVolumes(t *testing.T, dir string) []int64 {
+	t.Helper()
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	var ids []int64
+	for _, path := range paths {
+		j, err := journal.Open(path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		for _, resource := range j.Pending() {
+			if resource.Type == journal.ResourceVolume {
+				ids = append(ids, resource.ID)
+			}
+		}
+	}
+	return ids
+}
+
+func TestWriteToVolumeOptions(t *testing.T) {
+	image := WriteOptions{ImageReader: bytes.NewReader([]byte("image"))}
+
+	tests := []struct {
+		name     string
+		options  WriteToVolumeOptions
+		requests []mockutil.Request
+	}{
+		{
+			name:    "no volume",
+			options: WriteToVolumeOptions{WriteOptions: image},
+		},
+		{
+			name:    "volume and size",
+			options: WriteToVolumeOptions{WriteOptions: image, Volume: &hcloud.Volume{ID: 7}, VolumeSize: 10},
+		},
+		{
+			name:    "size too small",
+			options: WriteToVolumeOptions{WriteOptions: image, VolumeSize: 9},
+		},
+		{
+			name:    "volume not found",
+			options: WriteToVolumeOptions{WriteOptions: image, Volume: &hcloud.Volume{ID: 7}},
+			requests: []mockutil.Request{
+				{
+					Method: "GET", Path: "/volumes/7",
+					Status:  http.StatusNotFound,
+					JSONRaw: apiError(hcloud.ErrorCodeNotFound),
+				},
+			},
+		},
+		{
+			name:    "volume is attached",
+			options: WriteToVolumeOptions{WriteOptions: image, Volume: &hcloud.Volume{ID: 7}},
+			requests: []mockutil.Request{
+				{
+					Method: "GET", Path: "/volumes/7",
+					Status:  http.StatusOK,
+					JSONRaw: `{"volume": {"id": 7, "name": "data", "server": 42, "location": {"id": 1, "name": "fsn1"}}}`,
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, tt.requests)
+
+			volume, err := client.WriteToVolume(context.Background(), tt.options)
+			if err == nil {
+				t.Errorf("WriteToVolume() = %+v, want an error", volume)
+			}
+		})
+	}
+}
+
+func TestWriteToVolumeFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	createServerRequest := mockutil.Request{
+		Method: "POST", Path: "/servers",
+		Status: http.StatusCreated,
+		JSONRaw: `{
+			"server": {"id": 42, "name": "hcloud-upload-image-abcd1234"},
+			"action": {"id": 2, "status": "success"},
+			"next_actions": []
+		}`,
+	}
+	deleteServerRequest := mockutil.Request{
+		Method: "DELETE", Path: "/servers/42",
+		Status:  http.StatusOK,
+		JSONRaw: `{"action": {"id": 3, "status": "success"}}`,
+	}
+
+	tests := []struct {
+		name     string
+		options  WriteToVolumeOptions
+		requests []mockutil.Request
+
+		// Writing the image always fails in its first step, after the volume was prepared
+		wantSteps []string
+	}{
+		{
+			name: "new volume",
+			options: WriteToVolumeOptions{
+				VolumeSize: 10,
+				VolumeName: "data",
+				Labels:     map[string]string{"app": "test"},
+			},
+			requests: []mockutil.Request{
+				createSSHKeyRequest,
+				createServerRequest,
+				{
+					Method: "POST", Path: "/volumes",
+					Want: func(t *testing.T, r *http.Request) {
+						var body struct {
+							Name      string            `json:"name"`
+							Size      int               `json:"size"`
+							Server    int64             `json:"server"`
+							Labels    map[string]string `json:"labels"`
+							Automount bool              `json:"automount"`
+						}
+						if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+							t.Error(err)
+							return
+						}
+						if body.Name != "data" || body.Size != 10 || body.Server != 42 || body.Automount {
+							t.Errorf("volume is created with %+v", body)
+						}
+						// Until the image was written, the volume is a temporary resource
+						if body.Labels[CreatedByLabel] != CreatedByValue || len(body.Labels[RunIDLabel]) != 8 || body.Labels[HeartbeatLabel] == "" {
+							t.Errorf("volume is created with labels %v, want the labels of the temporary resources", body.Labels)
+						}
+					},
+					Status: http.StatusCreated,
+					JSONRaw: `{
+						"volume": {"id": 9, "name": "data", "size": 10},
+						"action": {"id": 4, "status": "success"},
+						"next_actions": [{"id": 5, "status": "success"}]
+					}`,
+				},
+				{
+					Method: "POST", Path: "/servers/42/actions/enable_rescue",
+					Want: func(t *testing.T, _ *http.Request) {
+						// A crash at this point must not leak the volume
+						if ids := pendingVolumes(t, dir); !slices.Equal(ids, []int64{9}) {
+							t.Errorf("journal has pending volumes %v, want the new volume", ids)
+						}
+					},
+					Status:  http.StatusLocked,
+					JSONRaw: apiError(hcloud.ErrorCodeLocked),
+				},
+				// The volume does not contain the image, so it is deleted again
+				{
+					Method: "GET", Path: "/volumes/9",
+					Status:  http.StatusOK,
+					JSONRaw: `{"volume": {"id": 9, "name": "data", "server": 42}}`,
+				},
+				{
+					Method: "POST", Path: "/volumes/9/actions/detach",
+					Status:  http.StatusCreated,
+					JSONRaw: `{"action": {"id": 6, "status": "success"}}`,
+				},
+				{
+					Method: "DELETE", Path: "/volumes/9",
+					Status: http.StatusNoContent,
+				},
+				deleteServerRequest,
+				deleteSSHKeyRequest,
+			},
+			wantSteps: []string{
+				"generate-ssh-key", "create-server", "create-volume", "enable-rescue failed",
+				"delete-volume", "delete-server", "delete-ssh-key",
+			},
+		},
+		{
+			name: "existing volume",
+			options: WriteToVolumeOptions{
+				Volume: &hcloud.Volume{ID: 7},
+			},
+			requests: []mockutil.Request{
+				{
+					Method: "GET", Path: "/volumes/7",
+					Status:  http.StatusOK,
+					JSONRaw: `{"volume": {"id": 7, "name": "data", "location": {"id": 2, "name": "nbg1"}}}`,
+				},
+				createSSHKeyRequest,
+				createServerRequest,
+				{
+					Method: "POST", Path: "/volumes/7/actions/attach",
+					Want: func(t *testing.T, r *http.Request) {
+						var body struct {
+							Server    int64 `json:"server"`
+							Automount bool  `json:"automount"`
+						}
+						if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+							t.Error(err)
+							return
+						}
+						if body.Server != 42 || body.Automount {
+							t.Errorf("volume is attached with %+v", body)
+						}
+					},
+					Status:  http.StatusCreated,
+					JSONRaw: `{"action": {"id": 4, "status": "success"}}`,
+				},
+				{
+					Method: "POST", Path: "/servers/42/actions/enable_rescue",
+					Want: func(t *testing.T, _ *http.Request) {
+						// The volume belongs to the caller and is never deleted
+						if ids := pendingVolumes(t, dir); len(ids) != 0 {
+							t.Errorf("journal has pending volumes %v, want none", ids)
+						}
+					},
+					Status:  http.StatusLocked,
+					JSONRaw: apiError(hcloud.ErrorCodeLocked),
+				},
+				deleteServerRequest,
+				deleteSSHKeyRequest,
+			},
+			wantSteps: []string{
+				"generate-ssh-key", "create-server", "attach-volume", "enable-rescue failed",
+				"delete-server", "delete-ssh-key",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var steps []StepResult
+			client := newTestClient(t, tt.requests, WithJournalDir(dir), WithObserver(ObserverFunc(func(_ context.Context, event Event) {
+				if event.Type != EventStepStarted {
+					steps = append(steps, StepResult{Step: event.Step, Err: event.Err})
+				}
+			})))
+
+			tt.options.WriteOptions = WriteOptions{ImageReader: bytes.NewReader([]byte("image")), ImageSize: 5}
+			volume, err := client.WriteToVolume(context.Background(), tt.options)
+			if err == nil {
+				t.Fatalf("WriteToVolume() = %+v, want an error", volume)
+			}
+
+			if got := stepResults(steps); !slices.Equal(got, tt.wantSteps) {
+				t.Errorf("WriteToVolume() ran steps %v, want %v", got, tt.wantSteps)
+			}
+			if ids := pendingVolumes(t, dir); len(ids) != 0 {
+				t.Errorf("journal has pending volumes %v after the cleanup", ids)
+			}
+		})
+	}
+}
+
+func TestFinishVolume(t *testing.T) {
+	detachRequests := []mockutil.Request{
+		{
+			Method: "POST", Path: "/volumes/9/actions/detach",
+			Status:  http.StatusCreated,
+			JSONRaw: `{"action": {"id": 6, "status": "success"}}`,
+		},
+		{
+			Method: "GET", Path: "/volumes/9",
+			Status:  http.StatusOK,
+			JSONRaw: `{"volume": {"id": 9, "name": "data", "labels": {"app": "test"}}}`,
+		},
+	}
+
+	tests := []struct {
+		name    string
+		options WriteToVolumeOptions
+		// Requests before the Volume is detached
+		requests []mockutil.Request
+
+		wantWarnings int
+	}{
+		{
+			name:    "new volume",
+			options: WriteToVolumeOptions{Labels: map[string]string{"app": "test"}},
+			requests: []mockutil.Request{
+				{
+					Method: "PUT", Path: "/volumes/9",
+					Want: func(t *testing.T, r *http.Request) {
+						var body struct {
+							Labels json.RawMessage `json:"labels"`
+						}
+						if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+							t.Error(err)
+							return
+						}
+						if string(body.Labels) != `{"app":"test"}` {
+							t.Errorf("volume is updated with labels %s", body.Labels)
+						}
+					},
+					Status:  http.StatusOK,
+					JSONRaw: `{"volume": {"id": 9, "name": "data", "labels": {"app": "test"}}}`,
+				},
+			},
+		},
+		{
+			// The labels of the temporary resources must be removed anyway
+			name: "new volume without labels",
+			requests: []mockutil.Request{
+				{
+					Method: "PUT", Path: "/volumes/9",
+					Want: func(t *testing.T, r *http.Request) {
+						var body struct {
+							Labels json.RawMessage `json:"labels"`
+						}
+						if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+							t.Error(err)
+							return
+						}
+						if string(body.Labels) != `{}` {
+							t.Errorf("volume is updated with labels %s", body.Labels)
+						}
+					},
+					Status:  http.StatusOK,
+					JSONRaw: `{"volume": {"id": 9, "name": "data", "labels": {}}}`,
+				},
+			},
+		},
+		{
+			// The Volume holds the image, it must not be deleted over its labels
+			name:    "labels can not be updated",
+			options: WriteToVolumeOptions{Labels: map[string]string{"app": "test"}},
+			requests: []mockutil.Request{
+				{
+					Method: "PUT", Path: "/volumes/9",
+					Status:  http.StatusLocked,
+					JSONRaw: apiError(hcloud.ErrorCodeLocked),
+				},
+			},
+			wantWarnings: 1,
+		},
+		{
+			name:    "existing volume",
+			options: WriteToVolumeOptions{Volume: &hcloud.Volume{ID: 9}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			client := newTestClient(t, append(slices.Clone(tt.requests), detachRequests...), WithJournalDir(dir))
+
+			ctx, r, err := client.newRun(context.Background(), "write-to-volume")
+			if err != nil {
+				t.Fatal(err)
+			}
+			volume := &hcloud.Volume{ID: 9, Name: "data"}
+			r.heartbeat = &heartbeat{}
+			if tt.options.Volume == nil {
+				r.track(ctx, journal.ResourceVolume, volume.ID, volume.Name)
+				r.heartbeat.addVolume(volume)
+			}
+
+			finished, err := client.finishVolume(ctx, r, 11, volume, tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if finished.ID != 9 || finished.Labels["app"] != "test" {
+				t.Errorf("finishVolume() = %+v, want the refreshed volume", finished)
+			}
+			if len(r.warnings) != tt.wantWarnings {
+				t.Errorf("finishVolume() warned %q, want %d warnings", r.warnings, tt.wantWarnings)
+			}
+			if len(r.heartbeat.volumes) != 0 {
+				t.Errorf("heartbeat still updates volumes %v", r.heartbeat.volumes)
+			}
+			if ids := pendingVolumes(t, dir); len(ids) != 0 {
+				t.Errorf("journal has pending volumes %v, want none", ids)
+			}
+		})
+	}
+}
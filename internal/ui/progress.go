@@ -0,0 +1,83 @@
+package ui
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ansiClearLine = "\r\033[K"
+
+	progressBarWidth = 30
+)
+
+// IsTerminal reports whether f is attached to a terminal.
+func IsTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// ProgressBar draws a single line progress bar. Every call to [ProgressBar.Update] replaces the line. It is created
+// through [Handler.NewProgressBar], so log messages and redraws are not mixed. Use [HandlerOptions.ClearLine] to make
+// sure that log messages replace the bar instead of being appended to it.
+type ProgressBar struct {
+	// Shared with the [Handler]
+	mu  *sync.Mutex
+	out io.Writer
+}
+
+// NewProgressBar returns a bar that draws to the output of the handler. It shares the lock of the handler, so a log
+// message is never written in the middle of a redraw.
+func (h *Handler) NewProgressBar() *ProgressBar {
+	return &ProgressBar{mu: h.mu, out: h.out}
+}
+
+// Update redraws the bar. total and eta are optional and can be set to 0 if unknown.
+func (p *ProgressBar) Update(done, total int64, throughput float64, eta time.Duration) {
+	buf := make([]byte, 0, 128)
+	buf = append(buf, ansiClearLine...)
+
+	if total > 0 {
+		ratio := min(float64(done)/float64(total), 1)
+		filled := int(ratio * progressBarWidth)
+
+		buf = fmt.Appendf(buf, "%s[%s%s] %3.0f%% %s / %s",
+			ansiBold, strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), ratio*100, formatBytes(done), formatBytes(total),
+		)
+	} else {
+		buf = fmt.Appendf(buf, "%s%s", ansiBold, formatBytes(done))
+	}
+
+	buf = fmt.Appendf(buf, "%s%s %s/s", ansiClear, ansiThinGray, formatBytes(int64(throughput)))
+	if eta > 0 {
+		buf = fmt.Appendf(buf, " ETA %s", eta.Round(time.Second))
+	}
+	buf = append(buf, ansiClear...)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, _ = p.out.Write(buf)
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -61,6 +61,10 @@ type HandlerOptions struct {
 	// integer seconds since the Unix epoch), sanitize personal information, or
 	// remove attributes from the output.
 	ReplaceAttr func(groups []string, a slog.Attr) slog.Attr
+
+	// ClearLine erases the current line before every record is written. This should be set if a [ProgressBar] is
+	// drawn to the same output, so the log messages replace the bar.
+	ClearLine bool
 }
 
 // groupOrAttrs holds either a group name or a list of [slog.Attr].
@@ -92,6 +96,10 @@ func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
 func (h *Handler) Handle(_ context.Context, record slog.Record) error {
 	buf := make([]byte, 0, 512)
 
+	if h.opts.ClearLine {
+		buf = append(buf, ansiClearLine...)
+	}
+
 	formattingPrefix := ""
 
 	switch record.Level {